@@ -0,0 +1,411 @@
+package caddydefender
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"pkg.jsn.cam/caddy-defender/bans"
+	"pkg.jsn.cam/caddy-defender/ranges/data"
+	"pkg.jsn.cam/caddy-defender/ranges/sources"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// defenders holds the provisioned Defender handlers by their admin ID, so the admin API
+// can report what each of them would decide.
+var (
+	defenders      sync.Map // map[uint64]*Defender
+	nextDefenderID atomic.Uint64
+)
+
+// registerDefender makes m visible to the admin API until unregisterDefender is called.
+func registerDefender(m *Defender) {
+	m.adminID = nextDefenderID.Add(1)
+	defenders.Store(m.adminID, m)
+}
+
+// unregisterDefender hides m from the admin API.
+func unregisterDefender(m *Defender) {
+	defenders.Delete(m.adminID)
+}
+
+// provisionedDefenders returns the registered handlers in the order they were provisioned.
+func provisionedDefenders() []*Defender {
+	var list []*Defender
+	defenders.Range(func(_, value any) bool {
+		list = append(list, value.(*Defender))
+		return true
+	})
+	slices.SortFunc(list, func(a, b *Defender) int { return cmp.Compare(a.adminID, b.adminID) })
+	return list
+}
+
+// adminAPI is a module that provides the /defender/ endpoints of the Caddy admin API:
+//
+//   - GET, POST and DELETE /defender/bans list, add and lift runtime bans
+//   - GET, POST and DELETE /defender/whitelist do the same for runtime whitelist entries
+//   - GET /defender/lookup?ip=<ip> reports the groups and prefixes containing an IP and
+//     what each defender handler would do with a request from it
+//   - GET /defender/policy dumps the effective policy of each defender handler
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.defender",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the routes for the /defender/ endpoints.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/defender/bans",
+			Handler: caddy.AdminHandlerFunc(a.handleBans),
+		},
+		{
+			Pattern: "/defender/whitelist",
+			Handler: caddy.AdminHandlerFunc(a.handleWhitelist),
+		},
+		{
+			Pattern: "/defender/lookup",
+			Handler: caddy.AdminHandlerFunc(a.handleLookup),
+		},
+		{
+			Pattern: "/defender/policy",
+			Handler: caddy.AdminHandlerFunc(a.handlePolicy),
+		},
+	}
+}
+
+// entryRequest is the body of a POST adding a runtime ban or whitelist entry.
+type entryRequest struct {
+	// Prefix is the IP or CIDR to add.
+	Prefix string `json:"prefix"`
+	// Duration is how long the entry lasts, e.g. "2h". Empty for an entry that never expires.
+	Duration string `json:"duration,omitempty"`
+	// Reason describes why the entry was added.
+	Reason string `json:"reason,omitempty"`
+	// Responder names the responder for a banned client. Bans only.
+	Responder string `json:"responder,omitempty"`
+}
+
+// handleBans lists, adds or lifts runtime bans. Bans are also stored in, and lifted from,
+// the storage of the handlers using ban_header.
+func (a adminAPI) handleBans(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return writeJSON(w, orEmpty(banTable.List()))
+	case http.MethodPost:
+		ban, err := decodeEntry(r, true)
+		if err != nil {
+			return err
+		}
+		if err := banTable.Add(ban); err != nil {
+			return apiError(http.StatusBadRequest, err)
+		}
+		for _, storage := range banStorages() {
+			if err := storeBan(r.Context(), storage, ban); err != nil {
+				return apiError(http.StatusInternalServerError, fmt.Errorf("storing ban: %w", err))
+			}
+		}
+		return writeJSON(w, ban)
+	case http.MethodDelete:
+		prefix, err := parsePrefix(r.URL.Query().Get("prefix"))
+		if err != nil {
+			return apiError(http.StatusBadRequest, err)
+		}
+		removed := banTable.Remove(prefix)
+		for _, storage := range banStorages() {
+			if err := deleteBan(r.Context(), storage, prefix); err != nil {
+				return apiError(http.StatusInternalServerError, fmt.Errorf("deleting stored ban: %w", err))
+			}
+		}
+		if !removed {
+			return apiError(http.StatusNotFound, fmt.Errorf("no ban of %s", prefix))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		return apiError(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// handleWhitelist lists, adds or removes runtime whitelist entries, which are kept in memory.
+func (a adminAPI) handleWhitelist(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return writeJSON(w, orEmpty(allowTable.List()))
+	case http.MethodPost:
+		entry, err := decodeEntry(r, false)
+		if err != nil {
+			return err
+		}
+		if err := allowTable.Add(entry); err != nil {
+			return apiError(http.StatusBadRequest, err)
+		}
+		return writeJSON(w, entry)
+	case http.MethodDelete:
+		prefix, err := parsePrefix(r.URL.Query().Get("prefix"))
+		if err != nil {
+			return apiError(http.StatusBadRequest, err)
+		}
+		if !allowTable.Remove(prefix) {
+			return apiError(http.StatusNotFound, fmt.Errorf("no whitelist entry for %s", prefix))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		return apiError(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// lookupResult is the response of /defender/lookup.
+type lookupResult struct {
+	IP string `json:"ip"`
+	// Groups maps the predefined groups, range files and URLs containing the IP to their
+	// prefixes that contain it.
+	Groups map[string][]string `json:"groups"`
+	// Ban is the active ban of the IP, if any.
+	Ban *bans.Ban `json:"ban,omitempty"`
+	// Whitelist is the runtime whitelist entry containing the IP, if any.
+	Whitelist *bans.Ban       `json:"whitelist,omitempty"`
+	Handlers  []handlerLookup `json:"handlers"`
+}
+
+// handlerLookup is what a defender handler would do with a request from the IP.
+type handlerLookup struct {
+	// Decision is "allowed", "whitelisted", "blocked" or "monitored".
+	Decision  string   `json:"decision"`
+	Responder string   `json:"responder,omitempty"`
+	Prefix    string   `json:"prefix,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+	ID        uint64   `json:"id"`
+}
+
+// handleLookup explains how an IP is treated.
+func (a adminAPI) handleLookup(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return apiError(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+	addr, err := netip.ParseAddr(r.URL.Query().Get("ip"))
+	if err != nil {
+		return apiError(http.StatusBadRequest, fmt.Errorf("invalid ip: %w", err))
+	}
+	addr = addr.Unmap()
+
+	handlers := provisionedDefenders()
+	result := lookupResult{
+		IP:       addr.String(),
+		Groups:   rangeGroups(addr, handlers),
+		Handlers: []handlerLookup{},
+	}
+	if ban, ok := banTable.Lookup(addr); ok {
+		result.Ban = &ban
+	}
+	if entry, ok := allowTable.Lookup(addr); ok {
+		result.Whitelist = &entry
+	}
+
+	for _, m := range handlers {
+		lookup := m.ipChecker.Lookup(r.Context(), net.IP(addr.AsSlice()))
+		decision := handlerLookup{ID: m.adminID, Decision: "allowed"}
+		switch {
+		case lookup.Whitelisted:
+			decision.Decision = "whitelisted"
+		case !lookup.Allowed:
+			decision.Decision = actionBlocked
+			if m.Mode == modeMonitor {
+				decision.Decision = actionMonitored
+			}
+			decision.Responder, _ = m.responderFor(lookup)
+		}
+		if lookup.Match != nil {
+			decision.Prefix = lookup.Match.Prefix.String()
+			decision.Groups = lookup.Match.Groups
+		}
+		result.Handlers = append(result.Handlers, decision)
+	}
+	return writeJSON(w, result)
+}
+
+// rangeGroups returns the prefixes containing addr of the predefined ranges, range files and
+// URLs, by group. Groups used by the handlers are resolved as their range tables currently
+// see them, so refreshed, reloaded and fetched ranges are reported; the other predefined
+// groups fall back to the embedded ranges.
+func rangeGroups(addr netip.Addr, handlers []*Defender) map[string][]string {
+	groups := map[string][]string{}
+	add := func(group string, cidrs []string) {
+		for _, cidr := range cidrs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil || !prefix.Contains(addr) {
+				continue
+			}
+			groups[group] = append(groups[group], prefix.String())
+		}
+	}
+
+	resolved := map[string]bool{}
+	for _, m := range handlers {
+		for _, entry := range m.rangeConfig().entries() {
+			_, predefined := data.IPRanges[entry]
+			if resolved[entry] || !(predefined || sources.IsFile(entry) || sources.IsRemote(entry)) {
+				continue
+			}
+			cidrs, err := m.resolver.Resolve(entry)
+			if err != nil {
+				continue
+			}
+			resolved[entry] = true
+			add(entry, cidrs)
+		}
+	}
+	for group, cidrs := range data.IPRanges {
+		if !resolved[group] {
+			add(group, cidrs)
+		}
+	}
+	return groups
+}
+
+// handlerPolicy is the effective policy of a defender handler.
+type handlerPolicy struct {
+	ClientIP       *ClientIPConfig       `json:"client_ip,omitempty"`
+	BanHeader      *BanHeaderConfig      `json:"ban_header,omitempty"`
+	Traps          *TrapConfig           `json:"traps,omitempty"`
+	EnforceRobots  *RobotsPolicyConfig   `json:"enforce_robots,omitempty"`
+	Robots         *RobotsConfig         `json:"robots,omitempty"`
+	VerifyCrawlers *VerifyCrawlersConfig `json:"verify_crawlers,omitempty"`
+	Escalation     *EscalationConfig     `json:"escalation,omitempty"`
+	Responder      string                `json:"responder"`
+	Mode           string                `json:"mode"`
+	BanVar         string                `json:"ban_var"`
+	Ranges         []string              `json:"ranges"`
+	Rules          []Rule                `json:"rules,omitempty"`
+	UserAgents     []string              `json:"user_agents,omitempty"`
+	ID             uint64                `json:"id"`
+	Prefixes       int                   `json:"prefixes"`
+	WhitelistCount int                   `json:"whitelist_count"`
+}
+
+// handlePolicy dumps the effective policy of every defender handler.
+func (a adminAPI) handlePolicy(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return apiError(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+	policies := []handlerPolicy{}
+	for _, m := range provisionedDefenders() {
+		policies = append(policies, handlerPolicy{
+			ID:             m.adminID,
+			Responder:      m.RawResponder,
+			Mode:           cmp.Or(m.Mode, modeEnforce),
+			Ranges:         m.Ranges,
+			Rules:          m.Rules,
+			UserAgents:     m.UserAgents,
+			Prefixes:       m.ipChecker.Len(),
+			WhitelistCount: len(m.Whitelist),
+			BanVar:         m.BanVar,
+			BanHeader:      m.BanHeader,
+			ClientIP:       m.ClientIP,
+			Traps:          m.Traps,
+			EnforceRobots:  m.EnforceRobots,
+			Robots:         m.Robots,
+			VerifyCrawlers: m.VerifyCrawlers,
+			Escalation:     m.Escalation,
+		})
+	}
+	return writeJSON(w, policies)
+}
+
+// banStorages returns the distinct storages of the handlers using ban_header.
+func banStorages() []certmagic.Storage {
+	var storages []certmagic.Storage
+	for _, m := range provisionedDefenders() {
+		if m.BanHeader != nil && m.storage != nil && !slices.Contains(storages, m.storage) {
+			storages = append(storages, m.storage)
+		}
+	}
+	return storages
+}
+
+// decodeEntry decodes the runtime ban or whitelist entry in the request body.
+func decodeEntry(r *http.Request, ban bool) (bans.Ban, error) {
+	var req entryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return bans.Ban{}, apiError(http.StatusBadRequest, fmt.Errorf("decoding request: %w", err))
+	}
+	prefix, err := parsePrefix(req.Prefix)
+	if err != nil {
+		return bans.Ban{}, apiError(http.StatusBadRequest, err)
+	}
+	if !ban && req.Responder != "" {
+		return bans.Ban{}, apiError(http.StatusBadRequest, errors.New("whitelist entries have no responder"))
+	}
+	if req.Responder != "" && !validResponder(req.Responder) {
+		return bans.Ban{}, apiError(http.StatusBadRequest, fmt.Errorf("invalid responder type: %s", req.Responder))
+	}
+
+	var duration time.Duration
+	if req.Duration != "" {
+		duration, err = caddy.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 {
+			return bans.Ban{}, apiError(http.StatusBadRequest, fmt.Errorf("invalid duration %q", req.Duration))
+		}
+	}
+	spec := bans.Spec{Duration: duration, Reason: req.Reason, Responder: req.Responder}
+	return spec.Ban(prefix, time.Now()), nil
+}
+
+// parsePrefix parses an IP or CIDR.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid prefix %q", s)
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid prefix %q", s)
+	}
+	return prefix.Masked(), nil
+}
+
+// orEmpty returns an empty list rather than nil, so it is encoded as [].
+func orEmpty(list []bans.Ban) []bans.Ban {
+	if list == nil {
+		return []bans.Ban{}
+	}
+	return list
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return apiError(http.StatusInternalServerError, err)
+	}
+	return nil
+}
+
+func apiError(status int, err error) error {
+	return caddy.APIError{HTTPStatus: status, Err: err}
+}
+
+// Interface guards
+var _ caddy.AdminRouter = (*adminAPI)(nil)
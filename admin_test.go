@@ -0,0 +1,149 @@
+package caddydefender
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+	"pkg.jsn.cam/caddy-defender/bans"
+	"pkg.jsn.cam/caddy-defender/responders"
+)
+
+// serveAdmin calls handler and returns the recorded response, or the API error.
+func serveAdmin(t *testing.T, handler caddy.AdminHandlerFunc, method, target, body string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	return recorder, handler(recorder, req)
+}
+
+// requireAPIError asserts err is an API error with the given status.
+func requireAPIError(t *testing.T, err error, status int) {
+	t.Helper()
+	var apiErr caddy.APIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, status, apiErr.HTTPStatus)
+}
+
+func TestAdminAPI_Bans(t *testing.T) {
+	var a adminAPI
+	prefix := netip.MustParsePrefix("192.0.2.0/24")
+	defer banTable.Remove(prefix)
+
+	recorder, err := serveAdmin(t, a.handleBans, http.MethodPost, "/defender/bans",
+		`{"prefix": "192.0.2.0/24", "duration": "2h", "reason": "scrape", "responder": "drop"}`)
+	require.NoError(t, err)
+	var added bans.Ban
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &added))
+	require.Equal(t, prefix, added.Prefix)
+	require.False(t, added.Permanent())
+
+	recorder, err = serveAdmin(t, a.handleBans, http.MethodGet, "/defender/bans", "")
+	require.NoError(t, err)
+	var list []bans.Ban
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &list))
+	require.Contains(t, list, added)
+
+	_, err = serveAdmin(t, a.handleBans, http.MethodPost, "/defender/bans", `{"prefix": "192.0.2.1", "responder": "nope"}`)
+	requireAPIError(t, err, http.StatusBadRequest)
+	_, err = serveAdmin(t, a.handleBans, http.MethodPost, "/defender/bans", `{"prefix": "not-an-ip"}`)
+	requireAPIError(t, err, http.StatusBadRequest)
+
+	recorder, err = serveAdmin(t, a.handleBans, http.MethodDelete, "/defender/bans?prefix=192.0.2.0/24", "")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, recorder.Code)
+	_, err = serveAdmin(t, a.handleBans, http.MethodDelete, "/defender/bans?prefix=192.0.2.0/24", "")
+	requireAPIError(t, err, http.StatusNotFound)
+}
+
+func TestAdminAPI_LookupLiveGroups(t *testing.T) {
+	var a adminAPI
+	path := filepath.Join(t.TempDir(), "scrapers.txt")
+	require.NoError(t, os.WriteFile(path, []byte("198.51.100.0/24\n"), 0o600))
+	defender := &Defender{
+		RawResponder: "block",
+		Ranges:       []string{"file://" + path},
+		responder:    &responders.BlockResponder{},
+	}
+	require.NoError(t, defender.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, defender.Cleanup()) }()
+
+	recorder, err := serveAdmin(t, a.handleLookup, http.MethodGet, "/defender/lookup?ip=198.51.100.10", "")
+	require.NoError(t, err)
+	var result lookupResult
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	require.Equal(t, []string{"198.51.100.0/24"}, result.Groups["file://"+path])
+}
+
+func TestAdminAPI_LookupAndPolicy(t *testing.T) {
+	var a adminAPI
+	defender := &Defender{
+		RawResponder: "block",
+		Ranges:       []string{"203.0.113.0/24"},
+		Whitelist:    []string{"203.0.113.7"},
+		responder:    &responders.BlockResponder{},
+	}
+	require.NoError(t, defender.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, defender.Cleanup()) }()
+
+	lookup := func(ip string) handlerLookup {
+		recorder, err := serveAdmin(t, a.handleLookup, http.MethodGet, "/defender/lookup?ip="+ip, "")
+		require.NoError(t, err)
+		var result lookupResult
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+		for _, handler := range result.Handlers {
+			if handler.ID == defender.adminID {
+				return handler
+			}
+		}
+		t.Fatalf("handler %d missing from lookup", defender.adminID)
+		return handlerLookup{}
+	}
+
+	blocked := lookup("203.0.113.10")
+	require.Equal(t, "blocked", blocked.Decision)
+	require.Equal(t, "block", blocked.Responder)
+	require.Equal(t, "203.0.113.0/24", blocked.Prefix)
+	require.Equal(t, []string{"203.0.113.0/24"}, blocked.Groups)
+
+	require.Equal(t, "whitelisted", lookup("203.0.113.7").Decision)
+	require.Equal(t, "allowed", lookup("198.51.100.10").Decision)
+
+	// Runtime whitelist entries allow blocked addresses
+	_, err := serveAdmin(t, a.handleWhitelist, http.MethodPost, "/defender/whitelist", `{"prefix": "203.0.113.10", "duration": "1h"}`)
+	require.NoError(t, err)
+	require.Equal(t, "whitelisted", lookup("203.0.113.10").Decision)
+	recorder, err := serveAdmin(t, a.handleWhitelist, http.MethodDelete, "/defender/whitelist?prefix=203.0.113.10", "")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, recorder.Code)
+
+	_, err = serveAdmin(t, a.handleLookup, http.MethodGet, "/defender/lookup?ip=nope", "")
+	requireAPIError(t, err, http.StatusBadRequest)
+
+	recorder, err = serveAdmin(t, a.handlePolicy, http.MethodGet, "/defender/policy", "")
+	require.NoError(t, err)
+	var policies []handlerPolicy
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &policies))
+	var policy *handlerPolicy
+	for i := range policies {
+		if policies[i].ID == defender.adminID {
+			policy = &policies[i]
+		}
+	}
+	require.NotNil(t, policy)
+	require.Equal(t, "block", policy.Responder)
+	require.Equal(t, "enforce", policy.Mode)
+	require.Equal(t, 1, policy.WhitelistCount)
+	require.Equal(t, 1, policy.Prefixes)
+
+	_, err = serveAdmin(t, a.handlePolicy, http.MethodPost, "/defender/policy", "")
+	requireAPIError(t, err, http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,255 @@
+package caddydefender
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"pkg.jsn.cam/caddy-defender/bans"
+	"pkg.jsn.cam/caddy-defender/matchers/ip"
+	"pkg.jsn.cam/caddy-defender/responders"
+)
+
+// defaultBanVar is the request variable read for new bans unless BanVar is set.
+const defaultBanVar = "defender_ban"
+
+// groupBan is the {http.defender.group} of requests from banned clients.
+const groupBan = ip.BanGroup
+
+// banTable holds the bans of every Defender handler, and allowTable the whitelist entries
+// added at runtime through the admin API. They belong to the process rather than a config,
+// so their entries survive config reloads, and every range table consults them.
+var (
+	banTable   = bans.New()
+	allowTable = bans.New()
+)
+
+// banResponderSet holds the responders bans, traps, escalation steps and the like can name,
+// by type. They are set up from the handler's settings on first use, since bans are shared by
+// all handlers and can name any responder.
+type banResponderSet struct {
+	mu         sync.Mutex
+	ctx        caddy.Context
+	responders map[string]responders.Responder
+	// errs records the responders that couldn't be set up, so they aren't retried per request
+	errs map[string]error
+	// closed is set once the handler is cleaned up, after which no responders are set up
+	closed bool
+}
+
+// provisionBanResponders sets up the responders named by the handler's configuration, which
+// must be available. The handler's own responder is reused for its type, and the others bans
+// can name are set up when first used.
+func (m *Defender) provisionBanResponders(ctx caddy.Context) error {
+	m.banResponders = &banResponderSet{
+		ctx:        ctx,
+		responders: map[string]responders.Responder{m.RawResponder: m.responder},
+		errs:       map[string]error{},
+	}
+	for _, name := range m.namedResponders() {
+		if name == "" {
+			continue
+		}
+		if _, err := m.banResponder(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// banResponder returns the responder of the given type, setting it up on first use.
+// Redirects are only available if the handler has a URL or a redirect module.
+func (m *Defender) banResponder(name string) (responders.Responder, error) {
+	set := m.banResponders
+	if set == nil {
+		return nil, errors.New("responders not provisioned")
+	}
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if responder, ok := set.responders[name]; ok {
+		return responder, nil
+	}
+	if err, ok := set.errs[name]; ok {
+		return nil, err
+	}
+	if set.closed {
+		return nil, errors.New("handler cleaned up")
+	}
+
+	var (
+		responder responders.Responder
+		err       error
+	)
+	if name == responderRedirect && !m.redirectConfigured() {
+		err = errors.New("redirect responder requires 'url' to be set")
+	} else {
+		responder, err = m.newBanResponder(set.ctx, name)
+	}
+	if err != nil {
+		m.log.Warn("Responder unavailable", zap.String("responder", name), zap.Error(err))
+		set.errs[name] = err
+		return nil, err
+	}
+	set.responders[name] = responder
+	return responder, nil
+}
+
+// newBanResponder creates and provisions the responder named name.
+func (m *Defender) newBanResponder(ctx caddy.Context, name string) (responders.Responder, error) {
+	responder, err := m.newResponder(name)
+	if err != nil {
+		return nil, err
+	}
+	if provisioner, ok := responder.(caddy.Provisioner); ok {
+		if err := provisioner.Provision(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if validator, ok := responder.(caddy.Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return responder, nil
+}
+
+// namedResponders returns the responders named by the handler's configuration, besides
+// its own.
+func (m *Defender) namedResponders() []string {
+	var names []string
+	if m.Traps != nil {
+		names = append(names, m.Traps.Responder)
+	}
+	if m.EnforceRobots != nil {
+		names = append(names, m.EnforceRobots.Responder)
+	}
+	if m.VerifyCrawlers != nil {
+		names = append(names, m.VerifyCrawlers.Responder)
+	}
+	if m.Escalation != nil {
+		for _, step := range m.Escalation.Steps {
+			names = append(names, step.Responder)
+		}
+	}
+	for _, rule := range m.Rules {
+		if rule.responder == nil {
+			names = append(names, rule.RawResponder)
+		}
+	}
+	return names
+}
+
+// cleanupResponders releases the state held by the handler's responder and the responders
+// bans can name. A responder loaded as a module is left to Caddy.
+func (m *Defender) cleanupResponders() error {
+	var (
+		errs []error
+		all  []responders.Responder
+	)
+	if set := m.banResponders; set != nil {
+		set.mu.Lock()
+		for name, responder := range set.responders {
+			// The handler's responder is reused for its own name
+			if name != m.RawResponder {
+				all = append(all, responder)
+			}
+		}
+		set.closed = true
+		set.mu.Unlock()
+	}
+	if !m.loadedResponder {
+		all = append(all, m.responder)
+	}
+	for _, responder := range all {
+		if cleaner, ok := responder.(caddy.CleanerUpper); ok {
+			errs = append(errs, cleaner.Cleanup())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// applyBanVar bans the client if an earlier handler set the ban variable.
+func (m *Defender) applyBanVar(r *http.Request, clientIP net.IP) {
+	value, ok := caddyhttp.GetVar(r.Context(), m.BanVar).(string)
+	if !ok || value == "" {
+		return
+	}
+
+	spec, err := bans.ParseSpec(value)
+	if err != nil {
+		m.log.Warn("Invalid ban request", zap.String("var", m.BanVar), zap.String("value", value), zap.Error(err))
+		return
+	}
+	addr, ok := netip.AddrFromSlice(clientIP)
+	if !ok {
+		return
+	}
+	addr = addr.Unmap()
+	m.addBan(r, spec, netip.PrefixFrom(addr, addr.BitLen()), "request variable")
+}
+
+// addBan bans prefix as requested by spec, which came from source. Bans are shared by every
+// handler, so in monitor mode the ban is only logged and the request annotated as monitored.
+func (m *Defender) addBan(r *http.Request, spec bans.Spec, prefix netip.Prefix, source string) (bans.Ban, bool) {
+	if m.Mode == modeMonitor {
+		ban := spec.Ban(prefix, time.Now())
+		m.log.Info("Client would be banned (monitor mode)",
+			zap.String("source", source),
+			zap.Stringer("prefix", ban.Prefix),
+			zap.String("reason", ban.Reason),
+			zap.String("responder", ban.Responder),
+			zap.Time("expires", ban.Expires),
+		)
+		setActionPlaceholder(r, actionMonitored)
+		return bans.Ban{}, false
+	}
+
+	if spec.Responder != "" {
+		if _, err := m.banResponder(spec.Responder); err != nil {
+			m.log.Warn("Unavailable ban responder, using the handler's responder",
+				zap.String("responder", spec.Responder))
+			spec.Responder = ""
+		}
+	}
+
+	ban := spec.Ban(prefix, time.Now())
+	if err := banTable.Add(ban); err != nil {
+		m.log.Warn("Failed to ban client", zap.Stringer("prefix", prefix), zap.Error(err))
+		return bans.Ban{}, false
+	}
+	m.log.Info("Banned client",
+		zap.String("source", source),
+		zap.Stringer("prefix", ban.Prefix),
+		zap.String("reason", ban.Reason),
+		zap.String("responder", ban.Responder),
+		zap.Time("expires", ban.Expires),
+	)
+	return ban, true
+}
+
+// responderFor returns the name and responder handling a request from a blocked range,
+// which is the ban's responder if it names one, or else that of the rule the range belongs to.
+func (m *Defender) responderFor(result ip.Result) (string, responders.Responder) {
+	if result.Ban == nil {
+		return m.ruleResponder(result.Match)
+	}
+	return m.namedResponder(result.Ban.Responder)
+}
+
+// namedResponder returns the responder of the given type, falling back to the handler's
+// responder if name is empty or unavailable.
+func (m *Defender) namedResponder(name string) (string, responders.Responder) {
+	if name == "" {
+		return m.RawResponder, m.responder
+	}
+	if responder, err := m.banResponder(name); err == nil {
+		return name, responder
+	}
+	return m.RawResponder, m.responder
+}
@@ -0,0 +1,281 @@
+package caddydefender
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+	"pkg.jsn.cam/caddy-defender/bans"
+)
+
+const (
+	// banStoragePrefix is the storage directory holding the bans requested by upstream responses.
+	banStoragePrefix = "defender/bans"
+	// banSyncInterval is how often bans added by other instances sharing the storage are loaded.
+	banSyncInterval = time.Minute
+	// banStoreTimeout bounds writing a new ban to storage.
+	banStoreTimeout = 30 * time.Second
+)
+
+// BanHeaderConfig lets upstream applications ban the client with a response header such as
+// `X-Defender-Ban: 2h; reason=scrape`, using the same format as the ban variable.
+type BanHeaderConfig struct {
+	// Header names the response header. It is removed before the response is sent.
+	// Required.
+	Header string `json:"header,omitempty"`
+
+	// IPv4Prefix is the length of the prefix banned for IPv4 clients, e.g. 24 to ban the client's /24.
+	// Default: 32
+	IPv4Prefix int `json:"ipv4_prefix,omitempty"`
+
+	// IPv6Prefix is the length of the prefix banned for IPv6 clients, e.g. 64 to ban the client's /64.
+	// Default: 128
+	IPv6Prefix int `json:"ipv6_prefix,omitempty"`
+}
+
+// validate checks that the header is set and the prefix lengths are in range.
+func (c *BanHeaderConfig) validate() error {
+	if c.Header == "" {
+		return errors.New("ban_header requires a header")
+	}
+	if c.IPv4Prefix < 0 || c.IPv4Prefix > 32 {
+		return fmt.Errorf("ban_header ipv4_prefix out of range: %d", c.IPv4Prefix)
+	}
+	if c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		return fmt.Errorf("ban_header ipv6_prefix out of range: %d", c.IPv6Prefix)
+	}
+	return nil
+}
+
+// prefix returns the prefix banned for addr.
+func (c *BanHeaderConfig) prefix(addr netip.Addr) netip.Prefix {
+	bits := addr.BitLen()
+	if addr.Is4() && c.IPv4Prefix > 0 {
+		bits = c.IPv4Prefix
+	} else if addr.Is6() && c.IPv6Prefix > 0 {
+		bits = c.IPv6Prefix
+	}
+	return netip.PrefixFrom(addr, bits).Masked()
+}
+
+// banSyncers holds the loops syncing banTable with the storages of the handlers using
+// ban_header, keyed by banStorageID, so handlers sharing a storage scan it only once.
+var banSyncers = caddy.NewUsagePool()
+
+// banSyncer keeps loading the bans added to a storage by other instances sharing it.
+type banSyncer struct {
+	cancel context.CancelFunc
+}
+
+// Destruct stops the sync loop once the last Defender using the storage is cleaned up.
+func (s *banSyncer) Destruct() error {
+	s.cancel()
+	return nil
+}
+
+// provisionBanStorage loads the bans persisted in storage and keeps syncing them with the
+// ones added and lifted by other instances sharing it. Callers must release the sync loop
+// with banSyncers.Delete(m.banSyncerKey) when they are cleaned up.
+func (m *Defender) provisionBanStorage(ctx context.Context) error {
+	key := banStorageID(m.storage)
+	_, _, err := banSyncers.LoadOrNew(key, func() (caddy.Destructor, error) {
+		return newBanSyncer(ctx, m.storage, m.log), nil
+	})
+	if err != nil {
+		return err
+	}
+	m.banSyncerKey = key
+	return nil
+}
+
+// newBanSyncer loads the bans in storage and starts syncing them every banSyncInterval.
+// The loop outlives ctx, since the storage may be shared with later configs; it runs until
+// the syncer is destructed.
+func newBanSyncer(ctx context.Context, storage certmagic.Storage, log *zap.Logger) *banSyncer {
+	if err := syncBans(ctx, storage, log); err != nil {
+		log.Warn("Failed to load bans from storage", zap.Error(err))
+	}
+
+	syncCtx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(banSyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-syncCtx.Done():
+				return
+			case <-ticker.C:
+				if err := syncBans(syncCtx, storage, log); err != nil {
+					log.Warn("Failed to load bans from storage", zap.Error(err))
+				}
+			}
+		}
+	}()
+	return &banSyncer{cancel: cancel}
+}
+
+// syncBans merges the bans in storage into banTable, deleting the expired ones. Bans loaded
+// earlier that are no longer stored, e.g. lifted by another instance, are removed.
+func syncBans(ctx context.Context, storage certmagic.Storage, log *zap.Logger) error {
+	keys, err := storage.List(ctx, banStoragePrefix, false)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	now := time.Now()
+	var stored []bans.Ban
+	for _, key := range keys {
+		b, err := storage.Load(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			// another instance deleted it meanwhile
+			continue
+		}
+		if err != nil {
+			// without the full list, loaded bans that seem gone might still be stored
+			return err
+		}
+		var ban bans.Ban
+		if err := json.Unmarshal(b, &ban); err != nil || !ban.Prefix.IsValid() {
+			log.Warn("Invalid ban in storage", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		if ban.Expired(now) {
+			_ = storage.Delete(ctx, key)
+			continue
+		}
+		stored = append(stored, ban)
+	}
+	banTable.Sync(banStorageID(storage), stored)
+	return nil
+}
+
+// banStorageID identifies storage as a source of bans.
+func banStorageID(storage certmagic.Storage) string {
+	if s, ok := storage.(fmt.Stringer); ok {
+		return fmt.Sprintf("%T %s", storage, s)
+	}
+	return fmt.Sprintf("%T %p", storage, storage)
+}
+
+// storeBan persists ban in storage so it survives reloads and restarts.
+func storeBan(ctx context.Context, storage certmagic.Storage, ban bans.Ban) error {
+	b, err := json.Marshal(ban)
+	if err != nil {
+		return fmt.Errorf("encoding ban: %w", err)
+	}
+	return storage.Store(ctx, banStorageKey(ban.Prefix), b)
+}
+
+// deleteBan removes the ban of prefix from storage, if it was stored.
+func deleteBan(ctx context.Context, storage certmagic.Storage, prefix netip.Prefix) error {
+	err := storage.Delete(ctx, banStorageKey(prefix))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// banStorageKey returns the storage key of the ban of prefix.
+func banStorageKey(prefix netip.Prefix) string {
+	return path.Join(banStoragePrefix, strings.NewReplacer("/", "_", ":", "-").Replace(prefix.String()))
+}
+
+// applyBanHeader bans the client as requested by an upstream response header value.
+func (m *Defender) applyBanHeader(r *http.Request, value string, clientIP net.IP) {
+	spec, err := bans.ParseSpec(value)
+	if err != nil {
+		m.log.Warn("Invalid ban response header", zap.String("header", m.BanHeader.Header),
+			zap.String("value", value), zap.Error(err))
+		return
+	}
+	addr, ok := netip.AddrFromSlice(clientIP)
+	if !ok {
+		return
+	}
+	if ban, ok := m.addBan(r, spec, m.BanHeader.prefix(addr.Unmap()), "upstream response"); ok {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), banStoreTimeout)
+			defer cancel()
+			if err := storeBan(ctx, m.storage, ban); err != nil {
+				m.log.Error("Failed to store ban", zap.Stringer("prefix", ban.Prefix), zap.Error(err))
+			}
+		}()
+	}
+}
+
+// serveNext passes the request on, watching the response for the ban header if configured.
+// The upstream robots.txt is kept when enforcing robots.txt without serving one.
+func (m *Defender) serveNext(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, clientIP net.IP) error {
+	if m.robots != nil && m.robots.served == nil && isRobotsTxt(r) {
+		rw := &robotsResponseWriter{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}}
+		defer m.learnUpstreamRobotsTxt(r, rw)
+		w = rw
+	}
+
+	if m.BanHeader == nil {
+		return next.ServeHTTP(w, r)
+	}
+
+	bw := &banResponseWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		header:                m.BanHeader.Header,
+		onBan:                 func(value string) { m.applyBanHeader(r, value, clientIP) },
+	}
+	err := next.ServeHTTP(bw, r)
+	// Handlers that write nothing leave the headers to be sent by the server
+	bw.takeBanHeader()
+	return err
+}
+
+// banResponseWriter removes the ban header from the response before it is written.
+type banResponseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	onBan       func(value string)
+	header      string
+	wroteHeader bool
+}
+
+// takeBanHeader removes the ban header and reports its value, if set.
+func (w *banResponseWriter) takeBanHeader() {
+	value := w.Header().Get(w.header)
+	if value == "" {
+		return
+	}
+	w.Header().Del(w.header)
+	w.onBan(value)
+}
+
+func (w *banResponseWriter) WriteHeader(status int) {
+	w.takeBanHeader()
+	if status >= http.StatusOK {
+		w.wroteHeader = true
+	}
+	w.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (w *banResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriterWrapper.Write(b)
+}
+
+func (w *banResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriterWrapper.ReadFrom(r)
+}
@@ -0,0 +1,241 @@
+package bans
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/gaissmai/bart"
+)
+
+// Permanent is the duration of a ban request that never expires.
+const Permanent = "permanent"
+
+// sweepInterval is the minimum time between removals of expired bans.
+const sweepInterval = time.Minute
+
+// Ban blocks a client IP or prefix until it expires.
+type Ban struct {
+	// Prefix is the banned IP (as a /32 or /128) or prefix.
+	Prefix netip.Prefix `json:"prefix"`
+	// Reason describes why the client was banned, e.g. "scrape".
+	Reason string `json:"reason,omitempty"`
+	// Responder names the responder that handles requests from the client,
+	// or is empty to use the handler's responder.
+	Responder string `json:"responder,omitempty"`
+	// Expires is when the ban ends. The zero time means the ban is permanent.
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// Permanent reports whether the ban never expires.
+func (b Ban) Permanent() bool {
+	return b.Expires.IsZero()
+}
+
+// Expired reports whether the ban has ended at now.
+func (b Ban) Expired(now time.Time) bool {
+	return !b.Permanent() && !now.Before(b.Expires)
+}
+
+// Outlasts reports whether the ban ends after other.
+func (b Ban) Outlasts(other Ban) bool {
+	if b.Permanent() {
+		return !other.Permanent()
+	}
+	return !other.Permanent() && b.Expires.After(other.Expires)
+}
+
+// Spec is a ban request, as written in request variables and response headers:
+//
+//	<duration|permanent>[; reason=<text>][; responder=<name>]
+//
+// e.g. "2h; reason=scrape" or "permanent; responder=drop".
+type Spec struct {
+	// Duration is how long the ban lasts, or 0 for a permanent ban.
+	Duration time.Duration
+	// Reason describes why the client was banned.
+	Reason string
+	// Responder names the responder for the banned client.
+	Responder string
+}
+
+// ParseSpec parses a ban request.
+func ParseSpec(s string) (Spec, error) {
+	params := strings.Split(s, ";")
+
+	var spec Spec
+	duration := strings.TrimSpace(params[0])
+	if duration != Permanent {
+		d, err := caddy.ParseDuration(duration)
+		if err != nil {
+			return Spec{}, fmt.Errorf("invalid ban duration %q: %w", duration, err)
+		}
+		if d <= 0 {
+			return Spec{}, fmt.Errorf("ban duration must be positive: %q", duration)
+		}
+		spec.Duration = d
+	}
+
+	for _, param := range params[1:] {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			return Spec{}, fmt.Errorf("invalid ban parameter %q", param)
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "reason":
+			spec.Reason = value
+		case "responder":
+			spec.Responder = value
+		default:
+			return Spec{}, fmt.Errorf("unknown ban parameter %q", key)
+		}
+	}
+	return spec, nil
+}
+
+// Ban returns the ban of prefix requested by the spec, starting at now.
+func (s Spec) Ban(prefix netip.Prefix, now time.Time) Ban {
+	ban := Ban{Prefix: prefix.Masked(), Reason: s.Reason, Responder: s.Responder}
+	if s.Duration > 0 {
+		ban.Expires = now.Add(s.Duration)
+	}
+	return ban
+}
+
+// Table holds the active bans. Expired bans are never returned and are removed
+// periodically as new bans are added. It is safe for concurrent use.
+type Table struct {
+	lastSweep time.Time
+	table     bart.Table[Ban]
+	// synced maps the prefixes whose ban was added by Sync to the source it came from
+	synced map[netip.Prefix]string
+	now    func() time.Time
+	mu     sync.RWMutex
+}
+
+// New returns an empty ban table.
+func New() *Table {
+	return &Table{now: time.Now, synced: map[netip.Prefix]string{}}
+}
+
+// Add bans ban.Prefix, replacing any ban of the same prefix, including one added by Sync.
+func (t *Table) Add(ban Ban) error {
+	if !ban.Prefix.IsValid() {
+		return errors.New("invalid ban prefix")
+	}
+	ban.Prefix = unmapPrefix(ban.Prefix.Masked())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	if now.Sub(t.lastSweep) >= sweepInterval {
+		t.sweep(now)
+	}
+	t.table.Insert(ban.Prefix, ban)
+	delete(t.synced, ban.Prefix)
+	return nil
+}
+
+// Sync merges the bans stored in source (e.g. storage shared by several instances) into the
+// table, and removes the bans an earlier Sync of source added that are no longer stored.
+// A ban added with Add is kept if it outlasts the stored ban of the same prefix.
+func (t *Table) Sync(source string, stored []Ban) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	seen := make(map[netip.Prefix]bool, len(stored))
+	for _, ban := range stored {
+		if !ban.Prefix.IsValid() || ban.Expired(now) {
+			continue
+		}
+		ban.Prefix = unmapPrefix(ban.Prefix.Masked())
+		seen[ban.Prefix] = true
+		existing, ok := t.table.Get(ban.Prefix)
+		if _, synced := t.synced[ban.Prefix]; ok && !synced && !existing.Expired(now) && existing.Outlasts(ban) {
+			continue
+		}
+		t.table.Insert(ban.Prefix, ban)
+		t.synced[ban.Prefix] = source
+	}
+	for prefix, from := range t.synced {
+		if from == source && !seen[prefix] {
+			t.table.Delete(prefix)
+			delete(t.synced, prefix)
+		}
+	}
+}
+
+// Remove lifts the ban of exactly prefix and reports whether there was one.
+func (t *Table) Remove(prefix netip.Prefix) bool {
+	prefix = unmapPrefix(prefix.Masked())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.table.Get(prefix); !ok {
+		return false
+	}
+	t.table.Delete(prefix)
+	delete(t.synced, prefix)
+	return true
+}
+
+// Lookup returns the most specific active ban containing addr.
+func (t *Table) Lookup(addr netip.Addr) (Ban, bool) {
+	addr = addr.Unmap()
+	now := t.now()
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.table.Size() == 0 {
+		return Ban{}, false
+	}
+	for _, ban := range t.table.Supernets(netip.PrefixFrom(addr, addr.BitLen())) {
+		if !ban.Expired(now) {
+			return ban, true
+		}
+	}
+	return Ban{}, false
+}
+
+// List returns the active bans in CIDR order.
+func (t *Table) List() []Ban {
+	now := t.now()
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var bans []Ban
+	for _, ban := range t.table.AllSorted() {
+		if !ban.Expired(now) {
+			bans = append(bans, ban)
+		}
+	}
+	return bans
+}
+
+// sweep removes the bans that have expired at now. t.mu must be held for writing.
+func (t *Table) sweep(now time.Time) {
+	var expired []netip.Prefix
+	for prefix, ban := range t.table.All() {
+		if ban.Expired(now) {
+			expired = append(expired, prefix)
+		}
+	}
+	for _, prefix := range expired {
+		t.table.Delete(prefix)
+		delete(t.synced, prefix)
+	}
+	t.lastSweep = now
+}
+
+// unmapPrefix stores IPv4-mapped IPv6 prefixes as plain IPv4, matching how lookups unmap addresses.
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix
+}
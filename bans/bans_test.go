@@ -0,0 +1,163 @@
+package bans
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSpec(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expected    Spec
+		expectError bool
+	}{
+		{
+			name:     "duration only",
+			input:    "2h",
+			expected: Spec{Duration: 2 * time.Hour},
+		},
+		{
+			name:     "reason and responder",
+			input:    `1d; reason="credential stuffing"; responder=tarpit`,
+			expected: Spec{Duration: 24 * time.Hour, Reason: "credential stuffing", Responder: "tarpit"},
+		},
+		{
+			name:     "permanent",
+			input:    "permanent; responder=drop",
+			expected: Spec{Responder: "drop"},
+		},
+		{
+			name:        "invalid duration",
+			input:       "soon",
+			expectError: true,
+		},
+		{
+			name:        "negative duration",
+			input:       "-1h",
+			expectError: true,
+		},
+		{
+			name:        "unknown parameter",
+			input:       "1h; scope=/24",
+			expectError: true,
+		},
+		{
+			name:        "malformed parameter",
+			input:       "1h; scrape",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := ParseSpec(tt.input)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, spec)
+		})
+	}
+}
+
+func TestTable(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	table := New()
+	table.now = func() time.Time { return now }
+
+	require.NoError(t, table.Add(Ban{Prefix: netip.MustParsePrefix("203.0.113.0/24"), Responder: "drop"}))
+	require.NoError(t, table.Add(Spec{Duration: time.Hour, Reason: "scrape", Responder: "tarpit"}.
+		Ban(netip.MustParsePrefix("203.0.113.10/32"), now)))
+	require.NoError(t, table.Add(Spec{Duration: time.Hour}.Ban(netip.MustParsePrefix("2001:db8::1/128"), now)))
+	require.Error(t, table.Add(Ban{}))
+
+	// The most specific ban decides
+	ban, ok := table.Lookup(netip.MustParseAddr("203.0.113.10"))
+	require.True(t, ok)
+	assert.Equal(t, "tarpit", ban.Responder)
+	assert.Equal(t, "scrape", ban.Reason)
+
+	ban, ok = table.Lookup(netip.MustParseAddr("::ffff:203.0.113.20"))
+	require.True(t, ok)
+	assert.True(t, ban.Permanent())
+	assert.Equal(t, "drop", ban.Responder)
+
+	_, ok = table.Lookup(netip.MustParseAddr("2001:db8::1"))
+	assert.True(t, ok)
+	_, ok = table.Lookup(netip.MustParseAddr("198.51.100.1"))
+	assert.False(t, ok)
+	assert.Len(t, table.List(), 3)
+
+	// Once the temporary bans expire, the permanent one applies again
+	now = now.Add(time.Hour)
+	ban, ok = table.Lookup(netip.MustParseAddr("203.0.113.10"))
+	require.True(t, ok)
+	assert.Equal(t, "drop", ban.Responder)
+	_, ok = table.Lookup(netip.MustParseAddr("2001:db8::1"))
+	assert.False(t, ok)
+	assert.Len(t, table.List(), 1)
+
+	// Adding a ban sweeps the expired ones
+	now = now.Add(sweepInterval)
+	require.NoError(t, table.Add(Ban{Prefix: netip.MustParsePrefix("192.0.2.1/32")}))
+	assert.Equal(t, 2, table.table.Size())
+
+	assert.True(t, table.Remove(netip.MustParsePrefix("203.0.113.0/24")))
+	assert.False(t, table.Remove(netip.MustParsePrefix("203.0.113.0/24")))
+	_, ok = table.Lookup(netip.MustParseAddr("203.0.113.10"))
+	assert.False(t, ok)
+}
+
+func TestTableSync(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	table := New()
+	table.now = func() time.Time { return now }
+
+	local := netip.MustParsePrefix("203.0.113.10/32")
+	shared := netip.MustParsePrefix("198.51.100.0/24")
+	require.NoError(t, table.Add(Ban{Prefix: local, Reason: "trap"}))
+
+	// A stored ban never shortens a longer ban added here
+	table.Sync("storage", []Ban{
+		Spec{Duration: time.Hour, Reason: "scrape"}.Ban(local, now),
+		Spec{Duration: time.Hour, Reason: "scrape"}.Ban(shared, now),
+	})
+	ban, ok := table.Lookup(local.Addr())
+	require.True(t, ok)
+	assert.True(t, ban.Permanent())
+	assert.Equal(t, "trap", ban.Reason)
+	ban, ok = table.Lookup(shared.Addr())
+	require.True(t, ok)
+	assert.Equal(t, "scrape", ban.Reason)
+
+	// A longer stored ban replaces a shorter one
+	require.NoError(t, table.Add(Spec{Duration: time.Minute}.Ban(shared, now)))
+	table.Sync("storage", []Ban{Spec{Duration: 2 * time.Hour, Reason: "scrape"}.Ban(shared, now)})
+	ban, ok = table.Lookup(shared.Addr())
+	require.True(t, ok)
+	assert.Equal(t, now.Add(2*time.Hour), ban.Expires)
+
+	// Bans deleted from storage are lifted, unless they were added here or by another source
+	other := netip.MustParsePrefix("192.0.2.0/24")
+	table.Sync("other", []Ban{{Prefix: other}})
+	table.Sync("storage", nil)
+	_, ok = table.Lookup(shared.Addr())
+	assert.False(t, ok)
+	_, ok = table.Lookup(local.Addr())
+	assert.True(t, ok)
+	_, ok = table.Lookup(other.Addr())
+	assert.True(t, ok)
+
+	// Bans added again take the prefix over from storage
+	require.NoError(t, table.Add(Ban{Prefix: other, Reason: "admin"}))
+	table.Sync("other", nil)
+	ban, ok = table.Lookup(other.Addr())
+	require.True(t, ok)
+	assert.Equal(t, "admin", ban.Reason)
+}
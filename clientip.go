@@ -0,0 +1,161 @@
+package caddydefender
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"pkg.jsn.cam/caddy-defender/matchers/whitelist"
+)
+
+// ClientIPConfig reads the client IP from a request header set by trusted proxies, such as
+// Cloudflare or a load balancer, instead of relying on the server-wide trusted_proxies.
+type ClientIPConfig struct {
+	trusted *whitelist.Whitelist
+
+	// Header holds the client IP, e.g. "CF-Connecting-IP", "X-Real-IP", "X-Forwarded-For" or
+	// "Forwarded". Headers holding a chain of addresses ("X-Forwarded-For", "Forwarded") are
+	// walked right to left, skipping trusted proxies, and the first untrusted address is used.
+	// Required.
+	Header string `json:"header,omitempty"`
+
+	// TrustedProxies lists the predefined range keys (e.g. "cloudflare") and CIDRs of the proxies
+	// allowed to set Header. The header is ignored for requests from any other address.
+	// Required.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+}
+
+// unmarshalCaddyfile parses the body of a client_ip block:
+//
+//	client_ip {
+//	    header <name>
+//	    trusted_proxies <cidr_or_predefined...>
+//	}
+func (c *ClientIPConfig) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "header":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Header = d.Val()
+		case "trusted_proxies":
+			c.TrustedProxies = append(c.TrustedProxies, d.RemainingArgs()...)
+		default:
+			return d.Errf("unknown nested config key: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// validate checks that the header and trusted proxies are set and valid.
+func (c *ClientIPConfig) validate() error {
+	if c.Header == "" {
+		return errors.New("client_ip requires a header")
+	}
+	if len(c.TrustedProxies) == 0 {
+		return errors.New("client_ip requires trusted_proxies")
+	}
+	if err := whitelist.Validate(c.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid client_ip trusted_proxies: %w", err)
+	}
+	return nil
+}
+
+// provision builds the set of trusted proxy prefixes.
+func (c *ClientIPConfig) provision() error {
+	trusted, err := whitelist.Initialize(c.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid client_ip trusted_proxies: %w", err)
+	}
+	c.trusted = trusted
+	return nil
+}
+
+// clientIP returns the client IP of r. Without a ClientIPConfig, this is Caddy's client_ip
+// variable, falling back to the connection's remote address.
+func (c *ClientIPConfig) clientIP(r *http.Request) (net.IP, error) {
+	if c == nil {
+		return clientIPFromRequest(r)
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client IP format")
+	}
+	remote, err := parseHop(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client IP")
+	}
+	if !c.isTrusted(remote) {
+		return net.IP(remote.AsSlice()), nil
+	}
+
+	var hops []string
+	values := r.Header.Values(c.Header)
+	if http.CanonicalHeaderKey(c.Header) == "Forwarded" {
+		hops = forwardedFor(values)
+	} else {
+		for _, value := range values {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	}
+
+	// Proxies append the address they received the request from, so walk the chain from
+	// the right and stop at the first hop that isn't one of our proxies. A hop that isn't an
+	// address, such as RFC 7239's "unknown" or an obfuscated "_hidden" identifier, ends the
+	// chain we can follow, so the last trusted address is used.
+	last := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := parseHop(hops[i])
+		if err != nil {
+			break
+		}
+		if i == 0 || !c.isTrusted(hop) {
+			return net.IP(hop.AsSlice()), nil
+		}
+		last = hop
+	}
+
+	// The trusted proxy didn't set the header, or the chain ended in an unusable hop
+	return net.IP(last.AsSlice()), nil
+}
+
+func (c *ClientIPConfig) isTrusted(addr netip.Addr) bool {
+	trusted, _ := c.trusted.Matches(addr)
+	return trusted
+}
+
+// forwardedFor returns the "for" parameters of the elements of RFC 7239 Forwarded headers.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, val)
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop parses an address from a forwarding header, which may be quoted and carry a port
+// (e.g. `"[2001:db8::1]:4711"`).
+func parseHop(s string) (netip.Addr, error) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
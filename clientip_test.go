@@ -0,0 +1,141 @@
+package caddydefender
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIPConfig_ClientIP(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		remoteAddr  string
+		values      []string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:       "single value header from trusted proxy",
+			header:     "CF-Connecting-IP",
+			remoteAddr: "10.0.0.1:443",
+			values:     []string{"203.0.113.10"},
+			expected:   "203.0.113.10",
+		},
+		{
+			name:       "header from untrusted address is ignored",
+			header:     "CF-Connecting-IP",
+			remoteAddr: "198.51.100.1:443",
+			values:     []string{"203.0.113.10"},
+			expected:   "198.51.100.1",
+		},
+		{
+			name:       "missing header falls back to the proxy",
+			header:     "X-Real-IP",
+			remoteAddr: "10.0.0.1:443",
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "forwarded for chain skips trusted hops",
+			header:     "X-Forwarded-For",
+			remoteAddr: "10.0.0.1:443",
+			values:     []string{"192.0.2.1, 203.0.113.10", "10.0.0.2"},
+			expected:   "203.0.113.10",
+		},
+		{
+			name:       "forwarded for chain of trusted hops uses the left-most",
+			header:     "X-Forwarded-For",
+			remoteAddr: "10.0.0.1:443",
+			values:     []string{"10.0.0.3, 10.0.0.2"},
+			expected:   "10.0.0.3",
+		},
+		{
+			name:       "spoofed left-most entry is ignored",
+			header:     "X-Forwarded-For",
+			remoteAddr: "10.0.0.1:443",
+			values:     []string{"garbage, 203.0.113.10"},
+			expected:   "203.0.113.10",
+		},
+		{
+			name:       "invalid hop ends the chain at the proxy",
+			header:     "X-Forwarded-For",
+			remoteAddr: "10.0.0.1:443",
+			values:     []string{"203.0.113.10, unknown"},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "forwarded unknown hop",
+			header:     "Forwarded",
+			remoteAddr: "10.0.0.1:443",
+			values:     []string{"for=unknown"},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "forwarded obfuscated hop uses the last trusted hop",
+			header:     "Forwarded",
+			remoteAddr: "10.0.0.1:443",
+			values:     []string{`for=192.0.2.1, for="_hidden", for=10.0.0.2`},
+			expected:   "10.0.0.2",
+		},
+		{
+			name:        "invalid remote address",
+			header:      "X-Forwarded-For",
+			remoteAddr:  "garbage",
+			values:      []string{"203.0.113.10"},
+			expectError: true,
+		},
+		{
+			name:       "forwarded header",
+			header:     "Forwarded",
+			remoteAddr: "10.0.0.1:443",
+			values:     []string{`for="[2001:db8::1]:4711";proto=https, for=10.0.0.2`},
+			expected:   "2001:db8::1",
+		},
+		{
+			name:       "ipv4-mapped hop",
+			header:     "X-Forwarded-For",
+			remoteAddr: "[::ffff:10.0.0.1]:443",
+			values:     []string{"::ffff:203.0.113.10"},
+			expected:   "203.0.113.10",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ClientIPConfig{Header: tt.header, TrustedProxies: []string{"10.0.0.0/8"}}
+			require.NoError(t, c.validate())
+			require.NoError(t, c.provision())
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.values {
+				req.Header.Add(tt.header, value)
+			}
+
+			clientIP, err := c.clientIP(req)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, clientIP.String())
+		})
+	}
+}
+
+func TestClientIPConfig_NilUsesCaddyClientIP(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:443"
+	req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, map[string]any{
+		caddyhttp.ClientIPVarKey: "203.0.113.10",
+	}))
+
+	var c *ClientIPConfig
+	clientIP, err := c.clientIP(req)
+	require.NoError(t, err)
+	require.Equal(t, "203.0.113.10", clientIP.String())
+}
@@ -5,23 +5,31 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"reflect"
 	"slices"
 	"strconv"
-	"strings"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"pkg.jsn.cam/caddy-defender/matchers/ip"
+	"pkg.jsn.cam/caddy-defender/matchers/useragent"
 	"pkg.jsn.cam/caddy-defender/matchers/whitelist"
 	"pkg.jsn.cam/caddy-defender/ranges/data"
+	"pkg.jsn.cam/caddy-defender/ranges/sources"
 	"pkg.jsn.cam/caddy-defender/responders"
+	"pkg.jsn.cam/caddy-defender/responders/challenge"
+	"pkg.jsn.cam/caddy-defender/responders/ratelimit"
 	"pkg.jsn.cam/caddy-defender/responders/tarpit"
 )
 
 const (
 	responderBlock     = "block"
+	responderChallenge = "challenge"
 	responderCustom    = "custom"
 	responderDrop      = "drop"
 	responderGarbage   = "garbage"
@@ -30,53 +38,151 @@ const (
 	responderTarpit    = "tarpit"
 )
 
-var responderTypes = []string{
-	responderBlock,
-	responderCustom,
-	responderDrop,
-	responderGarbage,
-	responderRateLimit,
-	responderRedirect,
-	responderTarpit,
-}
+const (
+	// modeEnforce hands matched requests to the responder.
+	modeEnforce = "enforce"
+	// modeMonitor only logs and annotates matched requests and passes them on.
+	modeMonitor = "monitor"
+)
 
 // UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
 //
-//	defender <responder> {
-//		# IP ranges to block
-//		ranges
-//		# Whitelisted IP addresses to allow to bypass ranges (optional)
-//		whitelist
+//	defender [<responder>] {
+//	    # Responder module and its settings, instead of the <responder> argument (optional)
+//	    responder <name> {
+//	        ...
+//	    }
+//	    # IP ranges, predefined keys or file:// lists to block, prefix with ! to exclude a range from blocking
+//	    ranges
+//	    # Ranges handled by their own responder, checked in order after ranges (repeatable, optional)
+//	    rule [<responder>] {
+//	        ranges <cidr_or_predefined...>
+//	        responder <name> {
+//	            ...
+//	        }
+//	    }
+//	    # Whitelisted IPs, CIDRs or predefined ranges to allow to bypass ranges (optional)
+//	    whitelist
+//	    # AI crawler catalog keys or regular expressions matching User-Agents to block (optional)
+//	    user_agents
 //	    # Custom message to return to the client when using "custom" middleware (optional)
 //	    message
 //	    # Custom URL to redirect the client to when using "redirect" middleware (optional)
 //	    url
 //	    # Serve robots.txt banning everything (optional)
 //	    serve_ignore (no arguments)
+//	    # Ban clients requesting paths disallowed in the served robots.txt (optional)
+//	    traps <paths...> {
+//	        paths <paths...>
+//	        duration <duration>
+//	        responder <responder>
+//	    }
+//	    # Log and annotate matched requests instead of blocking them (optional)
+//	    mode <enforce|monitor>
+//	    # Response header naming the responder that would have run in monitor mode (optional)
+//	    monitor_header <name>
+//	    # Re-fetch predefined and URL ranges at runtime on this interval (optional)
+//	    refresh_interval <duration>
+//	    # Limits for URL ranges (optional)
+//	    remote {
+//	        max_size <bytes>
+//	        min_count <prefixes>
+//	        timeout <duration>
+//	        json_keys <key...>
+//	    }
+//	    # Lookup cache settings, or "cache off" to disable it (optional)
+//	    cache {
+//	        capacity <entries>
+//	        shards <count>
+//	        ttl <duration>
+//	        disable_early_refreshes
+//	    }
+//	    # Request variable earlier handlers set to ban the client (optional)
+//	    ban_var <name>
+//	    # Response header upstream applications set to ban the client (optional)
+//	    ban_header <name> {
+//	        ipv4_prefix <bits>
+//	        ipv6_prefix <bits>
+//	    }
+//	    # Flag clients claiming a known crawler's User-Agent from outside its ranges (optional)
+//	    verify_crawlers {
+//	        responder <responder>
+//	        allow_verified
+//	        crawler <user_agent_token> <cidr_or_predefined...>
+//	    }
+//	    # Pick the responder by the client's recent number of matched requests (optional)
+//	    escalation {
+//	        window <duration>
+//	        after <strikes> <responder>
+//	    }
+//	    # Settings for the "ratelimit" responder (optional)
+//	    ratelimit_config {
+//	        algorithm <token_bucket|sliding_window>
+//	        events <requests>
+//	        window <duration>
+//	        ipv4_prefix <bits>
+//	        ipv6_prefix <bits>
+//	        group <name> {
+//	            algorithm <token_bucket|sliding_window>
+//	            events <requests>
+//	            window <duration>
+//	        }
+//	    }
+//	    # Settings for the "challenge" responder (optional)
+//	    challenge_config {
+//	        difficulty <bits>
+//	        duration <duration>
+//	        keys <keys...>
+//	        template <path>
+//	        cookie_name <name>
+//	    }
+//	    # Read the client IP from a header set by trusted proxies (optional)
+//	    client_ip {
+//	        header <name>
+//	        trusted_proxies <cidr_or_predefined...>
+//	    }
 //	}
 func (m *Defender) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	d.Next() // consume directive name
 
-	// Get the responder type
-	if !d.NextArg() {
-		return d.Errf("missing responder type")
-	}
-	// validate responder type
-	if !slices.Contains(responderTypes, d.Val()) {
-		return d.Errf("invalid responder type: %s", d.Val())
+	// Get the responder type, unless it is configured with the responder subdirective
+	if d.NextArg() {
+		// validate responder type
+		if !validResponder(d.Val()) {
+			return d.Errf("invalid responder type: %s", d.Val())
+		}
+		m.RawResponder = d.Val()
 	}
 
-	m.RawResponder = d.Val()
-
 	// Parse the block if it exists
 	var ranges []string
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		switch d.Val() {
+		case "responder":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			if m.RawResponder != "" && (m.ResponderRaw != nil || m.RawResponder != name) {
+				return d.Errf("responder already set to %s", m.RawResponder)
+			}
+			unm, err := caddyfile.UnmarshalModule(d, responders.Namespace+"."+name)
+			if err != nil {
+				return err
+			}
+			m.RawResponder = name
+			m.ResponderRaw = caddyconfig.JSONModuleObject(unm, "responder", name, nil)
 		case "ranges":
 			for d.NextArg() {
 				ranges = append(ranges, d.Val())
 			}
 			m.Ranges = ranges
+		case "rule":
+			rule, err := unmarshalRule(d)
+			if err != nil {
+				return err
+			}
+			m.Rules = append(m.Rules, rule)
 		case "message":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -102,77 +208,286 @@ func (m *Defender) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			for d.NextArg() {
 				m.Whitelist = append(m.Whitelist, d.Val())
 			}
+		case "user_agents":
+			m.UserAgents = append(m.UserAgents, d.RemainingArgs()...)
 		case "serve_ignore":
 			m.ServeIgnore = true
-		case "tarpit_config":
+		case "mode":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Mode = d.Val()
+		case "monitor_header":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.MonitorHeader = d.Val()
+		case "refresh_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			interval, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return fmt.Errorf("invalid refresh_interval value: '%s'", d.Val())
+			}
+			m.RefreshInterval = caddy.Duration(interval)
+		case "remote":
 			for nesting := d.Nesting(); d.NextBlock(nesting); {
-				switch d.Val() {
-				case "headers":
-					headers := map[string]string{}
-					for nesting := d.Nesting(); d.NextBlock(nesting); {
-						k := d.Val()
-						if !d.NextArg() {
-							return d.ArgErr()
-						}
-						headers[k] = d.Val()
+				key := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch key {
+				case "json_keys":
+					m.Remote.JSONKeys = append(m.Remote.JSONKeys, d.Val())
+					m.Remote.JSONKeys = append(m.Remote.JSONKeys, d.RemainingArgs()...)
+				case "max_size":
+					size, err := strconv.ParseInt(d.Val(), 10, 64)
+					if err != nil {
+						return fmt.Errorf("invalid max_size value: '%s'", d.Val())
+					}
+					m.Remote.MaxSize = size
+				case "min_count":
+					count, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return fmt.Errorf("invalid min_count value: '%s'", d.Val())
+					}
+					m.Remote.MinCount = count
+				case "timeout":
+					timeout, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return fmt.Errorf("invalid timeout value: '%s'", d.Val())
+					}
+					m.Remote.Timeout = caddy.Duration(timeout)
+				default:
+					return d.Errf("unknown nested config key: %s", key)
+				}
+			}
+		case "cache":
+			if d.NextArg() {
+				if d.Val() != "off" {
+					return d.Errf("invalid cache value: '%s'", d.Val())
+				}
+				m.Cache.Disabled = true
+				continue
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				key := d.Val()
+				if key == "disable_early_refreshes" {
+					m.Cache.DisableEarlyRefreshes = true
+					continue
+				}
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch key {
+				case "capacity":
+					capacity, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return fmt.Errorf("invalid capacity value: '%s'", d.Val())
+					}
+					m.Cache.Capacity = capacity
+				case "shards":
+					shards, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return fmt.Errorf("invalid shards value: '%s'", d.Val())
+					}
+					m.Cache.Shards = shards
+				case "ttl":
+					ttl, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return fmt.Errorf("invalid ttl value: '%s'", d.Val())
 					}
-					m.TarpitConfig.Headers = headers
-				case "content":
+					m.Cache.TTL = caddy.Duration(ttl)
+				default:
+					return d.Errf("unknown nested config key: %s", key)
+				}
+			}
+		case "ban_var":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.BanVar = d.Val()
+		case "ban_header":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.BanHeader = &BanHeaderConfig{Header: d.Val()}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				key := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				bits, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return fmt.Errorf("invalid %s value: '%s'", key, d.Val())
+				}
+				switch key {
+				case "ipv4_prefix":
+					m.BanHeader.IPv4Prefix = bits
+				case "ipv6_prefix":
+					m.BanHeader.IPv6Prefix = bits
+				default:
+					return d.Errf("unknown nested config key: %s", key)
+				}
+			}
+		case "client_ip":
+			if m.ClientIP == nil {
+				m.ClientIP = new(ClientIPConfig)
+			}
+			if err := m.ClientIP.unmarshalCaddyfile(d); err != nil {
+				return err
+			}
+		case "traps":
+			if m.Traps == nil {
+				m.Traps = new(TrapConfig)
+			}
+			m.Traps.Paths = append(m.Traps.Paths, d.RemainingArgs()...)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "paths":
+					m.Traps.Paths = append(m.Traps.Paths, d.RemainingArgs()...)
+				case "duration":
 					if !d.NextArg() {
 						return d.ArgErr()
 					}
-
-					content := strings.Split(d.Val(), "://")
-					if len(content) != 2 {
-						return errors.New("invalid content format. expected <content protocol>://<content path>")
+					duration, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return fmt.Errorf("invalid duration value: '%s'", d.Val())
 					}
-
-					m.TarpitConfig.Content = tarpit.Content{
-						Protocol: content[0],
-						Path:     content[1],
+					m.Traps.Duration = caddy.Duration(duration)
+				case "responder":
+					if !d.NextArg() {
+						return d.ArgErr()
 					}
-				case "timeout":
+					m.Traps.Responder = d.Val()
+				default:
+					return d.Errf("unknown nested config key: %s", d.Val())
+				}
+			}
+		case "robots":
+			if m.Robots == nil {
+				m.Robots = new(RobotsConfig)
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "allow":
+					m.Robots.Allow = append(m.Robots.Allow, d.RemainingArgs()...)
+				case "disallow":
+					m.Robots.Disallow = append(m.Robots.Disallow, d.RemainingArgs()...)
+				case "paths":
+					m.Robots.Paths = append(m.Robots.Paths, d.RemainingArgs()...)
+				case "merge":
+					m.Robots.Merge = true
+				case "ai_txt":
+					m.Robots.AITxt = true
+				case "llms_txt":
+					m.Robots.LLMsTxt = defaultLLMsTxt
+					if d.NextArg() {
+						m.Robots.LLMsTxt = d.Val()
+					}
+				default:
+					return d.Errf("unknown nested config key: %s", d.Val())
+				}
+			}
+		case "verify_crawlers":
+			if m.VerifyCrawlers == nil {
+				m.VerifyCrawlers = new(VerifyCrawlersConfig)
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "responder":
 					if !d.NextArg() {
 						return d.ArgErr()
 					}
-
-					timeout, err := time.ParseDuration(d.Val())
+					m.VerifyCrawlers.Responder = d.Val()
+				case "allow_verified":
+					m.VerifyCrawlers.AllowVerified = true
+				case "crawler":
+					args := d.RemainingArgs()
+					if len(args) < 2 {
+						return d.ArgErr()
+					}
+					if m.VerifyCrawlers.Crawlers == nil {
+						m.VerifyCrawlers.Crawlers = make(map[string][]string)
+					}
+					m.VerifyCrawlers.Crawlers[args[0]] = append(m.VerifyCrawlers.Crawlers[args[0]], args[1:]...)
+				default:
+					return d.Errf("unknown nested config key: %s", d.Val())
+				}
+			}
+		case "enforce_robots":
+			if m.EnforceRobots == nil {
+				m.EnforceRobots = new(RobotsPolicyConfig)
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				key := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch key {
+				case "duration":
+					duration, err := caddy.ParseDuration(d.Val())
 					if err != nil {
-						return fmt.Errorf("invalid timeout value: '%s'", d.Val())
+						return fmt.Errorf("invalid duration value: '%s'", d.Val())
 					}
-
-					m.TarpitConfig.Timeout = timeout
-				case "bytes_per_second":
+					m.EnforceRobots.Duration = caddy.Duration(duration)
+				case "responder":
+					m.EnforceRobots.Responder = d.Val()
+				default:
+					return d.Errf("unknown nested config key: %s", key)
+				}
+			}
+		case "tarpit_config":
+			if err := m.TarpitConfig.UnmarshalBlock(d); err != nil {
+				return err
+			}
+		case "escalation":
+			if m.Escalation == nil {
+				m.Escalation = new(EscalationConfig)
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch key := d.Val(); key {
+				case "window":
 					if !d.NextArg() {
 						return d.ArgErr()
 					}
-
-					bps, err := strconv.Atoi(d.Val())
+					window, err := caddy.ParseDuration(d.Val())
 					if err != nil {
-						return fmt.Errorf("invalid bytes_per_second value: '%s'", d.Val())
+						return fmt.Errorf("invalid duration value: '%s'", d.Val())
 					}
-
-					m.TarpitConfig.BytesPerSecond = bps
-				case "response_code":
-					if !d.NextArg() {
+					m.Escalation.Window = caddy.Duration(window)
+				case "after":
+					args := d.RemainingArgs()
+					if len(args) != 2 {
 						return d.ArgErr()
 					}
-
-					responseCode, err := strconv.Atoi(d.Val())
+					after, err := strconv.Atoi(args[0])
 					if err != nil {
-						return fmt.Errorf("invalid response_code value: '%s'", d.Val())
+						return fmt.Errorf("invalid after value: '%s'", args[0])
 					}
-
-					m.TarpitConfig.ResponseCode = responseCode
+					m.Escalation.Steps = append(m.Escalation.Steps, EscalationStep{Responder: args[1], After: after})
 				default:
-					return d.Errf("unknown nested config key: %s", d.Val())
+					return d.Errf("unknown nested config key: %s", key)
 				}
 			}
+		case "ratelimit_config":
+			if err := m.RateLimitConfig.UnmarshalBlock(d); err != nil {
+				return err
+			}
+		case "challenge_config":
+			if err := m.ChallengeConfig.UnmarshalBlock(d); err != nil {
+				return err
+			}
 		default:
 			return d.Errf("unknown subdirective '%s'", d.Val())
 		}
 	}
 
+	// Handlers with rules fall back to blocking, see UnmarshalJSON
+	if m.RawResponder == "" && len(m.Rules) == 0 {
+		return d.Errf("missing responder type")
+	}
 	return nil
 }
 
@@ -186,37 +501,6 @@ func (m *Defender) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
-	switch rawConfig.RawResponder {
-	case responderBlock:
-		m.responder = &responders.BlockResponder{}
-	case responderCustom:
-		// Get the custom message and status code
-		m.Message = rawConfig.Message
-		m.StatusCode = rawConfig.StatusCode
-		m.responder = &responders.CustomResponder{
-			Message:    m.Message,
-			StatusCode: m.StatusCode,
-		}
-	case responderDrop:
-		m.responder = &responders.DropResponder{}
-	case responderGarbage:
-		m.responder = &responders.GarbageResponder{}
-	case responderRateLimit:
-		m.responder = &responders.RateLimitResponder{}
-	case responderRedirect:
-		m.URL = rawConfig.URL
-		m.responder = &responders.RedirectResponder{
-			URL: m.URL,
-		}
-	case responderTarpit:
-		m.responder = &tarpit.Responder{
-			Config: &m.TarpitConfig,
-		}
-
-	default:
-		return fmt.Errorf("unknown responder type: %s", rawConfig.RawResponder)
-	}
-
 	// Use reflection to copy fields excluding excludedKeys
 	rawVal := reflect.ValueOf(rawConfig)
 	mVal := reflect.ValueOf(m).Elem()
@@ -234,45 +518,231 @@ func (m *Defender) UnmarshalJSON(b []byte) error {
 		}
 	}
 
+	// Responder modules are loaded when provisioning
+	if m.ResponderRaw != nil {
+		return nil
+	}
+
+	// The rules name their own responders, so the handler's own defaults to blocking
+	if m.RawResponder == "" && len(m.Rules) > 0 {
+		m.RawResponder = responderBlock
+	}
+
+	responder, err := m.newResponder(m.RawResponder)
+	if err != nil {
+		return err
+	}
+	m.responder = responder
+
 	return nil
 }
 
+// validResponder reports whether name is a registered responder module.
+func validResponder(name string) bool {
+	_, ok := responders.Lookup(name)
+	return ok
+}
+
+// newResponder creates the responder named name. The built-in responders take their
+// settings from the handler's fields, others start from their zero value.
+func (m *Defender) newResponder(name string) (responders.Responder, error) {
+	module, ok := responders.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown responder type: %s", name)
+	}
+	responder, ok := module.New().(responders.Responder)
+	if !ok {
+		return nil, fmt.Errorf("module %s is not a responder", module.ID)
+	}
+
+	switch r := responder.(type) {
+	case *challenge.Responder:
+		r.Config = &m.ChallengeConfig
+	case *responders.CustomResponder:
+		r.Message = m.Message
+		r.StatusCode = m.StatusCode
+	case *ratelimit.Responder:
+		r.Config = &m.RateLimitConfig
+	case *responders.RedirectResponder:
+		r.URL = m.URL
+	case *tarpit.Responder:
+		// Provisioning fills in the defaults, which shouldn't leak into the handler's settings
+		cfg := m.TarpitConfig
+		r.Config = &cfg
+	}
+	return responder, nil
+}
+
 // Validate ensures the middleware configuration is valid
 func (m *Defender) Validate() error {
-	if m.responder == nil {
+	if m.responder == nil && m.ResponderRaw == nil {
 		return fmt.Errorf("responder not configured")
 	}
 
-	for _, ipRange := range m.Ranges {
-		// Check if the range is a predefined key (e.g., "openai")
-		if _, ok := data.IPRanges[ipRange]; ok {
-			// If it's a predefined key, skip CIDR validation
-			continue
-		}
+	if err := validateRanges(m.Ranges); err != nil {
+		return err
+	}
 
-		// Otherwise, treat it as a custom CIDR and validate it
-		_, _, err := net.ParseCIDR(ipRange)
-		if err != nil {
-			return fmt.Errorf("invalid IP range %q: %v", ipRange, err)
+	for i := range m.Rules {
+		if err := m.Rules[i].validate(m.redirectConfigured()); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
 		}
 	}
 
-	// Check if the whitelist is valid
-	err := whitelist.Validate(m.Whitelist)
+	// Check if the whitelist is valid; range files and URLs are validated when provisioning
+	err := whitelist.Validate(slices.DeleteFunc(slices.Clone(m.Whitelist), func(entry string) bool {
+		return sources.IsFile(entry) || sources.IsRemote(entry)
+	}))
 	if err != nil {
 		return err
 	}
 
-	// Validate responder config options
-	if m.RawResponder == responderRedirect && m.URL == "" {
+	if err := useragent.Validate(m.UserAgents); err != nil {
+		return err
+	}
+
+	if m.Remote.MaxSize < 0 || m.Remote.MinCount < 0 || m.Remote.Timeout < 0 {
+		return errors.New("remote max_size, min_count and timeout must not be negative")
+	}
+
+	if m.Cache.Capacity < 0 || m.Cache.Shards < 0 || m.Cache.TTL < 0 {
+		return errors.New("cache capacity, shards and ttl must not be negative")
+	}
+
+	if err := m.RateLimitConfig.Validate(); err != nil {
+		return err
+	}
+
+	if err := m.ChallengeConfig.Validate(); err != nil {
+		return err
+	}
+
+	if m.RefreshInterval != 0 && time.Duration(m.RefreshInterval) < minRefreshInterval {
+		return fmt.Errorf("refresh_interval must be at least %s", minRefreshInterval)
+	}
+
+	if m.ClientIP != nil {
+		if err := m.ClientIP.validate(); err != nil {
+			return err
+		}
+	}
+
+	if m.BanHeader != nil {
+		if err := m.BanHeader.validate(); err != nil {
+			return err
+		}
+	}
+
+	if m.Traps != nil {
+		if err := m.Traps.validate(); err != nil {
+			return err
+		}
+		if m.Traps.Responder == responderRedirect && !m.redirectConfigured() {
+			return errors.New("traps redirect responder requires 'url' to be set")
+		}
+	}
+
+	if m.Robots != nil {
+		if err := m.Robots.validate(); err != nil {
+			return err
+		}
+	}
+
+	if m.Escalation != nil {
+		if err := m.Escalation.validate(); err != nil {
+			return err
+		}
+		// Escalation picks the responder itself, which would leave the rules' responders unused
+		if len(m.Rules) > 0 {
+			return errors.New("escalation can't be combined with rules")
+		}
+		for _, step := range m.Escalation.Steps {
+			if step.Responder == responderRedirect && !m.redirectConfigured() {
+				return errors.New("escalation redirect responder requires 'url' to be set")
+			}
+		}
+	}
+
+	if m.VerifyCrawlers != nil {
+		if err := m.VerifyCrawlers.validate(); err != nil {
+			return err
+		}
+		if m.VerifyCrawlers.Responder == responderRedirect && !m.redirectConfigured() {
+			return errors.New("verify_crawlers redirect responder requires 'url' to be set")
+		}
+	}
+
+	if m.EnforceRobots != nil {
+		if err := m.EnforceRobots.validate(); err != nil {
+			return err
+		}
+		if m.EnforceRobots.Responder == responderRedirect && !m.redirectConfigured() {
+			return errors.New("enforce_robots redirect responder requires 'url' to be set")
+		}
+	}
+
+	if m.Mode != "" && m.Mode != modeEnforce && m.Mode != modeMonitor {
+		return fmt.Errorf("invalid mode %q: must be %q or %q", m.Mode, modeEnforce, modeMonitor)
+	}
+
+	// Validate responder config options; responder modules validate their own
+	if m.RawResponder == responderRedirect && !m.redirectConfigured() {
 		return errors.New("redirect responder requires 'url' to be set")
 	}
 
 	return nil
 }
 
+// redirectConfigured reports whether the "redirect" responder has a URL to redirect to: the
+// handler's url, or the handler's own redirect responder module, which is reused wherever
+// "redirect" is named and validates its URL itself.
+func (m *Defender) redirectConfigured() bool {
+	if m.URL != "" {
+		return true
+	}
+	return m.RawResponder == responderRedirect && (m.ResponderRaw != nil || m.loadedResponder)
+}
+
+// validateRanges checks that every range entry is a predefined key, a CIDR, a range file or a URL,
+// optionally prefixed with "!".
+func validateRanges(ranges []string) error {
+	for _, entry := range ranges {
+		// Exclusions ("!<range>") follow the same rules as the ranges they carve out
+		ipRange, _ := ip.ParseEntry(entry)
+
+		// Check if the range is a predefined key (e.g., "openai")
+		if _, ok := data.IPRanges[ipRange]; ok {
+			// If it's a predefined key, skip CIDR validation
+			continue
+		}
+
+		// Range files are parsed (and reported line by line) when provisioning
+		if sources.IsFile(ipRange) {
+			if ipRange == sources.FileScheme {
+				return fmt.Errorf("invalid IP range %q: missing file path", entry)
+			}
+			continue
+		}
+
+		// URLs are fetched and validated when provisioning
+		if sources.IsRemote(ipRange) {
+			if u, err := url.Parse(ipRange); err != nil || u.Host == "" {
+				return fmt.Errorf("invalid IP range %q: invalid URL", entry)
+			}
+			continue
+		}
+
+		// Otherwise, treat it as a custom CIDR and validate it
+		_, _, err := net.ParseCIDR(ipRange)
+		if err != nil {
+			return fmt.Errorf("invalid IP range %q: %v", entry, err)
+		}
+	}
+	return nil
+}
+
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var m Defender
 	err := m.UnmarshalCaddyfile(h.Dispenser)
-	return m, err
+	return &m, err
 }
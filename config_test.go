@@ -2,6 +2,7 @@
 package caddydefender
 
 import (
+	"context"
 	"encoding/json"
 	"sort"
 	"testing"
@@ -9,7 +10,11 @@ import (
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddytest"
+	"pkg.jsn.cam/caddy-defender/matchers/ip"
+	"pkg.jsn.cam/caddy-defender/ranges/sources"
 	"pkg.jsn.cam/caddy-defender/responders"
+	"pkg.jsn.cam/caddy-defender/responders/challenge"
+	"pkg.jsn.cam/caddy-defender/responders/ratelimit"
 	"pkg.jsn.cam/caddy-defender/responders/tarpit"
 
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -109,6 +114,118 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 				Ranges:       []string{"cloudflare"},
 			},
 		},
+		{
+			name: "valid refresh interval",
+			input: `defender block {
+				ranges openai
+				refresh_interval 12h
+			}`,
+			expected: Defender{
+				RawResponder:    "block",
+				Ranges:          []string{"openai"},
+				RefreshInterval: caddy.Duration(12 * time.Hour),
+			},
+		},
+		{
+			name: "valid remote ranges",
+			input: `defender block {
+				ranges https://example.com/ranges.txt
+				refresh_interval 1h
+				remote {
+					max_size 1048576
+					min_count 10
+					timeout 5s
+					json_keys cidrs ipv6_cidrs
+				}
+			}`,
+			expected: Defender{
+				RawResponder:    "block",
+				Ranges:          []string{"https://example.com/ranges.txt"},
+				RefreshInterval: caddy.Duration(time.Hour),
+				Remote: sources.RemoteConfig{
+					MaxSize:  1048576,
+					MinCount: 10,
+					Timeout:  caddy.Duration(5 * time.Second),
+					JSONKeys: []string{"cidrs", "ipv6_cidrs"},
+				},
+			},
+		},
+		{
+			name: "invalid remote min_count",
+			input: `defender block {
+				remote {
+					min_count many
+				}
+			}`,
+			errContains: "invalid min_count value",
+			expectError: true,
+		},
+		{
+			name: "valid cache settings",
+			input: `defender block {
+				ranges openai
+				cache {
+					capacity 50000
+					shards 32
+					ttl 1m
+					disable_early_refreshes
+				}
+			}`,
+			expected: Defender{
+				RawResponder: "block",
+				Ranges:       []string{"openai"},
+				Cache: ip.CacheConfig{
+					Capacity:              50000,
+					Shards:                32,
+					TTL:                   caddy.Duration(time.Minute),
+					DisableEarlyRefreshes: true,
+				},
+			},
+		},
+		{
+			name: "cache off",
+			input: `defender block {
+				ranges openai
+				cache off
+			}`,
+			expected: Defender{
+				RawResponder: "block",
+				Ranges:       []string{"openai"},
+				Cache:        ip.CacheConfig{Disabled: true},
+			},
+		},
+		{
+			name: "monitor mode",
+			input: `defender block {
+				ranges openai
+				mode monitor
+				monitor_header X-Defender-Monitor
+			}`,
+			expected: Defender{
+				RawResponder:  "block",
+				Ranges:        []string{"openai"},
+				Mode:          "monitor",
+				MonitorHeader: "X-Defender-Monitor",
+			},
+		},
+		{
+			name: "invalid cache capacity",
+			input: `defender block {
+				cache {
+					capacity lots
+				}
+			}`,
+			errContains: "invalid capacity value",
+			expectError: true,
+		},
+		{
+			name: "invalid refresh interval",
+			input: `defender block {
+				refresh_interval soon
+			}`,
+			errContains: "invalid refresh_interval value",
+			expectError: true,
+		},
 		{
 			name: "missing responder type",
 			input: `defender {
@@ -117,6 +234,56 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 			errContains: "missing responder type",
 			expectError: true,
 		},
+		{
+			name: "responder module",
+			input: `defender {
+				ranges openai
+				responder custom "Go away" {
+					status_code 418
+				}
+			}`,
+			expected: Defender{
+				RawResponder: "custom",
+				Ranges:       []string{"openai"},
+				ResponderRaw: json.RawMessage(`{"responder":"custom","message":"Go away","status_code":418}`),
+			},
+		},
+		{
+			name: "responder module matching the responder type",
+			input: `defender redirect {
+				responder redirect https://example.com
+			}`,
+			expected: Defender{
+				RawResponder: "redirect",
+				ResponderRaw: json.RawMessage(`{"responder":"redirect","url":"https://example.com"}`),
+			},
+		},
+		{
+			name: "responder module conflicting with the responder type",
+			input: `defender block {
+				responder drop
+			}`,
+			errContains: "responder already set to block",
+			expectError: true,
+		},
+		{
+			name: "unknown responder module",
+			input: `defender {
+				responder invalid
+			}`,
+			errContains: "getting module named 'http.handlers.defender.responders.invalid'",
+			expectError: true,
+		},
+		{
+			name: "responder module with unknown setting",
+			input: `defender {
+				responder tarpit {
+					speed 10
+				}
+			}`,
+			errContains: "unknown nested config key: speed",
+			expectError: true,
+		},
 		{
 			name: "invalid responder type",
 			input: `defender invalid {
@@ -125,6 +292,258 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 			errContains: "invalid responder type",
 			expectError: true,
 		},
+		{
+			name: "client ip header",
+			input: `defender block {
+				client_ip {
+					header CF-Connecting-IP
+					trusted_proxies cloudflare 10.0.0.0/8
+				}
+			}`,
+			expected: Defender{
+				RawResponder: "block",
+				ClientIP: &ClientIPConfig{
+					Header:         "CF-Connecting-IP",
+					TrustedProxies: []string{"cloudflare", "10.0.0.0/8"},
+				},
+			},
+		},
+		{
+			name: "ban var",
+			input: `defender block {
+				ban_var abuse
+			}`,
+			expected: Defender{
+				RawResponder: "block",
+				BanVar:       "abuse",
+			},
+		},
+		{
+			name: "ban header",
+			input: `defender block {
+				ban_header X-Defender-Ban {
+					ipv4_prefix 24
+					ipv6_prefix 64
+				}
+			}`,
+			expected: Defender{
+				RawResponder: "block",
+				BanHeader:    &BanHeaderConfig{Header: "X-Defender-Ban", IPv4Prefix: 24, IPv6Prefix: 64},
+			},
+		},
+		{
+			name: "invalid ban_header prefix",
+			input: `defender block {
+				ban_header X-Defender-Ban {
+					ipv4_prefix wide
+				}
+			}`,
+			errContains: "invalid ipv4_prefix value",
+			expectError: true,
+		},
+		{
+			name: "traps",
+			input: `defender block {
+				traps /wp-admin/ /.env {
+					paths /secret-archive
+					duration 12h
+					responder tarpit
+				}
+			}`,
+			expected: Defender{
+				RawResponder: "block",
+				Traps: &TrapConfig{
+					Paths:     []string{"/wp-admin/", "/.env", "/secret-archive"},
+					Duration:  caddy.Duration(12 * time.Hour),
+					Responder: "tarpit",
+				},
+			},
+		},
+		{
+			name: "enforce robots",
+			input: `defender block {
+				serve_ignore
+				enforce_robots {
+					duration 1h
+					responder garbage
+				}
+			}`,
+			expected: Defender{
+				RawResponder:  "block",
+				EnforceRobots: &RobotsPolicyConfig{Duration: caddy.Duration(time.Hour), Responder: "garbage"},
+			},
+		},
+		{
+			name: "robots",
+			input: `defender block {
+				robots {
+					allow Googlebot Bingbot
+					disallow CCBot
+					paths /search /cart
+					merge
+					ai_txt
+					llms_txt
+				}
+			}`,
+			expected: Defender{
+				RawResponder: "block",
+				Robots: &RobotsConfig{
+					Allow:    []string{"Googlebot", "Bingbot"},
+					Disallow: []string{"CCBot"},
+					Paths:    []string{"/search", "/cart"},
+					LLMsTxt:  defaultLLMsTxt,
+					Merge:    true,
+					AITxt:    true,
+				},
+			},
+		},
+		{
+			name: "user agents",
+			input: `defender block {
+				user_agents ai_crawlers "^python-requests/"
+			}`,
+			expected: Defender{
+				RawResponder: "block",
+				UserAgents:   []string{"ai_crawlers", "^python-requests/"},
+			},
+		},
+		{
+			name: "verify crawlers",
+			input: `defender block {
+				verify_crawlers {
+					responder garbage
+					allow_verified
+					crawler Googlebot 66.249.64.0/19 2001:4860:4801::/48
+				}
+			}`,
+			expected: Defender{
+				RawResponder: "block",
+				VerifyCrawlers: &VerifyCrawlersConfig{
+					Crawlers:      map[string][]string{"Googlebot": {"66.249.64.0/19", "2001:4860:4801::/48"}},
+					Responder:     "garbage",
+					AllowVerified: true,
+				},
+			},
+		},
+		{
+			name: "ratelimit config",
+			input: `defender ratelimit {
+				ratelimit_config {
+					algorithm sliding_window
+					events 30
+					window 1m
+					ipv4_prefix 24
+					ipv6_prefix 64
+					group openai {
+						events 5
+						window 1h
+					}
+				}
+			}`,
+			expected: Defender{
+				RawResponder: "ratelimit",
+				RateLimitConfig: ratelimit.Config{
+					Limit: ratelimit.Limit{
+						Algorithm: "sliding_window",
+						Window:    caddy.Duration(time.Minute),
+						Events:    30,
+					},
+					Groups:     map[string]ratelimit.Limit{"openai": {Window: caddy.Duration(time.Hour), Events: 5}},
+					IPv4Prefix: 24,
+					IPv6Prefix: 64,
+				},
+			},
+		},
+		{
+			name: "escalation",
+			input: `defender block {
+				escalation {
+					window 30m
+					after 5 tarpit
+					after 20 drop
+				}
+			}`,
+			expected: Defender{
+				RawResponder: "block",
+				Escalation: &EscalationConfig{
+					Steps: []EscalationStep{
+						{Responder: "tarpit", After: 5},
+						{Responder: "drop", After: 20},
+					},
+					Window: caddy.Duration(30 * time.Minute),
+				},
+			},
+		},
+		{
+			name: "escalation step without responder",
+			input: `defender block {
+				escalation {
+					after 5
+				}
+			}`,
+			expectError: true,
+		},
+		{
+			name: "challenge config",
+			input: `defender challenge {
+				challenge_config {
+					difficulty 18
+					duration 12h
+					keys {env.CHALLENGE_KEY} {env.OLD_CHALLENGE_KEY}
+					template /etc/caddy/challenge.html
+					cookie_name proof
+				}
+			}`,
+			expected: Defender{
+				RawResponder: "challenge",
+				ChallengeConfig: challenge.Config{
+					Keys:       []string{"{env.CHALLENGE_KEY}", "{env.OLD_CHALLENGE_KEY}"},
+					Template:   "/etc/caddy/challenge.html",
+					CookieName: "proof",
+					Duration:   caddy.Duration(12 * time.Hour),
+					Difficulty: 18,
+				},
+			},
+		},
+		{
+			name: "invalid ratelimit events",
+			input: `defender ratelimit {
+				ratelimit_config {
+					events many
+				}
+			}`,
+			errContains: "invalid events value",
+			expectError: true,
+		},
+		{
+			name: "verify crawlers crawler without ranges",
+			input: `defender block {
+				verify_crawlers {
+					crawler Googlebot
+				}
+			}`,
+			expectError: true,
+		},
+		{
+			name: "invalid traps duration",
+			input: `defender block {
+				traps /wp-admin/ {
+					duration forever
+				}
+			}`,
+			errContains: "invalid duration value",
+			expectError: true,
+		},
+		{
+			name: "invalid client_ip key",
+			input: `defender block {
+				client_ip {
+					trusted_hops 2
+				}
+			}`,
+			errContains: "unknown nested config key",
+			expectError: true,
+		},
 		{
 			name: "invalid subdirective",
 			input: `defender block {
@@ -194,6 +613,27 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 			require.Equal(t, tt.expected.RawResponder, def.RawResponder)
 			require.Equal(t, tt.expected.Ranges, def.Ranges)
 			require.Equal(t, tt.expected.Message, def.Message)
+			require.Equal(t, tt.expected.RefreshInterval, def.RefreshInterval)
+			require.Equal(t, tt.expected.Remote, def.Remote)
+			require.Equal(t, tt.expected.Cache, def.Cache)
+			require.Equal(t, tt.expected.Mode, def.Mode)
+			require.Equal(t, tt.expected.MonitorHeader, def.MonitorHeader)
+			require.Equal(t, tt.expected.ClientIP, def.ClientIP)
+			require.Equal(t, tt.expected.BanVar, def.BanVar)
+			require.Equal(t, tt.expected.BanHeader, def.BanHeader)
+			require.Equal(t, tt.expected.Traps, def.Traps)
+			require.Equal(t, tt.expected.EnforceRobots, def.EnforceRobots)
+			require.Equal(t, tt.expected.Robots, def.Robots)
+			require.Equal(t, tt.expected.UserAgents, def.UserAgents)
+			require.Equal(t, tt.expected.VerifyCrawlers, def.VerifyCrawlers)
+			require.Equal(t, tt.expected.RateLimitConfig, def.RateLimitConfig)
+			require.Equal(t, tt.expected.ChallengeConfig, def.ChallengeConfig)
+			require.Equal(t, tt.expected.Escalation, def.Escalation)
+			if tt.expected.ResponderRaw != nil {
+				require.JSONEq(t, string(tt.expected.ResponderRaw), string(def.ResponderRaw))
+			} else {
+				require.Nil(t, def.ResponderRaw)
+			}
 		})
 	}
 }
@@ -287,6 +727,13 @@ func TestUnmarshalJSON(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:  "responder module is loaded when provisioning",
+			input: `{"responder":{"responder":"drop"},"ranges":["openai"]}`,
+			expected: Defender{
+				Ranges: []string{"openai"},
+			},
+		},
 		{
 			name:        "invalid responder type",
 			input:       `{"raw_responder":"invalid"}`,
@@ -334,6 +781,48 @@ func TestValidation(t *testing.T) {
 		require.NoError(t, def.Validate())
 	})
 
+	t.Run("redirect responder module", func(t *testing.T) {
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		defer cancel()
+		var def Defender
+		require.NoError(t, def.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`defender {
+			ranges 203.0.113.0/24
+			responder redirect https://example.com
+		}`)))
+		require.NoError(t, def.Validate())
+		require.NoError(t, def.Provision(ctx))
+		defer func() { require.NoError(t, def.Cleanup()) }()
+		require.NoError(t, def.Validate(), "validated after the module is loaded")
+	})
+
+	t.Run("redirect named with a redirect responder module", func(t *testing.T) {
+		def := Defender{
+			Ranges:       []string{"203.0.113.0/24"},
+			ResponderRaw: json.RawMessage(`{"responder":"redirect","url":"https://example.com"}`),
+			RawResponder: "redirect",
+			Traps:        &TrapConfig{Paths: []string{"/wp-admin/"}, Responder: "redirect"},
+			Escalation:   &EscalationConfig{Steps: []EscalationStep{{Responder: "redirect", After: 1}}},
+		}
+		require.NoError(t, def.Validate())
+
+		def.ResponderRaw = nil
+		require.ErrorContains(t, def.Validate(), "responder not configured")
+		def.responder = &responders.BlockResponder{}
+		def.RawResponder = "block"
+		require.ErrorContains(t, def.Validate(), "traps redirect responder requires 'url' to be set")
+	})
+
+	t.Run("escalation with rules", func(t *testing.T) {
+		def := Defender{
+			RawResponder: "block",
+			Ranges:       []string{"10.0.0.0/8"},
+			Rules:        []Rule{{Ranges: []string{"openai"}, RawResponder: "drop"}},
+			Escalation:   &EscalationConfig{Steps: []EscalationStep{{Responder: "tarpit", After: 1}}},
+			responder:    &responders.BlockResponder{},
+		}
+		require.ErrorContains(t, def.Validate(), "escalation can't be combined with rules")
+	})
+
 	t.Run("missing responder", func(t *testing.T) {
 		def := Defender{
 			Ranges: []string{"10.0.0.0/8"},
@@ -350,6 +839,33 @@ func TestValidation(t *testing.T) {
 		require.ErrorContains(t, def.Validate(), "invalid IP range")
 	})
 
+	t.Run("valid exclusions", func(t *testing.T) {
+		def := Defender{
+			RawResponder: "block",
+			Ranges:       []string{"aws", "!203.0.113.0/24", "!githubcopilot"},
+			responder:    &responders.BlockResponder{},
+		}
+		require.NoError(t, def.Validate())
+	})
+
+	t.Run("invalid exclusion", func(t *testing.T) {
+		def := Defender{
+			RawResponder: "block",
+			Ranges:       []string{"aws", "!invalid"},
+			responder:    &responders.BlockResponder{},
+		}
+		require.ErrorContains(t, def.Validate(), `invalid IP range "!invalid"`)
+	})
+
+	t.Run("invalid URL range", func(t *testing.T) {
+		def := Defender{
+			RawResponder: "block",
+			Ranges:       []string{"https://"},
+			responder:    &responders.BlockResponder{},
+		}
+		require.ErrorContains(t, def.Validate(), "invalid URL")
+	})
+
 	t.Run("invalid whitelist IP", func(t *testing.T) {
 		def := Defender{
 			RawResponder: "block",
@@ -359,6 +875,139 @@ func TestValidation(t *testing.T) {
 		require.ErrorContains(t, def.Validate(), "invalid IP address")
 	})
 
+	t.Run("refresh interval too short", func(t *testing.T) {
+		def := Defender{
+			RawResponder:    "block",
+			Ranges:          []string{"openai"},
+			RefreshInterval: caddy.Duration(time.Second),
+			responder:       &responders.BlockResponder{},
+		}
+		require.ErrorContains(t, def.Validate(), "refresh_interval must be at least")
+	})
+
+	t.Run("invalid mode", func(t *testing.T) {
+		def := Defender{
+			RawResponder: "block",
+			Ranges:       []string{"openai"},
+			Mode:         "dry-run",
+			responder:    &responders.BlockResponder{},
+		}
+		require.ErrorContains(t, def.Validate(), "invalid mode")
+	})
+
+	t.Run("negative cache ttl", func(t *testing.T) {
+		def := Defender{
+			RawResponder: "block",
+			Ranges:       []string{"openai"},
+			Cache:        ip.CacheConfig{TTL: caddy.Duration(-time.Minute)},
+			responder:    &responders.BlockResponder{},
+		}
+		require.ErrorContains(t, def.Validate(), "cache capacity, shards and ttl must not be negative")
+	})
+
+	t.Run("client_ip without trusted proxies", func(t *testing.T) {
+		def := Defender{
+			RawResponder: "block",
+			Ranges:       []string{"openai"},
+			ClientIP:     &ClientIPConfig{Header: "X-Forwarded-For"},
+			responder:    &responders.BlockResponder{},
+		}
+		require.ErrorContains(t, def.Validate(), "client_ip requires trusted_proxies")
+	})
+
+	t.Run("client_ip with invalid trusted proxy", func(t *testing.T) {
+		def := Defender{
+			RawResponder: "block",
+			Ranges:       []string{"openai"},
+			ClientIP:     &ClientIPConfig{Header: "X-Forwarded-For", TrustedProxies: []string{"not-a-proxy"}},
+			responder:    &responders.BlockResponder{},
+		}
+		require.ErrorContains(t, def.Validate(), "invalid client_ip trusted_proxies")
+	})
+
+	t.Run("ban_header prefix out of range", func(t *testing.T) {
+		def := Defender{
+			RawResponder: "block",
+			Ranges:       []string{"openai"},
+			BanHeader:    &BanHeaderConfig{Header: "X-Defender-Ban", IPv6Prefix: 129},
+			responder:    &responders.BlockResponder{},
+		}
+		require.ErrorContains(t, def.Validate(), "ban_header ipv6_prefix out of range")
+	})
+
+	t.Run("invalid user agent pattern", func(t *testing.T) {
+		def := Defender{
+			RawResponder: "block",
+			Ranges:       []string{"openai"},
+			UserAgents:   []string{"ai_crawlers", "Bot(["},
+			responder:    &responders.BlockResponder{},
+		}
+		require.ErrorContains(t, def.Validate(), "invalid user agent pattern")
+	})
+
+	t.Run("invalid verify_crawlers ranges", func(t *testing.T) {
+		def := Defender{
+			RawResponder:   "block",
+			Ranges:         []string{"openai"},
+			VerifyCrawlers: &VerifyCrawlersConfig{Crawlers: map[string][]string{"Googlebot": {"google"}}},
+			responder:      &responders.BlockResponder{},
+		}
+		require.ErrorContains(t, def.Validate(), "invalid verify_crawlers ranges for Googlebot")
+	})
+
+	t.Run("verify_crawlers redirect without url", func(t *testing.T) {
+		def := Defender{
+			RawResponder:   "block",
+			Ranges:         []string{"openai"},
+			VerifyCrawlers: &VerifyCrawlersConfig{Responder: "redirect"},
+			responder:      &responders.BlockResponder{},
+		}
+		require.ErrorContains(t, def.Validate(), "verify_crawlers redirect responder requires 'url'")
+	})
+
+	t.Run("escalation steps out of order", func(t *testing.T) {
+		def := Defender{
+			RawResponder: "block",
+			Ranges:       []string{"openai"},
+			Escalation: &EscalationConfig{Steps: []EscalationStep{
+				{Responder: "drop", After: 20},
+				{Responder: "tarpit", After: 5},
+			}},
+			responder: &responders.BlockResponder{},
+		}
+		require.ErrorContains(t, def.Validate(), "increasing order of strikes")
+	})
+
+	t.Run("trap at the root", func(t *testing.T) {
+		def := Defender{
+			RawResponder: "block",
+			Ranges:       []string{"openai"},
+			Traps:        &TrapConfig{Paths: []string{"/"}},
+			responder:    &responders.BlockResponder{},
+		}
+		require.ErrorContains(t, def.Validate(), "invalid trap path")
+	})
+
+	t.Run("robots path without leading slash", func(t *testing.T) {
+		def := Defender{
+			RawResponder: "block",
+			Ranges:       []string{"openai"},
+			Robots:       &RobotsConfig{Paths: []string{"search"}},
+			responder:    &responders.BlockResponder{},
+		}
+		require.ErrorContains(t, def.Validate(), "invalid robots path")
+	})
+
+	t.Run("traps redirect without url", func(t *testing.T) {
+		def := Defender{
+			RawResponder: "block",
+			Ranges:       []string{"openai"},
+			Traps:        &TrapConfig{Paths: []string{"/wp-admin/"}, Responder: "redirect"},
+			responder:    &responders.BlockResponder{},
+		}
+		require.ErrorContains(t, def.Validate(), "traps redirect responder requires 'url'")
+	})
+
 	t.Run("Missing ranges", func(t *testing.T) {
 		def := Defender{
 			RawResponder: "block",
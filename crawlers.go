@@ -0,0 +1,96 @@
+package caddydefender
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"go.uber.org/zap"
+	"pkg.jsn.cam/caddy-defender/matchers/ip"
+	"pkg.jsn.cam/caddy-defender/matchers/useragent"
+	"pkg.jsn.cam/caddy-defender/matchers/whitelist"
+)
+
+// groupSpoofed is the {http.defender.group} of requests claiming to be a known crawler from
+// outside its published ranges.
+const groupSpoofed = "spoofed"
+
+// VerifyCrawlersConfig checks that requests whose User-Agent claims a known crawler, such as
+// GPTBot, come from the crawler's published ranges. The known crawlers and their range keys are
+// listed in data.VerifiedCrawlers.
+type VerifyCrawlersConfig struct {
+	// Crawlers maps more user-agent tokens to the predefined range keys and CIDRs their crawler
+	// connects from, e.g. {"bingbot": ["157.55.39.0/24"]}. Tokens already known are extended.
+	Crawlers map[string][]string `json:"crawlers,omitempty"`
+
+	// Responder names the responder handling requests from spoofed crawlers.
+	// Default: "" (the handler's responder)
+	Responder string `json:"responder,omitempty"`
+
+	// AllowVerified lets verified crawlers through even if their IP is in the blocked ranges or
+	// their User-Agent matches user_agents.
+	// Default: false
+	AllowVerified bool `json:"allow_verified,omitempty"`
+}
+
+// validate checks that the responder and crawler ranges are valid.
+func (c *VerifyCrawlersConfig) validate() error {
+	if c.Responder != "" && !validResponder(c.Responder) {
+		return fmt.Errorf("invalid verify_crawlers responder: %s", c.Responder)
+	}
+	for token, ranges := range c.Crawlers {
+		if token == "" || len(ranges) == 0 {
+			return fmt.Errorf("verify_crawlers crawler %q requires a token and ranges", token)
+		}
+		if err := whitelist.Validate(ranges); err != nil {
+			return fmt.Errorf("invalid verify_crawlers ranges for %s: %w", token, err)
+		}
+	}
+	return nil
+}
+
+// provisionCrawlerVerifier builds the verifier of the known and configured crawlers.
+func (m *Defender) provisionCrawlerVerifier() error {
+	crawlers := useragent.DefaultCrawlers()
+	for token, ranges := range m.VerifyCrawlers.Crawlers {
+		crawlers[token] = append(crawlers[token], ranges...)
+	}
+	verifier, err := useragent.NewVerifier(crawlers)
+	if err != nil {
+		return fmt.Errorf("invalid verify_crawlers: %w", err)
+	}
+	m.verifier = verifier
+	return nil
+}
+
+// verifyCrawler blocks requests claiming to be a known crawler from outside its ranges, and
+// reports whether it did. Verified crawlers are allowed if configured. Whitelisted and banned
+// clients are left alone.
+func (m *Defender) verifyCrawler(r *http.Request, clientIP net.IP, result ip.Result) (ip.Result, bool) {
+	if m.verifier == nil || result.Whitelisted || result.Ban != nil {
+		return result, false
+	}
+	addr, ok := netip.AddrFromSlice(clientIP)
+	if !ok {
+		return result, false
+	}
+	claim, ok := m.verifier.Verify(r.UserAgent(), addr.Unmap())
+	if !ok {
+		return result, false
+	}
+
+	if !claim.Verified {
+		m.log.Debug("Spoofed crawler",
+			zap.String("ip", clientIP.String()),
+			zap.String("crawler", claim.Crawler),
+			zap.String("user_agent", r.UserAgent()),
+		)
+		return ip.Result{Match: &ip.Match{Groups: []string{groupSpoofed}}}, true
+	}
+	if m.VerifyCrawlers.AllowVerified {
+		m.log.Debug("Verified crawler allowed", zap.String("ip", clientIP.String()), zap.String("crawler", claim.Crawler))
+		return ip.Result{Allowed: true, Whitelisted: true}, false
+	}
+	return result, false
+}
@@ -0,0 +1,108 @@
+package caddydefender
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+	"pkg.jsn.cam/caddy-defender/ranges/data"
+	"pkg.jsn.cam/caddy-defender/responders"
+)
+
+func TestDefenderServeHTTP_VerifyCrawlers(t *testing.T) {
+	openai := netip.MustParsePrefix(data.IPRanges["openai"][0]).Addr().Next().String()
+
+	tests := []struct {
+		name          string
+		ip            string
+		userAgent     string
+		group         string
+		status        int
+		allowVerified bool
+	}{
+		{
+			name:      "spoofed crawler",
+			ip:        "192.0.2.70",
+			userAgent: "Mozilla/5.0 AppleWebKit/537.36 (KHTML, like Gecko; compatible; GPTBot/1.2; +https://openai.com/gptbot)",
+			group:     groupSpoofed,
+			status:    http.StatusTeapot,
+		},
+		{
+			name:      "configured crawler from its ranges",
+			ip:        "66.249.66.1",
+			userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			status:    http.StatusOK,
+		},
+		{
+			name:      "spoofed configured crawler",
+			ip:        "192.0.2.70",
+			userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			group:     groupSpoofed,
+			status:    http.StatusTeapot,
+		},
+		{
+			name:      "verified crawler in the blocked ranges",
+			ip:        openai,
+			userAgent: "GPTBot/1.2",
+			group:     "openai",
+			status:    http.StatusForbidden,
+		},
+		{
+			name:          "verified crawler allowed",
+			ip:            openai,
+			userAgent:     "GPTBot/1.2",
+			status:        http.StatusOK,
+			allowVerified: true,
+		},
+		{
+			name:      "whitelisted client",
+			ip:        "198.51.100.70",
+			userAgent: "GPTBot/1.2",
+			status:    http.StatusOK,
+		},
+		{
+			name:      "browser",
+			ip:        "192.0.2.70",
+			userAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:138.0) Gecko/20100101 Firefox/138.0",
+			status:    http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defender := &Defender{
+				RawResponder: "block",
+				Ranges:       []string{"openai"},
+				Whitelist:    []string{"198.51.100.70"},
+				Message:      "spoofed crawler",
+				StatusCode:   http.StatusTeapot,
+				VerifyCrawlers: &VerifyCrawlersConfig{
+					Crawlers:      map[string][]string{"Googlebot": {"66.249.64.0/19"}},
+					Responder:     "custom",
+					AllowVerified: tt.allowVerified,
+				},
+				responder: &responders.BlockResponder{},
+			}
+			require.NoError(t, defender.Validate())
+			require.NoError(t, defender.Provision(caddy.Context{Context: context.Background()}))
+			defer func() { require.NoError(t, defender.Cleanup()) }()
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = net.JoinHostPort(tt.ip, "12345")
+			req.Header.Set("User-Agent", tt.userAgent)
+			repl := caddy.NewReplacer()
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+			recorder := httptest.NewRecorder()
+
+			require.NoError(t, defender.ServeHTTP(recorder, req, &mockHandler{}))
+			require.Equal(t, tt.status, recorder.Code)
+			group, _ := repl.GetString(placeholderGroup)
+			require.Equal(t, tt.group, group)
+		})
+	}
+}
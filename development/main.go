@@ -34,7 +34,6 @@ import (
 	// plug in Caddy modules here
 	_ "github.com/caddyserver/caddy/v2/modules/standard"
 	_ "pkg.jsn.cam/caddy-defender"
-	// _ "github.com/mholt/caddy-ratelimit" // Please uncomment if you wish to build with rate limiting
 )
 
 func main() {
@@ -0,0 +1,94 @@
+package caddydefender
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"pkg.jsn.cam/caddy-defender/responders"
+	"pkg.jsn.cam/caddy-defender/strikes"
+)
+
+// defaultEscalationWindow is the window strikes are counted over unless Window is set.
+const defaultEscalationWindow = time.Hour
+
+// EscalationStep is the responder used once a client has more than After strikes.
+type EscalationStep struct {
+	// Responder names the responder, e.g. "tarpit".
+	// Required.
+	Responder string `json:"responder"`
+
+	// After is the number of strikes the client must exceed.
+	After int `json:"after"`
+}
+
+// EscalationConfig picks the responder for a matched client by the number of its matched
+// requests (strikes) in a sliding window, so it can, say, be let through at first, tarpitted
+// next and dropped after that.
+type EscalationConfig struct {
+	// Steps lists the responders by increasing number of strikes. Clients with no more
+	// strikes than the first step's After are let through.
+	// Required.
+	Steps []EscalationStep `json:"steps,omitempty"`
+
+	// Window is the period strikes are counted over.
+	// Default: 1h
+	Window caddy.Duration `json:"window,omitempty"`
+}
+
+// validate checks that there are steps, in increasing order, with valid responders.
+func (c *EscalationConfig) validate() error {
+	if len(c.Steps) == 0 {
+		return errors.New("escalation requires at least one step")
+	}
+	for i, step := range c.Steps {
+		if !validResponder(step.Responder) {
+			return fmt.Errorf("invalid escalation responder: %s", step.Responder)
+		}
+		if step.After < 0 {
+			return fmt.Errorf("invalid escalation strikes: %d", step.After)
+		}
+		if i > 0 && step.After <= c.Steps[i-1].After {
+			return errors.New("escalation steps must be in increasing order of strikes")
+		}
+	}
+	if c.Window < 0 {
+		return errors.New("escalation window must not be negative")
+	}
+	return nil
+}
+
+// step returns the step for a client with the given number of strikes, if any.
+func (c *EscalationConfig) step(count int) (EscalationStep, bool) {
+	for i := len(c.Steps) - 1; i >= 0; i-- {
+		if count > c.Steps[i].After {
+			return c.Steps[i], true
+		}
+	}
+	return EscalationStep{}, false
+}
+
+// provisionEscalation sets up the strike counter.
+func (m *Defender) provisionEscalation() {
+	window := time.Duration(m.Escalation.Window)
+	if window == 0 {
+		window = defaultEscalationWindow
+	}
+	m.strikes = strikes.New(window)
+}
+
+// escalate records a strike for the client and returns the responder for its strikes, or
+// false if it is let through.
+func (m *Defender) escalate(clientIP net.IP) (string, responders.Responder, int, bool) {
+	addr, _ := netip.AddrFromSlice(clientIP)
+	count := m.strikes.Add(addr)
+	step, ok := m.Escalation.step(count)
+	if !ok {
+		return "", nil, count, false
+	}
+	name, responder := m.namedResponder(step.Responder)
+	return name, responder, count, true
+}
@@ -0,0 +1,73 @@
+package caddydefender
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+	"pkg.jsn.cam/caddy-defender/responders"
+)
+
+func TestEscalationConfigStep(t *testing.T) {
+	cfg := &EscalationConfig{Steps: []EscalationStep{
+		{Responder: "tarpit", After: 3},
+		{Responder: "drop", After: 10},
+	}}
+	require.NoError(t, cfg.validate())
+
+	tests := []struct {
+		responder string
+		count     int
+	}{
+		{count: 1},
+		{count: 3},
+		{count: 4, responder: "tarpit"},
+		{count: 10, responder: "tarpit"},
+		{count: 11, responder: "drop"},
+	}
+	for _, tt := range tests {
+		step, ok := cfg.step(tt.count)
+		require.Equal(t, tt.responder != "", ok, "strikes %d", tt.count)
+		require.Equal(t, tt.responder, step.Responder, "strikes %d", tt.count)
+	}
+}
+
+func TestDefenderServeHTTP_Escalation(t *testing.T) {
+	defender := &Defender{
+		RawResponder: "block",
+		Ranges:       []string{"203.0.113.0/24"},
+		Message:      "slow down",
+		StatusCode:   http.StatusTeapot,
+		Escalation: &EscalationConfig{Steps: []EscalationStep{
+			{Responder: "custom", After: 2},
+			{Responder: "block", After: 4},
+		}},
+		responder: &responders.BlockResponder{},
+	}
+	require.NoError(t, defender.Validate())
+	require.NoError(t, defender.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, defender.Cleanup()) }()
+
+	serve := func(ip string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = ip + ":12345"
+		recorder := httptest.NewRecorder()
+		require.NoError(t, defender.ServeHTTP(recorder, req, &mockHandler{}))
+		return recorder.Code
+	}
+
+	for i, status := range []int{
+		http.StatusOK, http.StatusOK,
+		http.StatusTeapot, http.StatusTeapot,
+		http.StatusForbidden, http.StatusForbidden,
+	} {
+		require.Equal(t, status, serve("203.0.113.90"), "request %d", i+1)
+	}
+	require.Equal(t, http.StatusOK, serve("203.0.113.91"), "clients are counted separately")
+	for range 5 {
+		require.Equal(t, http.StatusOK, serve("192.0.2.90"), "allowed requests are not strikes")
+	}
+}
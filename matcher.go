@@ -0,0 +1,259 @@
+package caddydefender
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types/ref"
+	"go.uber.org/zap"
+	"pkg.jsn.cam/caddy-defender/matchers/ip"
+)
+
+// MatchDefender matches requests whose client IP falls inside the given ranges, so the
+// Defender ranges can drive standard Caddy directives (e.g. routing scrapers to a decoy
+// backend with `reverse_proxy`) instead of a fixed responder. Ranges take the same entries
+// as the defender handler, including exclusions, range files and URLs, and identical range
+// sets share their compiled table with handlers that have no whitelist, rules or range settings.
+// Clients banned by any defender handler match too, with the "ban" group.
+//
+// On a match, the {http.defender.group} and {http.defender.prefix} placeholders are set.
+//
+// **Caddyfile Syntax:**
+// ```
+//
+//	@ai defender_ranges openai deepseek
+//
+//	@ai defender_ranges openai deepseek {
+//	    client_ip {
+//	        header CF-Connecting-IP
+//	        trusted_proxies cloudflare
+//	    }
+//	}
+//
+// ```
+//
+// **CEL Syntax:**
+// ```
+//
+//	@ai expression defender_in('openai', 'deepseek')
+//
+// ```
+type MatchDefender struct {
+	ipChecker     *ip.IPChecker
+	log           *zap.Logger
+	rangeTableKey string
+
+	// Ranges specifies the IP ranges to match, using the same entries as the defender handler.
+	// Default: the default ranges of the defender handler
+	Ranges []string `json:"ranges,omitempty"`
+
+	// ClientIP reads the client IP from a header set by trusted proxies, like the defender
+	// handler's client_ip.
+	// Default: nil (Caddy's client_ip, falling back to the remote address)
+	ClientIP *ClientIPConfig `json:"client_ip,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (MatchDefender) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.defender",
+		New: func() caddy.Module { return new(MatchDefender) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	defender_ranges <cidr_or_predefined...> {
+//	    client_ip {
+//	        header <name>
+//	        trusted_proxies <cidr_or_predefined...>
+//	    }
+//	}
+func (m *MatchDefender) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	// iterate to merge multiple matchers into one
+	for d.Next() {
+		m.Ranges = append(m.Ranges, d.RemainingArgs()...)
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "client_ip":
+				if m.ClientIP == nil {
+					m.ClientIP = new(ClientIPConfig)
+				}
+				if err := m.ClientIP.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			default:
+				return d.Errf("unknown subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Provision loads the shared range table for the matcher's ranges.
+func (m *MatchDefender) Provision(ctx caddy.Context) error {
+	m.log = ctx.Logger()
+
+	if len(m.Ranges) == 0 {
+		m.Ranges = DefaultRanges
+	}
+
+	if err := registerMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return fmt.Errorf("registering metrics: %w", err)
+	}
+
+	if m.ClientIP != nil {
+		if err := m.ClientIP.provision(); err != nil {
+			return err
+		}
+	}
+
+	cfg := rangeConfig{Ranges: canonicalEntries(m.Ranges)}
+	key, err := cfg.key()
+	if err != nil {
+		return err
+	}
+	table, err := loadRangeTable(ctx, key, cfg, m.log)
+	if err != nil {
+		return err
+	}
+	m.rangeTableKey = key
+	m.ipChecker = table.checker
+	return nil
+}
+
+// Cleanup releases the shared range table.
+func (m *MatchDefender) Cleanup() error {
+	if m.rangeTableKey == "" {
+		return nil
+	}
+	_, err := rangeTables.Delete(m.rangeTableKey)
+	m.rangeTableKey = ""
+	return err
+}
+
+// Validate ensures the matcher's ranges and client IP config are valid.
+func (m *MatchDefender) Validate() error {
+	if m.ClientIP != nil {
+		if err := m.ClientIP.validate(); err != nil {
+			return err
+		}
+	}
+	return validateRanges(m.Ranges)
+}
+
+// Match returns true if the request's client IP is inside the ranges.
+func (m MatchDefender) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+	return match
+}
+
+// MatchWithError returns true if the request's client IP is inside the ranges.
+func (m MatchDefender) MatchWithError(r *http.Request) (bool, error) {
+	clientIP, err := m.ClientIP.clientIP(r)
+	if err != nil {
+		m.log.Error("Invalid client IP", zap.String("remote_addr", r.RemoteAddr), zap.Error(err))
+		return false, nil
+	}
+
+	match := m.ipChecker.Lookup(r.Context(), clientIP).Match
+	if match == nil {
+		return false, nil
+	}
+	setMatchPlaceholders(r, match)
+	return true, nil
+}
+
+// CELLibrary produces options that expose this matcher for use in CEL
+// expression matchers.
+//
+// Example:
+//
+//	expression defender_in('openai', 'deepseek')
+func (MatchDefender) CELLibrary(ctx caddy.Context) (cel.Library, error) {
+	return caddyhttp.CELMatcherImpl(
+		"defender_in",
+		"defender_in_match_request_list",
+		[]*cel.Type{cel.ListType(cel.StringType)},
+		func(data ref.Val) (caddyhttp.RequestMatcherWithError, error) {
+			ranges, err := data.ConvertToNative(reflect.TypeFor[[]string]())
+			if err != nil {
+				return nil, err
+			}
+
+			m := MatchDefender{Ranges: ranges.([]string)}
+			if err := m.Validate(); err != nil {
+				return nil, err
+			}
+			if err := m.Provision(ctx); err != nil {
+				return nil, err
+			}
+			// CEL matchers aren't cleaned up like modules, so release the table with the config
+			ctx.OnCancel(func() { _ = m.Cleanup() })
+			return m, nil
+		},
+	)
+}
+
+// MatchDefenderRanges is MatchDefender registered as "defender_ranges", which is the name
+// Caddyfile named matchers use: `@ai defender_ranges openai deepseek`.
+type MatchDefenderRanges MatchDefender
+
+// CaddyModule returns the Caddy module information.
+func (MatchDefenderRanges) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.defender_ranges",
+		New: func() caddy.Module { return new(MatchDefenderRanges) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+func (m *MatchDefenderRanges) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return (*MatchDefender)(m).UnmarshalCaddyfile(d)
+}
+
+// Provision loads the shared range table for the matcher's ranges.
+func (m *MatchDefenderRanges) Provision(ctx caddy.Context) error {
+	return (*MatchDefender)(m).Provision(ctx)
+}
+
+// Cleanup releases the shared range table.
+func (m *MatchDefenderRanges) Cleanup() error {
+	return (*MatchDefender)(m).Cleanup()
+}
+
+// Validate ensures the matcher's ranges and client IP config are valid.
+func (m *MatchDefenderRanges) Validate() error {
+	return (*MatchDefender)(m).Validate()
+}
+
+// Match returns true if the request's client IP is inside the ranges.
+func (m MatchDefenderRanges) Match(r *http.Request) bool {
+	return MatchDefender(m).Match(r)
+}
+
+// MatchWithError returns true if the request's client IP is inside the ranges.
+func (m MatchDefenderRanges) MatchWithError(r *http.Request) (bool, error) {
+	return MatchDefender(m).MatchWithError(r)
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner                 = (*MatchDefender)(nil)
+	_ caddy.CleanerUpper                = (*MatchDefender)(nil)
+	_ caddy.Validator                   = (*MatchDefender)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchDefender)(nil)
+	_ caddyhttp.CELLibraryProducer      = (*MatchDefender)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchDefender)(nil)
+
+	_ caddy.Provisioner                 = (*MatchDefenderRanges)(nil)
+	_ caddy.CleanerUpper                = (*MatchDefenderRanges)(nil)
+	_ caddy.Validator                   = (*MatchDefenderRanges)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchDefenderRanges)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchDefenderRanges)(nil)
+)
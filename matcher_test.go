@@ -0,0 +1,188 @@
+package caddydefender
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/require"
+
+	"pkg.jsn.cam/caddy-defender/bans"
+)
+
+// newMatcherRequest creates a request from clientIP with the context Caddy's HTTP server would provide.
+func newMatcherRequest(clientIP string) (*http.Request, *caddy.Replacer) {
+	repl := caddy.NewReplacer()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = clientIP + ":12345"
+	ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, map[string]any{})
+	return req.WithContext(ctx), repl
+}
+
+func TestMatchDefender_UnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expected    []string
+		clientIP    *ClientIPConfig
+		expectError bool
+	}{
+		{
+			name:     "ranges",
+			input:    `defender_ranges openai deepseek`,
+			expected: []string{"openai", "deepseek"},
+		},
+		{
+			name: "merged matchers",
+			input: `defender_ranges openai
+			defender_ranges !203.0.113.0/24`,
+			expected: []string{"openai", "!203.0.113.0/24"},
+		},
+		{
+			name: "client IP header",
+			input: `defender_ranges openai {
+				client_ip {
+					header CF-Connecting-IP
+					trusted_proxies cloudflare
+				}
+			}`,
+			expected: []string{"openai"},
+			clientIP: &ClientIPConfig{Header: "CF-Connecting-IP", TrustedProxies: []string{"cloudflare"}},
+		},
+		{
+			name: "unknown subdirective is rejected",
+			input: `defender_ranges openai {
+				ranges aws
+			}`,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(MatchDefenderRanges)
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, m.Ranges)
+			require.Equal(t, tt.clientIP, m.ClientIP)
+		})
+	}
+}
+
+func TestMatchDefender_Match(t *testing.T) {
+	m := &MatchDefender{Ranges: []string{"203.0.0.0/16", "!203.0.113.0/24"}}
+	require.NoError(t, m.Validate())
+	require.NoError(t, m.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, m.Cleanup()) }()
+
+	tests := []struct {
+		name     string
+		clientIP string
+		expected bool
+	}{
+		{name: "IP in range", clientIP: "203.0.1.10", expected: true},
+		{name: "IP in excluded subnet", clientIP: "203.0.113.10", expected: false},
+		{name: "IP outside ranges", clientIP: "198.51.100.10", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, repl := newMatcherRequest(tt.clientIP)
+			matched, err := m.MatchWithError(req)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, matched)
+
+			prefix, _ := repl.GetString(placeholderPrefix)
+			if tt.expected {
+				require.Equal(t, "203.0.0.0/16", prefix)
+			} else {
+				require.Empty(t, prefix)
+			}
+		})
+	}
+}
+
+func TestMatchDefender_Bans(t *testing.T) {
+	m := &MatchDefender{Ranges: []string{"203.0.113.0/24"}}
+	require.NoError(t, m.Validate())
+	require.NoError(t, m.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, m.Cleanup()) }()
+
+	ban := bans.Ban{Prefix: netip.MustParsePrefix("198.51.100.10/32")}
+	require.NoError(t, banTable.Add(ban))
+	defer banTable.Remove(ban.Prefix)
+
+	req, repl := newMatcherRequest("198.51.100.10")
+	matched, err := m.MatchWithError(req)
+	require.NoError(t, err)
+	require.True(t, matched)
+	group, _ := repl.GetString(placeholderGroup)
+	require.Equal(t, groupBan, group)
+}
+
+func TestMatchDefender_ClientIP(t *testing.T) {
+	m := &MatchDefender{
+		Ranges:   []string{"203.0.113.0/24"},
+		ClientIP: &ClientIPConfig{Header: "X-Forwarded-For", TrustedProxies: []string{"192.0.2.0/24"}},
+	}
+	require.NoError(t, m.Validate())
+	require.NoError(t, m.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, m.Cleanup()) }()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		expected   bool
+	}{
+		{name: "client behind trusted proxy", remoteAddr: "192.0.2.1", forwarded: "203.0.113.10", expected: true},
+		{name: "trusted proxy without header", remoteAddr: "192.0.2.1", expected: false},
+		{name: "header from untrusted address", remoteAddr: "198.51.100.10", forwarded: "203.0.113.10", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := newMatcherRequest(tt.remoteAddr)
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			matched, err := m.MatchWithError(req)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, matched)
+		})
+	}
+}
+
+func TestMatchDefender_InvalidRange(t *testing.T) {
+	m := &MatchDefender{Ranges: []string{"not-a-range"}}
+	require.ErrorContains(t, m.Validate(), "invalid IP range")
+}
+
+func TestMatchDefender_CEL(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	expr := &caddyhttp.MatchExpression{Expr: "defender_in('192.0.2.0/24', '198.51.100.0/24')"}
+	require.NoError(t, expr.Provision(ctx))
+
+	for clientIP, expected := range map[string]bool{
+		"192.0.2.10":    true,
+		"198.51.100.10": true,
+		"203.0.113.10":  false,
+	} {
+		req, _ := newMatcherRequest(clientIP)
+		matched, err := expr.MatchWithError(req)
+		require.NoError(t, err)
+		require.Equal(t, expected, matched, clientIP)
+	}
+}
@@ -5,147 +5,385 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	Whitelist "pkg.jsn.cam/caddy-defender/matchers/whitelist"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/gaissmai/bart"
 	"github.com/viccon/sturdyc"
 	"go.uber.org/zap"
-	"pkg.jsn.cam/caddy-defender/ranges/data"
+	"pkg.jsn.cam/caddy-defender/bans"
+	"pkg.jsn.cam/caddy-defender/ranges/static"
 )
 
+// ResolveFunc expands a range entry (a predefined key or a CIDR) into the CIDRs it covers.
+type ResolveFunc func(entry string) ([]string, error)
+
+// ExclusionPrefix marks a range entry (e.g. "!203.0.113.0/24" or "!githubcopilot")
+// whose prefixes are carved out of the blocked ranges.
+const ExclusionPrefix = "!"
+
+// ParseEntry splits a range entry into its predefined key or CIDR and whether it is an exclusion.
+func ParseEntry(entry string) (name string, excluded bool) {
+	if name, ok := strings.CutPrefix(entry, ExclusionPrefix); ok {
+		return name, true
+	}
+	return entry, false
+}
+
+// BanGroup is the group reported for addresses blocked by a ban.
+const BanGroup = "ban"
+
+// Match describes the blocked prefix an address fell into.
+type Match struct {
+	// Groups lists the range entries (predefined keys or CIDRs) that contributed Prefix.
+	Groups []string
+	// Prefix is the most specific prefix containing the address.
+	Prefix netip.Prefix
+	// Rule is the index of the range list Prefix was blocked by, for checkers built with
+	// several lists (see NewIPCheckerWithRules).
+	Rule int
+	// Excluded reports whether Prefix was carved out of the blocked ranges by an exclusion entry.
+	Excluded bool
+}
+
+// Result is the outcome of checking a client IP against the whitelist and blocked ranges.
+type Result struct {
+	// Match is the blocked range the IP belongs to, or nil if it is in none.
+	Match *Match
+	// Allowed reports whether the request should be let through.
+	Allowed bool
+	// Whitelisted reports whether the IP was allowed by the whitelist.
+	Whitelisted bool
+	// Ban is the active ban of the IP, or nil if it isn't banned.
+	Ban *bans.Ban
+}
+
+// CacheConfig controls the cache of lookup results kept in front of the range table.
+type CacheConfig struct {
+	// Disabled turns the cache off, so every request is looked up in the range table directly.
+	// Default: false
+	Disabled bool `json:"disabled,omitempty"`
+
+	// Capacity is the maximum number of cached addresses.
+	// Default: 10000
+	Capacity int `json:"capacity,omitempty"`
+
+	// Shards is the number of shards the cache is split into to reduce lock contention.
+	// Default: 10
+	Shards int `json:"shards,omitempty"`
+
+	// TTL is how long a lookup result is cached.
+	// Default: 10m
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// DisableEarlyRefreshes stops entries from being refreshed in the background before they expire.
+	// Default: false
+	DisableEarlyRefreshes bool `json:"disable_early_refreshes,omitempty"`
+}
+
+// Options configures how an IPChecker resolves its ranges and caches lookups.
+type Options struct {
+	// Resolve expands range entries. Default: static.Resolve
+	Resolve ResolveFunc
+	// Cache configures the lookup cache.
+	Cache CacheConfig
+	// Metrics receives the lookup cache's hit, miss and eviction events, if set.
+	Metrics sturdyc.MetricsRecorder
+	// Bans are consulted before the blocked ranges, if set.
+	Bans *bans.Table
+	// Allows are runtime whitelist entries consulted along with the whitelist, if set.
+	Allows *bans.Table
+}
+
+// rangeTable is a compiled range table. Lookups are cached under its generation, so those
+// made against a replaced table, even ones still in flight, are never served for a newer one.
+type rangeTable struct {
+	table      *bart.Table[*Match]
+	generation uint64
+}
+
 type IPChecker struct {
-	table     *bart.Table[struct{}]
-	cache     *sturdyc.Client[string]
-	whitelist *Whitelist.Whitelist
-	log       *zap.Logger
+	table          atomic.Pointer[rangeTable]
+	generation     atomic.Uint64
+	whitelist      atomic.Pointer[Whitelist.Whitelist]
+	cache          *sturdyc.Client[*Match] // nil if the cache is disabled
+	bans           *bans.Table             // nil if bans aren't consulted
+	allows         *bans.Table             // nil if runtime whitelist entries aren't consulted
+	log            *zap.Logger
+	rules          [][]string
+	whitelistRules []string
 }
 
 func NewIPChecker(cidrRanges, whitelistedIPs []string, log *zap.Logger) *IPChecker {
+	return NewIPCheckerWithOptions(cidrRanges, whitelistedIPs, Options{}, log)
+}
+
+// NewIPCheckerWithOptions creates an IPChecker configured by opts.
+func NewIPCheckerWithOptions(cidrRanges, whitelistedIPs []string, opts Options, log *zap.Logger) *IPChecker {
+	return NewIPCheckerWithRules([][]string{cidrRanges}, whitelistedIPs, opts, log)
+}
+
+// NewIPCheckerWithRules creates an IPChecker blocking the ranges of several lists, compiled into
+// one table. Each list decides on its own which addresses it blocks, and an address blocked by
+// several lists is reported as blocked by the first of them (see Match.Rule).
+func NewIPCheckerWithRules(rules [][]string, whitelistedIPs []string, opts Options, log *zap.Logger) *IPChecker {
+	if opts.Resolve == nil {
+		opts.Resolve = static.Resolve
+	}
+
+	checker := &IPChecker{
+		log:            log,
+		rules:          rules,
+		whitelistRules: whitelistedIPs,
+		bans:           opts.Bans,
+		allows:         opts.Allows,
+	}
+	if !opts.Cache.Disabled {
+		checker.cache = newCache(opts.Cache, opts.Metrics)
+	}
+	checker.table.Store(&rangeTable{table: buildTable(rules, opts.Resolve, log)})
+	checker.whitelist.Store(buildWhitelist(whitelistedIPs, opts.Resolve, log))
+	return checker
+}
+
+// newCache creates the lookup cache, applying defaults for unset options.
+func newCache(cfg CacheConfig, metrics sturdyc.MetricsRecorder) *sturdyc.Client[*Match] {
 	const (
-		capacity        = 10000
-		numShards       = 10
-		ttl             = 10 * time.Minute
-		evictionPercent = 10
-		minRefreshDelay = 100 * time.Millisecond
-		maxRefreshDelay = 300 * time.Millisecond
-		retryBaseDelay  = 10 * time.Millisecond
+		defaultCapacity  = 10000
+		defaultNumShards = 10
+		defaultTTL       = 10 * time.Minute
+		evictionPercent  = 10
+		minRefreshDelay  = 100 * time.Millisecond
+		maxRefreshDelay  = 300 * time.Millisecond
+		retryBaseDelay   = 10 * time.Millisecond
 	)
 
-	whitelist, err := Whitelist.Initialize(whitelistedIPs)
-	if err != nil {
-		log.Warn("Invalid whitelist IP",
-			zap.Strings("whitelist", whitelistedIPs),
-			zap.Error(err))
+	capacity, numShards, ttl := cfg.Capacity, cfg.Shards, time.Duration(cfg.TTL)
+	if capacity <= 0 {
+		capacity = defaultCapacity
+	}
+	if numShards <= 0 {
+		numShards = defaultNumShards
+	}
+	if ttl <= 0 {
+		ttl = defaultTTL
 	}
 
-	cache := sturdyc.New[string](
-		capacity,
-		numShards,
-		ttl,
-		evictionPercent,
-		sturdyc.WithEarlyRefreshes(
+	opts := []sturdyc.Option{sturdyc.WithMissingRecordStorage()}
+	if !cfg.DisableEarlyRefreshes {
+		opts = append(opts, sturdyc.WithEarlyRefreshes(
 			minRefreshDelay,
 			maxRefreshDelay,
 			ttl,
 			retryBaseDelay,
-		),
-		sturdyc.WithMissingRecordStorage(),
-	)
-
-	return &IPChecker{
-		table:     buildTable(cidrRanges, log),
-		cache:     cache,
-		log:       log,
-		whitelist: whitelist,
+		))
+	}
+	if metrics != nil {
+		opts = append(opts, sturdyc.WithMetrics(metrics))
 	}
+
+	return sturdyc.New[*Match](capacity, numShards, ttl, evictionPercent, opts...)
+}
+
+// Rebuild resolves the checker's ranges and whitelist again and atomically replaces them.
+// The new table starts a new generation of cached lookups, so subsequent requests see it,
+// while those cached for the old one are left to expire.
+// It is safe to call concurrently with ReqAllowed.
+func (c *IPChecker) Rebuild(resolve ResolveFunc) {
+	table := &rangeTable{table: buildTable(c.rules, resolve, c.log), generation: c.generation.Add(1)}
+	c.table.Store(table)
+	c.whitelist.Store(buildWhitelist(c.whitelistRules, resolve, c.log))
+}
+
+// Len returns the number of prefixes in the range table.
+func (c *IPChecker) Len() int {
+	return c.table.Load().table.Size()
 }
 
 func (c *IPChecker) ReqAllowed(ctx context.Context, clientIP net.IP) bool {
+	return c.Lookup(ctx, clientIP).Allowed
+}
+
+// Lookup checks the client IP against the whitelist, the runtime whitelist entries, the bans
+// and the blocked ranges, in that order, and reports which range or ban, if any, it matched.
+func (c *IPChecker) Lookup(ctx context.Context, clientIP net.IP) Result {
 	// convert net.IP to netip.Addr
 	ipAddr, err := ipToAddr(clientIP)
 	if err != nil {
 		c.log.Warn("Invalid IP address format",
 			zap.String("ip", clientIP.String()),
 			zap.Error(err))
-		return false
+		return Result{}
 	}
 
 	// Check if the IP is whitelisted
-	if ok, _ := c.whitelist.Matches(ipAddr); ok {
+	if ok, _ := c.whitelist.Load().Matches(ipAddr); ok {
 		c.log.Debug("IP is whitelisted", zap.String("ip", clientIP.String()))
-		return true
+		return Result{Allowed: true, Whitelisted: true}
+	}
+	if c.allows != nil {
+		if _, ok := c.allows.Lookup(ipAddr); ok {
+			c.log.Debug("IP is whitelisted at runtime", zap.String("ip", clientIP.String()))
+			return Result{Allowed: true, Whitelisted: true}
+		}
+	}
+	// Bans change at runtime, so they are checked before the cached range lookups
+	if c.bans != nil {
+		if ban, ok := c.bans.Lookup(ipAddr); ok {
+			return Result{Match: &Match{Groups: []string{BanGroup}, Prefix: ban.Prefix}, Ban: &ban}
+		}
 	}
 	// Check if the IP is in the blocked ranges
-	return !c.IPInRanges(ctx, ipAddr)
+	match := c.MatchRanges(ctx, ipAddr)
+	return Result{Match: match, Allowed: match == nil}
 }
 
 func (c *IPChecker) IPInRanges(ctx context.Context, ipAddr netip.Addr) bool {
-	// Convert to netip.Addr first to handle IPv4-mapped IPv6 addresses
-	// Use the normalized string representation for cache keys
-	cacheKey := ipAddr.String()
+	return c.MatchRanges(ctx, ipAddr) != nil
+}
+
+// MatchRanges returns the blocked range containing ipAddr, or nil if there is none.
+func (c *IPChecker) MatchRanges(ctx context.Context, ipAddr netip.Addr) *Match {
+	// Normalize IPv4-mapped IPv6 addresses to pure IPv4, matching how prefixes are stored
+	ipAddr = ipAddr.Unmap()
+	table := c.table.Load()
 
-	result, _ := c.cache.GetOrFetch(ctx, cacheKey, func(ctx context.Context) (string, error) {
-		if c.table.Contains(ipAddr) {
-			return "true", nil
+	if c.cache == nil {
+		return table.lookup(ipAddr)
+	}
+	result, _ := c.cache.GetOrFetch(ctx, table.cacheKey(ipAddr), func(ctx context.Context) (*Match, error) {
+		if match := table.lookup(ipAddr); match != nil {
+			return match, nil
 		}
-		return "false", sturdyc.ErrNotFound
+		return nil, sturdyc.ErrNotFound
 	})
 
-	return result == "true"
+	return result
+}
+
+// cacheKey returns the key of the cached lookup of ipAddr against the table, which is the
+// normalized string representation of ipAddr scoped to the table's generation.
+func (t *rangeTable) cacheKey(ipAddr netip.Addr) string {
+	return strconv.FormatUint(t.generation, 10) + "/" + ipAddr.String()
 }
 
-func buildTable(cidrRanges []string, log *zap.Logger) *bart.Table[struct{}] {
-	table := &bart.Table[struct{}]{}
-	for _, cidr := range cidrRanges {
-		if ranges, ok := data.IPRanges[cidr]; ok {
-			for _, predefinedCIDR := range ranges {
-				if err := insertCIDR(table, predefinedCIDR); err != nil {
-					log.Warn("Invalid predefined CIDR",
-						zap.String("group", cidr),
-						zap.String("cidr", predefinedCIDR),
-						zap.Error(err))
-				}
+// lookup returns the blocked range containing ipAddr, bypassing the cache.
+func (t *rangeTable) lookup(ipAddr netip.Addr) *Match {
+	// The longest matching prefix decides, so an exclusion nested inside a
+	// blocked range allows the address and vice versa.
+	if match, ok := t.table.Lookup(ipAddr); ok && !match.Excluded {
+		return match
+	}
+	return nil
+}
+
+// buildWhitelist builds the whitelist, leaving it empty if any entry is invalid.
+func buildWhitelist(entries []string, resolve ResolveFunc, log *zap.Logger) *Whitelist.Whitelist {
+	whitelist, err := Whitelist.New(entries, resolve)
+	if err != nil {
+		log.Warn("Invalid whitelist entry",
+			zap.Strings("whitelist", entries),
+			zap.Error(err))
+	}
+	return whitelist
+}
+
+// buildTable compiles the range lists into one table, whose value for each prefix is the
+// Match of the first list blocking it.
+func buildTable(rules [][]string, resolve ResolveFunc, log *zap.Logger) *bart.Table[*Match] {
+	tables := make([]*bart.Table[*Match], len(rules))
+	for i, cidrRanges := range rules {
+		tables[i] = buildRuleTable(i, cidrRanges, resolve, log)
+	}
+	if len(tables) == 1 {
+		return tables[0]
+	}
+
+	merged := &bart.Table[*Match]{}
+	for _, table := range tables {
+		for prefix := range table.All() {
+			if _, ok := merged.Get(prefix); !ok {
+				merged.Insert(prefix, firstMatch(tables, prefix))
 			}
-			continue
 		}
+	}
+	return merged
+}
+
+// firstMatch returns the Match of the first table blocking prefix, or an excluded Match if
+// none does. A table decides by its most specific prefix containing prefix, which may be a
+// less specific one than prefix itself.
+func firstMatch(tables []*bart.Table[*Match], prefix netip.Prefix) *Match {
+	for _, table := range tables {
+		if _, match, ok := table.LookupPrefixLPM(prefix); ok && !match.Excluded {
+			return match
+		}
+	}
+	return &Match{Prefix: prefix, Excluded: true}
+}
 
-		if err := insertCIDR(table, cidr); err != nil {
-			log.Warn("Invalid CIDR specification",
-				zap.String("cidr", cidr),
+// buildRuleTable compiles the range list with the given index.
+func buildRuleTable(rule int, cidrRanges []string, resolve ResolveFunc, log *zap.Logger) *bart.Table[*Match] {
+	table := &bart.Table[*Match]{}
+	for _, entry := range cidrRanges {
+		cidr, excluded := ParseEntry(entry)
+		ranges, err := resolve(cidr)
+		if err != nil {
+			log.Warn("Failed to resolve range",
+				zap.String("range", entry),
 				zap.Error(err))
+			continue
+		}
+
+		for _, resolved := range ranges {
+			if err := insertCIDR(table, rule, cidr, resolved, excluded); err != nil {
+				log.Warn("Invalid CIDR specification",
+					zap.String("range", cidr),
+					zap.String("cidr", resolved),
+					zap.Error(err))
+			}
 		}
 	}
 	return table
 }
 
-func insertCIDR(table *bart.Table[struct{}], cidr string) error {
+// insertCIDR adds cidr to the table of rule, recording group as one of its origins.
+func insertCIDR(table *bart.Table[*Match], rule int, group, cidr string, excluded bool) error {
 	prefix, err := netip.ParsePrefix(cidr)
 	if err != nil {
 		return fmt.Errorf("invalid CIDR: %w", err)
 	}
+	prefix = prefix.Masked()
 
-	// Always insert the original CIDR
-	table.Insert(prefix.Masked(), struct{}{})
-
-	// If IPv4 CIDR, also insert as IPv4-mapped IPv6
-	if prefix.Addr().Is4() {
-		ipv4 := prefix.Addr().As4()
-		ipv6Bytes := [16]byte{
-			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff,
-			ipv4[0], ipv4[1], ipv4[2], ipv4[3],
-		}
-		ipv6Prefix := netip.PrefixFrom(
-			netip.AddrFrom16(ipv6Bytes),
-			96+prefix.Bits(), // Convert IPv4 prefix to IPv4-mapped IPv6
-		)
-		table.Insert(ipv6Prefix.Masked(), struct{}{})
+	// Lookups unmap IPv4-mapped IPv6 addresses, so store such prefixes as plain IPv4
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
 	}
 
+	insertMatch(table, rule, prefix, group, excluded)
 	return nil
 }
 
+// insertMatch stores a Match for prefix, merging group into an existing entry for the same prefix.
+// Exclusions take precedence over blocks of the exact same prefix.
+func insertMatch(table *bart.Table[*Match], rule int, prefix netip.Prefix, group string, excluded bool) {
+	table.Modify(prefix, func(existing *Match, ok bool) (*Match, bool) {
+		if !ok || (excluded && !existing.Excluded) {
+			return &Match{Groups: []string{group}, Prefix: prefix, Rule: rule, Excluded: excluded}, false
+		}
+		if existing.Excluded == excluded && !slices.Contains(existing.Groups, group) {
+			existing.Groups = append(existing.Groups, group)
+		}
+		return existing, false
+	})
+}
+
 func ipToAddr(ip net.IP) (netip.Addr, error) {
 	if ip == nil {
 		return netip.Addr{}, fmt.Errorf("ip is nil")
@@ -3,14 +3,20 @@ package ip
 
 import (
 	"context"
+	"errors"
 	"net"
+	"net/netip"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"go.uber.org/zap/zapcore"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/stretchr/testify/assert"
+	"github.com/viccon/sturdyc"
 	"go.uber.org/zap"
+	"pkg.jsn.cam/caddy-defender/bans"
 	"pkg.jsn.cam/caddy-defender/ranges/data"
 )
 
@@ -115,7 +121,9 @@ func TestIPInRangesCache(t *testing.T) {
 
 func TestIPInRangesCacheExpiration(t *testing.T) {
 	// Create a new IPChecker with a short cache TTL for testing
-	checker := NewIPChecker(validCIDRs, []string{}, testLogger)
+	checker := NewIPCheckerWithOptions(validCIDRs, []string{}, Options{
+		Cache: CacheConfig{TTL: caddy.Duration(50 * time.Millisecond), DisableEarlyRefreshes: true},
+	}, testLogger)
 
 	// Test IP
 	clientIP := net.ParseIP("192.168.1.100")
@@ -135,6 +143,53 @@ func TestIPInRangesCacheExpiration(t *testing.T) {
 	assert.True(t, result, "Expected IP to be in range (second call, cache expired)")
 }
 
+// countingRecorder counts the cache events reported by sturdyc.
+type countingRecorder struct {
+	hits, misses atomic.Int64
+}
+
+func (r *countingRecorder) CacheHit()                   { r.hits.Add(1) }
+func (r *countingRecorder) CacheMiss()                  { r.misses.Add(1) }
+func (r *countingRecorder) AsynchronousRefresh()        {}
+func (r *countingRecorder) SynchronousRefresh()         {}
+func (r *countingRecorder) MissingRecord()              {}
+func (r *countingRecorder) ForcedEviction()             {}
+func (r *countingRecorder) EntriesEvicted(int)          {}
+func (r *countingRecorder) ShardIndex(int)              {}
+func (r *countingRecorder) CacheBatchRefreshSize(int)   {}
+func (r *countingRecorder) ObserveCacheSize(func() int) {}
+
+func TestIPInRangesCacheMetrics(t *testing.T) {
+	recorder := &countingRecorder{}
+	checker := NewIPCheckerWithOptions(validCIDRs, []string{}, Options{Metrics: recorder}, testLogger)
+
+	blocked := netip.MustParseAddr("192.168.1.100")
+	allowed := netip.MustParseAddr("192.168.2.100")
+	for range 3 {
+		assert.True(t, checker.IPInRanges(context.Background(), blocked))
+		assert.False(t, checker.IPInRanges(context.Background(), allowed))
+	}
+
+	// Misses are cached as well, so only the first lookup of each address reaches the table
+	assert.Equal(t, int64(2), recorder.misses.Load())
+	assert.Equal(t, int64(4), recorder.hits.Load())
+}
+
+func TestIPInRangesCacheDisabled(t *testing.T) {
+	checker := NewIPCheckerWithOptions([]string{"group"}, []string{}, Options{
+		Cache: CacheConfig{Disabled: true},
+	}, testLogger)
+	addr := netip.MustParseAddr("198.51.100.10")
+
+	assert.Nil(t, checker.cache)
+	assert.False(t, checker.IPInRanges(context.Background(), addr))
+
+	checker.Rebuild(func(entry string) ([]string, error) {
+		return []string{"198.51.100.0/24"}, nil
+	})
+	assert.True(t, checker.IPInRanges(context.Background(), addr))
+}
+
 func TestIPInRangesInvalidCIDR(t *testing.T) {
 	// Create a new IPChecker with invalid CIDRs
 	checker := NewIPChecker(invalidCIDRs, []string{}, testLogger)
@@ -246,3 +301,262 @@ func TestPredefinedCIDRGroups(t *testing.T) {
 		})
 	}
 }
+
+func TestRebuild(t *testing.T) {
+	checker := NewIPChecker([]string{"group"}, []string{}, testLogger)
+	addr := netip.MustParseAddr("198.51.100.10")
+
+	// Unknown group, nothing is blocked and the miss gets cached
+	assert.False(t, checker.IPInRanges(context.Background(), addr))
+
+	checker.Rebuild(func(entry string) ([]string, error) {
+		return []string{"198.51.100.0/24"}, nil
+	})
+	assert.True(t, checker.IPInRanges(context.Background(), addr), "Expected cached result to be invalidated")
+
+	checker.Rebuild(func(entry string) ([]string, error) {
+		return nil, errors.New("resolve failed")
+	})
+	assert.False(t, checker.IPInRanges(context.Background(), addr))
+}
+
+func TestRebuildIgnoresStaleLookups(t *testing.T) {
+	checker := NewIPChecker([]string{"group"}, []string{}, testLogger)
+	addr := netip.MustParseAddr("198.51.100.10")
+	stale := checker.table.Load()
+
+	checker.Rebuild(func(entry string) ([]string, error) {
+		return []string{"198.51.100.0/24"}, nil
+	})
+	// A lookup against the old table finishing after the rebuild caches its miss for that table only
+	_, _ = checker.cache.GetOrFetch(context.Background(), stale.cacheKey(addr), func(context.Context) (*Match, error) {
+		return stale.lookup(addr), sturdyc.ErrNotFound
+	})
+	assert.True(t, checker.IPInRanges(context.Background(), addr))
+}
+
+func TestLookup(t *testing.T) {
+	originalIPRanges := data.IPRanges
+	defer func() { data.IPRanges = originalIPRanges }()
+	data.IPRanges = map[string][]string{
+		"cloud":   {"203.0.0.0/16", "2001:db8::/32"},
+		"crawler": {"203.0.113.0/24"},
+		"partner": {"203.0.113.0/24"},
+	}
+
+	checker := NewIPChecker([]string{"cloud", "crawler", "partner", "198.51.100.0/24"}, []string{"203.0.113.7"}, testLogger)
+
+	tests := []struct {
+		name          string
+		ip            string
+		prefix        string
+		groups        []string
+		allowed       bool
+		whitelisted   bool
+		expectedMatch bool
+	}{
+		{
+			name:          "most specific prefix wins",
+			ip:            "203.0.113.10",
+			prefix:        "203.0.113.0/24",
+			groups:        []string{"crawler", "partner"},
+			expectedMatch: true,
+		},
+		{
+			name:          "broader group prefix",
+			ip:            "203.0.1.1",
+			prefix:        "203.0.0.0/16",
+			groups:        []string{"cloud"},
+			expectedMatch: true,
+		},
+		{
+			name:          "custom CIDR",
+			ip:            "198.51.100.1",
+			prefix:        "198.51.100.0/24",
+			groups:        []string{"198.51.100.0/24"},
+			expectedMatch: true,
+		},
+		{
+			name:          "IPv6 group",
+			ip:            "2001:db8::1",
+			prefix:        "2001:db8::/32",
+			groups:        []string{"cloud"},
+			expectedMatch: true,
+		},
+		{
+			name:        "whitelisted",
+			ip:          "203.0.113.7",
+			allowed:     true,
+			whitelisted: true,
+		},
+		{
+			name:    "not in any range",
+			ip:      "192.0.2.1",
+			allowed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := checker.Lookup(context.Background(), net.ParseIP(tt.ip))
+			assert.Equal(t, tt.allowed, result.Allowed)
+			assert.Equal(t, tt.whitelisted, result.Whitelisted)
+			if !tt.expectedMatch {
+				assert.Nil(t, result.Match)
+				return
+			}
+			if assert.NotNil(t, result.Match) {
+				assert.Equal(t, netip.MustParsePrefix(tt.prefix), result.Match.Prefix)
+				assert.ElementsMatch(t, tt.groups, result.Match.Groups)
+			}
+		})
+	}
+}
+
+func TestLookupBans(t *testing.T) {
+	banned, allowed := bans.New(), bans.New()
+	for _, prefix := range []string{"203.0.113.7/32", "198.51.100.0/24"} {
+		assert.NoError(t, banned.Add(bans.Ban{Prefix: netip.MustParsePrefix(prefix), Reason: "test"}))
+	}
+	assert.NoError(t, allowed.Add(bans.Ban{Prefix: netip.MustParsePrefix("198.51.100.9/32")}))
+
+	checker := NewIPCheckerWithOptions([]string{"203.0.113.0/24"}, []string{"203.0.113.7"},
+		Options{Cache: true, Bans: banned, Allows: allowed}, testLogger)
+	ctx := context.Background()
+
+	// The configured whitelist wins over bans.
+	result := checker.Lookup(ctx, net.ParseIP("203.0.113.7"))
+	assert.True(t, result.Whitelisted)
+	assert.Nil(t, result.Ban)
+
+	// Runtime allows win over bans too.
+	result = checker.Lookup(ctx, net.ParseIP("198.51.100.9"))
+	assert.True(t, result.Allowed)
+	assert.Nil(t, result.Ban)
+
+	result = checker.Lookup(ctx, net.ParseIP("198.51.100.10"))
+	if assert.NotNil(t, result.Ban) && assert.NotNil(t, result.Match) {
+		assert.Equal(t, []string{BanGroup}, result.Match.Groups)
+		assert.Equal(t, netip.MustParsePrefix("198.51.100.0/24"), result.Match.Prefix)
+		assert.Equal(t, "test", result.Ban.Reason)
+	}
+
+	// Bans are checked before cached range results.
+	result = checker.Lookup(ctx, net.ParseIP("203.0.113.10"))
+	assert.Nil(t, result.Ban)
+	assert.NoError(t, banned.Add(bans.Ban{Prefix: netip.MustParsePrefix("203.0.113.10/32")}))
+	result = checker.Lookup(ctx, net.ParseIP("203.0.113.10"))
+	if assert.NotNil(t, result.Match) {
+		assert.Equal(t, []string{BanGroup}, result.Match.Groups)
+	}
+}
+
+func TestExclusions(t *testing.T) {
+	originalIPRanges := data.IPRanges
+	defer func() { data.IPRanges = originalIPRanges }()
+	data.IPRanges = map[string][]string{
+		"cloud":   {"203.0.0.0/16", "2001:db8::/32"},
+		"partner": {"203.0.113.0/24", "2001:db8:1::/48"},
+	}
+
+	checker := NewIPChecker([]string{
+		"cloud",
+		"!partner",
+		"!203.0.1.0/24",
+		"203.0.1.128/25",
+		"198.51.100.0/24",
+		"!198.51.100.0/24",
+	}, []string{}, testLogger)
+
+	tests := []struct {
+		name     string
+		ip       string
+		expected bool
+	}{
+		{name: "blocked group", ip: "203.0.2.1", expected: true},
+		{name: "excluded predefined group", ip: "203.0.113.10", expected: false},
+		{name: "excluded predefined group (IPv6)", ip: "2001:db8:1::1", expected: false},
+		{name: "blocked group outside exclusion (IPv6)", ip: "2001:db8:2::1", expected: true},
+		{name: "excluded CIDR", ip: "203.0.1.1", expected: false},
+		{name: "block nested inside exclusion", ip: "203.0.1.200", expected: true},
+		{name: "exclusion wins on identical prefix", ip: "198.51.100.1", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipAddr, err := ipToAddr(net.ParseIP(tt.ip))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, checker.IPInRanges(context.Background(), ipAddr))
+		})
+	}
+}
+
+func TestRules(t *testing.T) {
+	originalIPRanges := data.IPRanges
+	defer func() { data.IPRanges = originalIPRanges }()
+	data.IPRanges = map[string][]string{
+		"cloud": {"203.0.0.0/16", "2001:db8::/32"},
+		"vpn":   {"203.0.113.0/24", "198.51.100.0/24"},
+	}
+
+	checker := NewIPCheckerWithRules([][]string{
+		{"cloud", "!203.0.1.0/24"},
+		{"vpn"},
+		{"203.0.1.0/24", "!203.0.1.128/25"},
+	}, []string{}, Options{Cache: CacheConfig{Disabled: true}}, testLogger)
+
+	tests := []struct {
+		name   string
+		ip     string
+		groups []string
+		rule   int
+	}{
+		{name: "first rule", ip: "203.0.2.1", groups: []string{"cloud"}, rule: 0},
+		{name: "first rule over a more specific prefix", ip: "203.0.113.10", groups: []string{"cloud"}, rule: 0},
+		{name: "second rule", ip: "198.51.100.1", groups: []string{"vpn"}, rule: 1},
+		{name: "excluded from the first rule", ip: "203.0.1.1", groups: []string{"203.0.1.0/24"}, rule: 2},
+		{name: "excluded from every rule", ip: "203.0.1.200", rule: -1},
+		{name: "first rule (IPv6)", ip: "2001:db8::1", groups: []string{"cloud"}, rule: 0},
+		{name: "no rule", ip: "192.0.2.1", rule: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipAddr, err := ipToAddr(net.ParseIP(tt.ip))
+			assert.NoError(t, err)
+			match := checker.MatchRanges(context.Background(), ipAddr)
+			if tt.rule < 0 {
+				assert.Nil(t, match)
+				return
+			}
+			if assert.NotNil(t, match) {
+				assert.Equal(t, tt.rule, match.Rule)
+				assert.Equal(t, tt.groups, match.Groups)
+			}
+		})
+	}
+}
+
+func TestIPv4MappedRanges(t *testing.T) {
+	checker := NewIPChecker([]string{"192.168.1.0/24", "::ffff:198.51.100.0/120"}, []string{}, testLogger)
+
+	tests := []struct {
+		name     string
+		ip       string
+		expected bool
+	}{
+		{name: "IPv4-mapped address in IPv4 range", ip: "::ffff:192.168.1.10", expected: true},
+		{name: "IPv4 address in IPv4-mapped range", ip: "198.51.100.10", expected: true},
+		{name: "IPv4-mapped address in IPv4-mapped range", ip: "::ffff:198.51.100.10", expected: true},
+		{name: "IPv4-mapped address outside ranges", ip: "::ffff:192.168.2.10", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, checker.IPInRanges(context.Background(), netip.MustParseAddr(tt.ip)))
+		})
+	}
+
+	// IPv4 prefixes are stored once rather than alongside an IPv4-mapped copy
+	assert.Equal(t, 2, checker.Len())
+}
@@ -0,0 +1,89 @@
+// Package useragent matches User-Agent headers against the bundled catalog of AI crawler
+// tokens and user-provided regular expressions.
+package useragent
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"pkg.jsn.cam/caddy-defender/useragents/data"
+)
+
+// token is a lower-cased crawler token and the catalog key it was selected with.
+type token struct {
+	key   string
+	token string
+}
+
+// pattern is a user-provided regular expression.
+type pattern struct {
+	re    *regexp.Regexp
+	entry string
+}
+
+// Matcher matches User-Agent headers. Catalog keys (e.g. "ai_crawlers" or "openai") match the
+// User-Agent headers containing one of their tokens, ignoring case. Other entries are regular
+// expressions, also matched ignoring case.
+type Matcher struct {
+	tokens   []token
+	patterns []pattern
+}
+
+// Match is a User-Agent matched by a Matcher.
+type Match struct {
+	// Group is the catalog key or regular expression that matched.
+	Group string
+	// Token is the crawler token found in the User-Agent, or the matched text for regular expressions.
+	Token string
+}
+
+// New returns a Matcher for catalog keys and regular expressions.
+func New(entries []string) (*Matcher, error) {
+	m := new(Matcher)
+	for _, entry := range entries {
+		if tokens, ok := data.UserAgents[entry]; ok {
+			for _, t := range tokens {
+				m.tokens = append(m.tokens, token{key: entry, token: strings.ToLower(t)})
+			}
+			continue
+		}
+		re, err := regexp.Compile("(?i)" + entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user agent pattern %q: %w", entry, err)
+		}
+		m.patterns = append(m.patterns, pattern{re: re, entry: entry})
+	}
+	return m, nil
+}
+
+// Validate checks that every entry is a catalog key or a valid regular expression.
+func Validate(entries []string) error {
+	_, err := New(entries)
+	return err
+}
+
+// Match returns the first entry matching userAgent, catalog keys before regular expressions.
+// Requests without a User-Agent never match.
+func (m *Matcher) Match(userAgent string) (Match, bool) {
+	if m == nil || userAgent == "" {
+		return Match{}, false
+	}
+	lower := strings.ToLower(userAgent)
+	for _, t := range m.tokens {
+		if strings.Contains(lower, t.token) {
+			return Match{Group: t.key, Token: t.token}, true
+		}
+	}
+	for _, p := range m.patterns {
+		if found := p.re.FindString(userAgent); found != "" {
+			return Match{Group: p.entry, Token: found}, true
+		}
+	}
+	return Match{}, false
+}
+
+// Len returns the number of tokens and regular expressions matched.
+func (m *Matcher) Len() int {
+	return len(m.tokens) + len(m.patterns)
+}
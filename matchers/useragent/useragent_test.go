@@ -0,0 +1,78 @@
+package useragent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"pkg.jsn.cam/caddy-defender/useragents/data"
+)
+
+func TestMatch(t *testing.T) {
+	matcher, err := New([]string{"openai", "ai_crawlers", `^python-requests/`})
+	require.NoError(t, err)
+	require.Equal(t, len(data.UserAgents["openai"])+len(data.UserAgents["ai_crawlers"])+1, matcher.Len())
+
+	tests := []struct {
+		name      string
+		userAgent string
+		group     string
+		token     string
+	}{
+		{
+			name:      "first key wins",
+			userAgent: "Mozilla/5.0 AppleWebKit/537.36 (KHTML, like Gecko; compatible; GPTBot/1.2; +https://openai.com/gptbot)",
+			group:     "openai",
+			token:     "gptbot",
+		},
+		{
+			name:      "catalog",
+			userAgent: "Mozilla/5.0 AppleWebKit/537.36 (KHTML, like Gecko; compatible; ClaudeBot/1.0; +claudebot@anthropic.com)",
+			group:     "ai_crawlers",
+			token:     "claudebot",
+		},
+		{
+			name:      "case insensitive",
+			userAgent: "ccbot/2.0 (https://commoncrawl.org/faq/)",
+			group:     "ai_crawlers",
+			token:     "ccbot",
+		},
+		{
+			name:      "regular expression",
+			userAgent: "Python-Requests/2.32.3",
+			group:     `^python-requests/`,
+			token:     "Python-Requests/",
+		},
+		{
+			name:      "browser",
+			userAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:138.0) Gecko/20100101 Firefox/138.0",
+		},
+		{
+			name: "no user agent",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, ok := matcher.Match(tt.userAgent)
+			require.Equal(t, tt.group != "", ok)
+			require.Equal(t, tt.group, match.Group)
+			require.Equal(t, tt.token, match.Token)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, Validate([]string{"ai_crawlers", "anthropic", "(?:Scrapy|Nutch)"}))
+	require.ErrorContains(t, Validate([]string{"[unclosed"}), "invalid user agent pattern")
+}
+
+func TestCatalog(t *testing.T) {
+	all := data.UserAgents["ai_crawlers"]
+	require.NotEmpty(t, all)
+	for key, tokens := range data.UserAgents {
+		for _, token := range tokens {
+			require.Contains(t, all, token, "%s token %s missing from ai_crawlers", key, token)
+		}
+	}
+	require.NotContains(t, all, "facebookexternalhit")
+}
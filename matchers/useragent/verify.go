@@ -0,0 +1,94 @@
+package useragent
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"pkg.jsn.cam/caddy-defender/matchers/whitelist"
+	"pkg.jsn.cam/caddy-defender/ranges/data"
+)
+
+// crawler is a crawler whose User-Agent token can be checked against its published ranges.
+type crawler struct {
+	ranges *whitelist.Whitelist
+	name   string
+	token  string
+}
+
+// Verifier checks that clients claiming to be a known crawler in their User-Agent connect
+// from the ranges the crawler's operator publishes.
+type Verifier struct {
+	crawlers []crawler
+}
+
+// Claim is a User-Agent claiming to be a known crawler.
+type Claim struct {
+	// Crawler is the crawler's token, e.g. "GPTBot".
+	Crawler string
+	// Verified reports whether the client IP is in the crawler's ranges.
+	Verified bool
+}
+
+// DefaultCrawlers returns the known crawlers from data.VerifiedCrawlers, mapping each user-agent
+// token to the predefined range key its operator runs it from. Keys without embedded ranges
+// yet are left out, since every client would fail their check.
+func DefaultCrawlers() map[string][]string {
+	crawlers := make(map[string][]string)
+	for _, key := range slices.Sorted(maps.Keys(data.VerifiedCrawlers)) {
+		if len(data.IPRanges[key]) == 0 {
+			continue
+		}
+		for _, token := range data.VerifiedCrawlers[key] {
+			crawlers[token] = append(crawlers[token], key)
+		}
+	}
+	return crawlers
+}
+
+// NewVerifier returns a Verifier for crawlers, which maps user-agent tokens to the predefined
+// range keys and CIDRs the crawler connects from. Tokens are matched ignoring case, and the
+// ranges of tokens differing only in case are combined.
+func NewVerifier(crawlers map[string][]string) (*Verifier, error) {
+	byToken := make(map[string][]string)
+	names := make(map[string]string)
+	for _, name := range slices.Sorted(maps.Keys(crawlers)) {
+		token := strings.ToLower(name)
+		if _, ok := names[token]; !ok {
+			names[token] = name
+		}
+		byToken[token] = append(byToken[token], crawlers[name]...)
+	}
+
+	v := new(Verifier)
+	for _, token := range slices.Sorted(maps.Keys(byToken)) {
+		ranges, err := whitelist.Initialize(byToken[token])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ranges for crawler %s: %w", names[token], err)
+		}
+		v.crawlers = append(v.crawlers, crawler{ranges: ranges, name: names[token], token: token})
+	}
+	return v, nil
+}
+
+// Verify returns the crawler userAgent claims to be, if any, and whether addr is in its ranges.
+// When several tokens appear in userAgent, the longest one is checked.
+func (v *Verifier) Verify(userAgent string, addr netip.Addr) (Claim, bool) {
+	if v == nil || userAgent == "" {
+		return Claim{}, false
+	}
+	lower := strings.ToLower(userAgent)
+	var claimed *crawler
+	for i, c := range v.crawlers {
+		if strings.Contains(lower, c.token) && (claimed == nil || len(c.token) > len(claimed.token)) {
+			claimed = &v.crawlers[i]
+		}
+	}
+	if claimed == nil {
+		return Claim{}, false
+	}
+	verified, _ := claimed.ranges.Matches(addr)
+	return Claim{Crawler: claimed.name, Verified: verified}, true
+}
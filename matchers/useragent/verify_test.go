@@ -0,0 +1,85 @@
+package useragent
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"pkg.jsn.cam/caddy-defender/ranges/data"
+)
+
+func TestDefaultCrawlers(t *testing.T) {
+	crawlers := DefaultCrawlers()
+	require.Equal(t, []string{"openai"}, crawlers["GPTBot"])
+	// robots.txt product tokens are never sent as User-Agents
+	require.NotContains(t, crawlers, "Google-Extended")
+	for token, keys := range crawlers {
+		for _, key := range keys {
+			require.Contains(t, data.IPRanges, key, "crawler %s maps to unknown range key", token)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	verifier, err := NewVerifier(map[string][]string{
+		"Googlebot":       {"66.249.64.0/19"},
+		"googlebot":       {"2001:4860:4801::/48"},
+		"Googlebot-Image": {"192.0.2.0/24"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		userAgent string
+		addr      string
+		crawler   string
+		verified  bool
+	}{
+		{
+			name:      "verified",
+			userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			addr:      "66.249.66.1",
+			crawler:   "Googlebot",
+			verified:  true,
+		},
+		{
+			name:      "ranges of tokens differing in case are combined",
+			userAgent: "Googlebot/2.1",
+			addr:      "2001:4860:4801::1",
+			crawler:   "Googlebot",
+			verified:  true,
+		},
+		{
+			name:      "spoofed",
+			userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			addr:      "198.51.100.1",
+			crawler:   "Googlebot",
+		},
+		{
+			name:      "longest token",
+			userAgent: "Googlebot-Image/1.0",
+			addr:      "192.0.2.1",
+			crawler:   "Googlebot-Image",
+			verified:  true,
+		},
+		{
+			name:      "no claim",
+			userAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:138.0) Gecko/20100101 Firefox/138.0",
+			addr:      "198.51.100.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claim, ok := verifier.Verify(tt.userAgent, netip.MustParseAddr(tt.addr))
+			require.Equal(t, tt.crawler != "", ok)
+			require.Equal(t, tt.crawler, claim.Crawler)
+			require.Equal(t, tt.verified, claim.Verified)
+		})
+	}
+}
+
+func TestNewVerifierInvalidRanges(t *testing.T) {
+	_, err := NewVerifier(map[string][]string{"Googlebot": {"not-a-range"}})
+	require.ErrorContains(t, err, "invalid ranges for crawler Googlebot")
+}
@@ -3,24 +3,42 @@ package whitelist
 import (
 	"fmt"
 	"net/netip"
+
+	"github.com/gaissmai/bart"
+	"pkg.jsn.cam/caddy-defender/ranges/data"
+	"pkg.jsn.cam/caddy-defender/ranges/static"
 )
 
-// Whitelist holds the allowed IP addresses.
+// Whitelist holds the allowed IP addresses and ranges.
 type Whitelist struct {
-	ips map[netip.Addr]struct{} // Use netip.Addr for efficient IP handling
+	table *bart.Lite // Longest-prefix lookup over every whitelisted prefix
+}
+
+// Initialize initializes a new Whitelist from IP addresses, CIDRs and predefined range keys,
+// resolving predefined keys using the embedded data.
+func Initialize(entries []string) (*Whitelist, error) {
+	return New(entries, static.Resolve)
 }
 
-// Initialize initializes a new Whitelist from IP strings.
-func Initialize(ipStrings []string) (*Whitelist, error) {
+// New initializes a new Whitelist from IP addresses, CIDRs and predefined range keys.
+// Each entry is expanded with resolve, which must return entries that are not
+// predefined keys unchanged.
+func New(entries []string, resolve func(entry string) ([]string, error)) (*Whitelist, error) {
 	wl := &Whitelist{
-		ips: make(map[netip.Addr]struct{}),
+		table: &bart.Lite{},
 	}
-	for _, ipStr := range ipStrings {
-		ip, err := netip.ParseAddr(ipStr)
+	for _, entry := range entries {
+		resolved, err := resolve(entry)
 		if err != nil {
-			return nil, fmt.Errorf("invalid IP address: %s", ipStr)
+			return nil, fmt.Errorf("invalid whitelist entry %s: %w", entry, err)
+		}
+		for _, ipOrCIDR := range resolved {
+			prefix, err := parseEntry(ipOrCIDR)
+			if err != nil {
+				return nil, err
+			}
+			wl.insert(prefix)
 		}
-		wl.ips[ip] = struct{}{}
 	}
 
 	return wl, nil
@@ -28,18 +46,42 @@ func Initialize(ipStrings []string) (*Whitelist, error) {
 
 // Matches checks if the remote address is in the whitelist.
 func (wl *Whitelist) Matches(ip netip.Addr) (bool, error) {
-	// Check if the IP is in the whitelist
-	_, ok := wl.ips[ip]
-	return ok, nil
+	if wl == nil {
+		return false, nil
+	}
+	// Check if the IP is covered by any whitelisted prefix
+	return wl.table.Lookup(ip.Unmap()), nil
 }
 
-// Validate checks if a list of IP strings are valid.
-func Validate(ipStrings []string) error {
-	for _, ipStr := range ipStrings {
-		_, err := netip.ParseAddr(ipStr)
-		if err != nil {
-			return fmt.Errorf("invalid IP address: %s", ipStr)
+// Validate checks if a list of IP addresses, CIDRs and predefined range keys are valid.
+func Validate(entries []string) error {
+	for _, entry := range entries {
+		if _, ok := data.IPRanges[entry]; ok {
+			continue
+		}
+		if _, err := parseEntry(entry); err != nil {
+			return err
 		}
 	}
 	return nil
 }
+
+func (wl *Whitelist) insert(prefix netip.Prefix) {
+	// Store IPv4-mapped IPv6 prefixes as plain IPv4, since lookups are unmapped
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	wl.table.Insert(prefix.Masked())
+}
+
+// parseEntry parses a single IP address or CIDR into a prefix.
+func parseEntry(entry string) (netip.Prefix, error) {
+	if ip, err := netip.ParseAddr(entry); err == nil {
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address or CIDR: %s", entry)
+	}
+	return prefix, nil
+}
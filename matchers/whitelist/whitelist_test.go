@@ -4,6 +4,8 @@ package whitelist
 import (
 	"net/netip"
 	"testing"
+
+	"pkg.jsn.cam/caddy-defender/ranges/data"
 )
 
 func TestNewWhitelist(t *testing.T) {
@@ -17,11 +19,21 @@ func TestNewWhitelist(t *testing.T) {
 			ipStrings:   []string{"192.168.1.1", "2001:db8::1"},
 			expectError: false,
 		},
+		{
+			name:        "Valid CIDRs and predefined key",
+			ipStrings:   []string{"10.20.0.0/16", "2001:db8::/48", "private"},
+			expectError: false,
+		},
 		{
 			name:        "Invalid IP",
 			ipStrings:   []string{"invalid-ip"},
 			expectError: true,
 		},
+		{
+			name:        "Invalid CIDR",
+			ipStrings:   []string{"10.20.0.0/33"},
+			expectError: true,
+		},
 		{
 			name:        "Mixed valid and invalid IPs",
 			ipStrings:   []string{"192.168.1.1", "invalid-ip"},
@@ -94,6 +106,65 @@ func TestWhitelisted(t *testing.T) {
 	}
 }
 
+func TestWhitelistedRanges(t *testing.T) {
+	originalIPRanges := data.IPRanges
+	defer func() { data.IPRanges = originalIPRanges }()
+	data.IPRanges = map[string][]string{
+		"partner": {"198.51.100.0/24", "2001:db8:1::/48"},
+	}
+
+	wl, err := Initialize([]string{"10.20.0.0/16", "partner", "::ffff:192.0.2.0/120"})
+	if err != nil {
+		t.Fatalf("Failed to create whitelist: %v", err)
+	}
+
+	tests := []struct {
+		ip       netip.Addr
+		name     string
+		expected bool
+	}{
+		{
+			ip:       netip.MustParseAddr("10.20.30.40"),
+			name:     "IPv4 inside whitelisted CIDR",
+			expected: true,
+		},
+		{
+			ip:       netip.MustParseAddr("10.21.0.1"),
+			name:     "IPv4 outside whitelisted CIDR",
+			expected: false,
+		},
+		{
+			ip:       netip.MustParseAddr("198.51.100.7"),
+			name:     "IPv4 in predefined group",
+			expected: true,
+		},
+		{
+			ip:       netip.MustParseAddr("2001:db8:1::7"),
+			name:     "IPv6 in predefined group",
+			expected: true,
+		},
+		{
+			ip:       netip.MustParseAddr("192.0.2.9"),
+			name:     "IPv4 in IPv4-mapped CIDR",
+			expected: true,
+		},
+		{
+			ip:       netip.MustParseAddr("::ffff:10.20.0.1"),
+			name:     "IPv4-mapped IPv6 address",
+			expected: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, _ := wl.Matches(tt.ip)
+			if result != tt.expected {
+				t.Errorf("Expected %v for IP %v, but got %v", tt.expected, tt.ip, result)
+			}
+		})
+	}
+}
+
 func TestValidateWhitelist(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -105,11 +176,21 @@ func TestValidateWhitelist(t *testing.T) {
 			ipStrings:   []string{"192.168.1.1", "2001:db8::1"},
 			expectError: false,
 		},
+		{
+			name:        "Valid CIDRs and predefined key",
+			ipStrings:   []string{"10.20.0.0/16", "cloudflare"},
+			expectError: false,
+		},
 		{
 			name:        "Invalid IP",
 			ipStrings:   []string{"invalid-ip"},
 			expectError: true,
 		},
+		{
+			name:        "Unknown predefined key",
+			ipStrings:   []string{"not-a-group"},
+			expectError: true,
+		},
 		{
 			name:        "Mixed valid and invalid IPs",
 			ipStrings:   []string{"192.168.1.1", "invalid-ip"},
@@ -0,0 +1,267 @@
+package caddydefender
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"pkg.jsn.cam/caddy-defender/responders"
+)
+
+const (
+	metricsNamespace = "caddy"
+	metricsSubsystem = "defender"
+)
+
+// cacheMetrics counts the events of the lookup caches. Range tables outlive config
+// reloads, so the counters are shared by all of them and registered with the metrics
+// registry of every config that provisions a Defender.
+var cacheMetrics = struct {
+	hits            prometheus.Counter
+	misses          prometheus.Counter
+	evictions       prometheus.Counter
+	forcedEvictions prometheus.Counter
+}{
+	hits: prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "cache_hits_total",
+		Help:      "Number of client IP lookups answered from the lookup cache.",
+	}),
+	misses: prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "cache_misses_total",
+		Help:      "Number of client IP lookups that had to search the range table.",
+	}),
+	evictions: prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "cache_evictions_total",
+		Help:      "Number of entries evicted from the lookup cache.",
+	}),
+	forcedEvictions: prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "cache_forced_evictions_total",
+		Help:      "Number of times the lookup cache was full and had to evict entries early.",
+	}),
+}
+
+// requestMetrics counts the requests checked by Defender handlers, by the server they were
+// received on and, for blocked requests, the matched groups and the responder that handled
+// them (or would have, in monitor mode).
+var requestMetrics = struct {
+	evaluated *prometheus.CounterVec
+	allowed   *prometheus.CounterVec
+	blocked   *prometheus.CounterVec
+	monitored *prometheus.CounterVec
+}{
+	evaluated: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "evaluated_requests_total",
+		Help:      "Number of requests whose client IP was checked against the ranges.",
+	}, []string{"server"}),
+	allowed: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "allowed_requests_total",
+		Help:      "Number of requests passed on because the client IP was whitelisted or not in a blocked range.",
+	}, []string{"server"}),
+	blocked: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "blocked_requests_total",
+		Help:      "Number of requests handed to a responder because the client IP matched a blocked range.",
+	}, []string{"server", "group", "responder"}),
+	monitored: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "monitored_requests_total",
+		Help:      "Number of requests that would have been blocked, but were passed on in monitor mode.",
+	}, []string{"server", "group", "responder"}),
+}
+
+// responderMetrics tracks the responders that keep clients busy.
+var responderMetrics = struct {
+	tarpitConnections prometheus.Gauge
+	tarpitHold        prometheus.Histogram
+	bytes             *prometheus.CounterVec
+}{
+	tarpitConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "tarpit_connections",
+		Help:      "Number of connections currently held open by the tarpit responder.",
+	}),
+	tarpitHold: prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "tarpit_hold_seconds",
+		Help:      "How long the tarpit responder held connections open.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600},
+	}),
+	bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "responder_bytes_total",
+		Help:      "Number of response body bytes streamed by the tarpit and garbage responders.",
+	}, []string{"responder"}),
+}
+
+// refreshMetrics counts the runtime refreshes of predefined and URL ranges, by source.
+var refreshMetrics = struct {
+	successes   *prometheus.CounterVec
+	failures    *prometheus.CounterVec
+	lastSuccess *prometheus.GaugeVec
+}{
+	successes: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "range_refreshes_total",
+		Help:      "Number of successful range refreshes.",
+	}, []string{"source"}),
+	failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "range_refresh_failures_total",
+		Help:      "Number of failed range refreshes.",
+	}, []string{"source"}),
+	lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "range_refresh_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful range refresh.",
+	}, []string{"source"}),
+}
+
+// registerMetrics registers the Defender metrics with registry, which may be nil.
+func registerMetrics(registry *prometheus.Registry) error {
+	if registry == nil {
+		return nil
+	}
+	collectors := []prometheus.Collector{
+		cacheMetrics.hits,
+		cacheMetrics.misses,
+		cacheMetrics.evictions,
+		cacheMetrics.forcedEvictions,
+		requestMetrics.evaluated,
+		requestMetrics.allowed,
+		requestMetrics.blocked,
+		requestMetrics.monitored,
+		responderMetrics.tarpitConnections,
+		responderMetrics.tarpitHold,
+		responderMetrics.bytes,
+		refreshMetrics.successes,
+		refreshMetrics.failures,
+		refreshMetrics.lastSuccess,
+	}
+	for _, c := range collectors {
+		// Every Defender in a config registers the same collectors
+		var alreadyRegistered prometheus.AlreadyRegisteredError
+		if err := registry.Register(c); err != nil && !errors.As(err, &alreadyRegistered) {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordRefresh reports the outcome of refreshing source to refreshMetrics.
+func recordRefresh(source string, err error) {
+	source = refreshSourceLabel(source)
+	if err != nil {
+		refreshMetrics.failures.WithLabelValues(source).Inc()
+		return
+	}
+	refreshMetrics.successes.WithLabelValues(source).Inc()
+	refreshMetrics.lastSuccess.WithLabelValues(source).SetToCurrentTime()
+}
+
+// refreshSourceLabel strips credentials and query strings, which may hold tokens, from URL sources.
+func refreshSourceLabel(source string) string {
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return source
+	}
+	u.User, u.RawQuery, u.Fragment = nil, "", ""
+	return u.String()
+}
+
+// serverName returns the name of the Caddy server that received r.
+func serverName(r *http.Request) string {
+	if srv, ok := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server); ok && srv != nil {
+		return srv.Name()
+	}
+	return ""
+}
+
+// instrumentResponder wraps the responders that stream responses to record their activity.
+func instrumentResponder(name string, responder responders.Responder) responders.Responder {
+	if name != responderTarpit && name != responderGarbage {
+		return responder
+	}
+	return instrumentedResponder{name: name, responder: responder}
+}
+
+// instrumentedResponder records the bytes a responder streams, and for the tarpit,
+// how many connections it holds and for how long.
+type instrumentedResponder struct {
+	responder responders.Responder
+	name      string
+}
+
+func (i instrumentedResponder) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if i.name == responderTarpit {
+		responderMetrics.tarpitConnections.Inc()
+		defer responderMetrics.tarpitConnections.Dec()
+		start := time.Now()
+		defer func() { responderMetrics.tarpitHold.Observe(time.Since(start).Seconds()) }()
+	}
+	cw := &countingResponseWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		bytes:                 responderMetrics.bytes.WithLabelValues(i.name),
+	}
+	return i.responder.ServeHTTP(cw, r, next)
+}
+
+// countingResponseWriter adds the body bytes written to a counter.
+type countingResponseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	bytes prometheus.Counter
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriterWrapper.Write(b)
+	w.bytes.Add(float64(n))
+	return n, err
+}
+
+func (w *countingResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := w.ResponseWriterWrapper.ReadFrom(r)
+	w.bytes.Add(float64(n))
+	return n, err
+}
+
+// Flush flushes the underlying writer, which the tarpit relies on to stream its content.
+func (w *countingResponseWriter) Flush() {
+	_ = http.NewResponseController(w.ResponseWriterWrapper.ResponseWriter).Flush()
+}
+
+// cacheRecorder reports lookup cache events to cacheMetrics.
+type cacheRecorder struct{}
+
+func (cacheRecorder) CacheHit()                   { cacheMetrics.hits.Inc() }
+func (cacheRecorder) CacheMiss()                  { cacheMetrics.misses.Inc() }
+func (cacheRecorder) ForcedEviction()             { cacheMetrics.forcedEvictions.Inc() }
+func (cacheRecorder) EntriesEvicted(n int)        { cacheMetrics.evictions.Add(float64(n)) }
+func (cacheRecorder) AsynchronousRefresh()        {}
+func (cacheRecorder) SynchronousRefresh()         {}
+func (cacheRecorder) MissingRecord()              {}
+func (cacheRecorder) ShardIndex(int)              {}
+func (cacheRecorder) CacheBatchRefreshSize(int)   {}
+func (cacheRecorder) ObserveCacheSize(func() int) {}
@@ -4,67 +4,193 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
+	"strings"
 
 	"go.uber.org/zap"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"pkg.jsn.cam/caddy-defender/matchers/ip"
+	"pkg.jsn.cam/caddy-defender/responders"
 )
 
-// serveIgnore is a helper function to serve a robots.txt file if the ServeIgnore option is enabled.
+const (
+	// placeholderGroup holds the comma-separated range group(s) a request matched.
+	placeholderGroup = "http.defender.group"
+	// placeholderPrefix holds the blocked prefix a request matched.
+	placeholderPrefix = "http.defender.prefix"
+	// placeholderAction holds what the defender did with a request from a blocked range.
+	placeholderAction = "http.defender.action"
+
+	// varAction is the request variable holding the same value as placeholderAction, for use with the vars matcher.
+	varAction = "defender_action"
+
+	// actionBlocked means the request was handed to the responder.
+	actionBlocked = "blocked"
+	// actionMonitored means the request would have been blocked, but was passed on in monitor mode.
+	actionMonitored = "monitored"
+)
+
+// serveIgnore is a helper function to serve robots.txt, ai.txt and llms.txt if the ServeIgnore,
+// Traps or Robots options ask for them, merging robots.txt with the upstream one if configured.
 // It returns true if the request was handled, false otherwise.
-func (m Defender) serveGitignore(w http.ResponseWriter, r *http.Request) bool {
+func (m *Defender) serveGitignore(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) bool {
 	m.log.Debug("ServeIgnore",
 		zap.Bool("serveIgnore", m.ServeIgnore),
 		zap.String("path", r.URL.Path),
 		zap.String("method", r.Method),
 	)
 
-	// Serve robots.txt only if ServeIgnore is enabled, the path is "/robots.txt", and the method is GET.
-	if !m.ServeIgnore || r.URL.Path != "/robots.txt" || r.Method != http.MethodGet {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	switch {
+	case r.URL.Path == robotsPath && m.robotsTxt != "":
+		content := m.robotsTxt
+		if m.Robots != nil && m.Robots.Merge {
+			content = m.mergeUpstreamRobotsTxt(r, next)
+		}
+		writeText(w, content)
+	case r.URL.Path == aiTxtPath && m.Robots != nil && m.Robots.AITxt:
+		writeText(w, aiTxt)
+	case r.URL.Path == llmsTxtPath && m.Robots != nil && m.Robots.LLMsTxt != "":
+		writeText(w, m.Robots.LLMsTxt)
+	default:
 		return false
 	}
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusOK)
-	// Build the robots.txt content to allow specific bots and block others.
-	robotsTxt := `
-User-agent: Googlebot
-Disallow:
-
-User-agent: Bingbot
-Disallow:
-
-User-agent: DuckDuckBot
-Disallow:
-
-User-agent: *
-Disallow: /
-`
-	_, _ = w.Write([]byte(robotsTxt))
 	return true
 }
 
 // ServeHTTP implements the middleware logic.
-func (m Defender) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	if m.serveGitignore(w, r) {
+func (m *Defender) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if m.serveGitignore(w, r, next) {
+		m.recordRobotsFetch(r)
 		return nil
 	}
 
-	clientIP, err := clientIPFromRequest(r)
+	clientIP, err := m.ClientIP.clientIP(r)
 	if err != nil {
 		m.log.Error("Invalid client IP", zap.String("remote_addr", r.RemoteAddr), zap.Error(err))
 		return caddyhttp.Error(http.StatusForbidden, err)
 	}
 	m.log.Debug("Ranges", zap.Strings("ranges", m.Ranges))
 
-	// Check if the client IP should be allowed (considering whitelist and blocked ranges)
-	if m.ipChecker.ReqAllowed(r.Context(), clientIP) {
+	m.applyBanVar(r, clientIP)
+	m.applyTraps(r, clientIP)
+	m.applyRobotsPolicy(r, clientIP)
+
+	// Check if the client IP should be allowed (considering whitelist, bans and blocked ranges)
+	result, spoofed := m.verifyCrawler(r, clientIP, m.ipChecker.Lookup(r.Context(), clientIP))
+	result = m.matchUserAgent(r, result)
+	setMatchPlaceholders(r, result.Match)
+	server := serverName(r)
+	requestMetrics.evaluated.WithLabelValues(server).Inc()
+	if result.Allowed {
+		requestMetrics.allowed.WithLabelValues(server).Inc()
 		m.log.Debug("Request allowed (IP whitelisted or not in blocked ranges)", zap.String("ip", clientIP.String()))
 		// Request is allowed, proceed to the next handler
-		return next.ServeHTTP(w, r)
+		return m.serveNext(w, r, next, clientIP)
+	}
+
+	responderName, responder, strikeCount, ok := m.selectResponder(clientIP, result, spoofed)
+	if !ok {
+		requestMetrics.allowed.WithLabelValues(server).Inc()
+		m.log.Debug("Request allowed (below escalation threshold)",
+			zap.String("ip", clientIP.String()), zap.Int("strikes", strikeCount))
+		return m.serveNext(w, r, next, clientIP)
+	}
+	group := strings.Join(result.Match.Groups, ",")
+	fields := []zap.Field{
+		zap.String("ip", clientIP.String()),
+		zap.Strings("groups", result.Match.Groups),
+		zap.String("responder", responderName),
+	}
+	if result.Match.Prefix.IsValid() {
+		fields = append(fields, zap.Stringer("prefix", result.Match.Prefix))
+	} else {
+		fields = append(fields, zap.String("user_agent", r.UserAgent()))
+	}
+	if result.Ban != nil {
+		fields = append(fields, zap.String("ban_reason", result.Ban.Reason))
+	}
+	if strikeCount > 0 {
+		fields = append(fields, zap.Int("strikes", strikeCount))
+	}
+
+	if m.Mode == modeMonitor {
+		m.log.Info("Request would be blocked (monitor mode)", fields...)
+		setActionPlaceholder(r, actionMonitored)
+		requestMetrics.monitored.WithLabelValues(server, group, responderName).Inc()
+		if m.MonitorHeader != "" {
+			w.Header().Set(m.MonitorHeader, fmt.Sprintf("%s; group=%s", responderName, group))
+		}
+		return m.serveNext(w, r, next, clientIP)
 	}
-	m.log.Debug("Request blocked (IP in blocked ranges and not whitelisted)", zap.String("ip", clientIP.String()))
+
+	m.log.Debug("Request blocked (IP banned or in blocked ranges and not whitelisted)", fields...)
+	setActionPlaceholder(r, actionBlocked)
+	requestMetrics.blocked.WithLabelValues(server, group, responderName).Inc()
 	// Request should be blocked
-	return m.responder.ServeHTTP(w, r, next)
+	addr, _ := netip.AddrFromSlice(clientIP)
+	r = responders.WithMatch(r, responders.Match{ClientIP: addr.Unmap(), Groups: result.Match.Groups})
+	return instrumentResponder(responderName, responder).ServeHTTP(w, r, next)
+}
+
+// selectResponder returns the responder for a request that wasn't allowed, along with the
+// client's strikes if escalation applies. It returns false if escalation lets the client through.
+// Banned clients and spoofed crawlers are never escalated.
+func (m *Defender) selectResponder(
+	clientIP net.IP, result ip.Result, spoofed bool,
+) (string, responders.Responder, int, bool) {
+	switch {
+	case spoofed:
+		name, responder := m.namedResponder(m.VerifyCrawlers.Responder)
+		return name, responder, 0, true
+	case m.strikes != nil && result.Ban == nil:
+		return m.escalate(clientIP)
+	default:
+		name, responder := m.responderFor(result)
+		return name, responder, 0, true
+	}
+}
+
+// matchUserAgent blocks requests allowed by their IP whose User-Agent matches user_agents.
+// Whitelisted clients are never blocked.
+func (m *Defender) matchUserAgent(r *http.Request, result ip.Result) ip.Result {
+	if m.userAgents == nil || !result.Allowed || result.Whitelisted {
+		return result
+	}
+	match, ok := m.userAgents.Match(r.UserAgent())
+	if !ok {
+		return result
+	}
+	return ip.Result{Match: &ip.Match{Groups: []string{match.Group}}}
+}
+
+// setMatchPlaceholders exposes the matched range group(s) and prefix as the
+// {http.defender.group} and {http.defender.prefix} placeholders.
+func setMatchPlaceholders(r *http.Request, match *ip.Match) {
+	if match == nil {
+		return
+	}
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+	repl.Set(placeholderGroup, strings.Join(match.Groups, ","))
+	if match.Prefix.IsValid() {
+		repl.Set(placeholderPrefix, match.Prefix.String())
+	}
+}
+
+// setActionPlaceholder exposes what was done with a request from a blocked range as the
+// {http.defender.action} placeholder and the defender_action variable.
+func setActionPlaceholder(r *http.Request, action string) {
+	caddyhttp.SetVar(r.Context(), varAction, action)
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Set(placeholderAction, action)
+	}
 }
 
 func clientIPFromRequest(r *http.Request) (net.IP, error) {
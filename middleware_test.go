@@ -3,15 +3,32 @@ package caddydefender
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"pkg.jsn.cam/caddy-defender/bans"
+	"pkg.jsn.cam/caddy-defender/matchers/ip"
 	"pkg.jsn.cam/caddy-defender/responders"
+	"pkg.jsn.cam/caddy-defender/responders/challenge"
+	"pkg.jsn.cam/caddy-defender/responders/ratelimit"
 )
 
 // mockHandler is a simple handler that returns 200 OK
@@ -83,6 +100,22 @@ func TestDefenderServeHTTP_WhitelistBehavior(t *testing.T) {
 			expectedStatus: http.StatusOK,
 			description:    "Should handle IPv6 whitelisting correctly",
 		},
+		{
+			name:           "Whitelisted subnet inside blocked range",
+			ranges:         []string{"192.168.0.0/16"},
+			whitelist:      []string{"192.168.1.0/24"},
+			clientIP:       "192.168.1.100",
+			expectedStatus: http.StatusOK,
+			description:    "Should allow IPs in a whitelisted subnet of a blocked range",
+		},
+		{
+			name:           "Neighbouring subnet of whitelisted subnet",
+			ranges:         []string{"192.168.0.0/16"},
+			whitelist:      []string{"192.168.1.0/24"},
+			clientIP:       "192.168.2.100",
+			expectedStatus: http.StatusForbidden,
+			description:    "Should still block IPs outside the whitelisted subnet",
+		},
 		{
 			name:           "Multiple ranges with whitelist",
 			ranges:         []string{"192.168.0.0/16", "10.0.0.0/8"},
@@ -256,3 +289,880 @@ func TestDefenderServeHTTP_UsesCaddyClientIP(t *testing.T) {
 	require.Equal(t, http.StatusForbidden, recorder.Code)
 	require.Equal(t, "Access denied", recorder.Body.String())
 }
+
+func TestDefenderServeHTTP_MatchPlaceholders(t *testing.T) {
+	defender := &Defender{
+		RawResponder: "block",
+		Ranges:       []string{"203.0.113.0/24"},
+		responder:    &responders.BlockResponder{},
+	}
+
+	ctx := caddy.Context{Context: context.Background()}
+	defender.log = zap.NewNop()
+	err := defender.Provision(ctx)
+	require.NoError(t, err)
+
+	repl := caddy.NewReplacer()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.10:12345"
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+	recorder := httptest.NewRecorder()
+	err = defender.ServeHTTP(recorder, req, &mockHandler{})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+
+	group, _ := repl.GetString("http.defender.group")
+	prefix, _ := repl.GetString("http.defender.prefix")
+	require.Equal(t, "203.0.113.0/24", group)
+	require.Equal(t, "203.0.113.0/24", prefix)
+}
+
+func TestDefenderServeHTTP_Exclusions(t *testing.T) {
+	tests := []struct {
+		name           string
+		clientIP       string
+		ranges         []string
+		expectedStatus int
+	}{
+		{
+			name:           "IP in excluded subnet of blocked range",
+			ranges:         []string{"203.0.0.0/16", "!203.0.113.0/24"},
+			clientIP:       "203.0.113.10",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "IP in blocked range outside exclusion",
+			ranges:         []string{"203.0.0.0/16", "!203.0.113.0/24"},
+			clientIP:       "203.0.1.10",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "only exclusions apply to the default ranges",
+			ranges:         []string{"!203.0.113.0/24"},
+			clientIP:       "203.0.113.10",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defender := &Defender{
+				RawResponder: "block",
+				Ranges:       tt.ranges,
+				responder:    &responders.BlockResponder{},
+			}
+
+			ctx := caddy.Context{Context: context.Background()}
+			defender.log = zap.NewNop()
+			err := defender.Provision(ctx)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.clientIP + ":12345"
+			recorder := httptest.NewRecorder()
+
+			err = defender.ServeHTTP(recorder, req, &mockHandler{})
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedStatus, recorder.Code)
+		})
+	}
+}
+
+func TestDefenderProvision_RangeFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("blocks ranges listed in file", func(t *testing.T) {
+		path := filepath.Join(dir, "scrapers.txt")
+		require.NoError(t, os.WriteFile(path, []byte("# scrapers\n203.0.113.0/24\n"), 0o600))
+
+		defender := &Defender{
+			RawResponder: "block",
+			Ranges:       []string{"file://" + path},
+			responder:    &responders.BlockResponder{},
+		}
+		defender.log = zap.NewNop()
+		require.NoError(t, defender.Validate())
+		require.NoError(t, defender.Provision(caddy.Context{Context: context.Background()}))
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "203.0.113.10:12345"
+		recorder := httptest.NewRecorder()
+
+		err := defender.ServeHTTP(recorder, req, &mockHandler{})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+
+	t.Run("invalid lines fail provisioning", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.txt")
+		require.NoError(t, os.WriteFile(path, []byte("203.0.113.0/24\nbogus\n"), 0o600))
+
+		defender := &Defender{
+			RawResponder: "block",
+			Ranges:       []string{"file://" + path},
+			responder:    &responders.BlockResponder{},
+		}
+		defender.log = zap.NewNop()
+		err := defender.Provision(caddy.Context{Context: context.Background()})
+		require.ErrorContains(t, err, path+":2")
+	})
+}
+
+func TestDefenderProvision_SharedRangeTables(t *testing.T) {
+	provision := func(t *testing.T, ranges, whitelist []string) *Defender {
+		t.Helper()
+		defender := &Defender{
+			RawResponder: "block",
+			Ranges:       ranges,
+			Whitelist:    whitelist,
+			responder:    &responders.BlockResponder{},
+		}
+		require.NoError(t, defender.Provision(caddy.Context{Context: context.Background()}))
+		return defender
+	}
+
+	first := provision(t, []string{"203.0.113.0/24", "198.51.100.0/24"}, nil)
+	second := provision(t, []string{"198.51.100.0/24", "203.0.113.0/24", "198.51.100.0/24"}, nil)
+	other := provision(t, []string{"198.51.100.0/24", "203.0.113.0/24"}, []string{"203.0.113.7"})
+
+	require.Same(t, first.ipChecker, second.ipChecker, "identical range sets should share a table")
+	require.NotSame(t, first.ipChecker, other.ipChecker, "a different whitelist needs its own table")
+
+	refs, ok := rangeTables.References(first.rangeTableKey)
+	require.True(t, ok)
+	require.Equal(t, 2, refs)
+
+	require.NoError(t, first.Cleanup())
+	refs, ok = rangeTables.References(second.rangeTableKey)
+	require.True(t, ok)
+	require.Equal(t, 1, refs)
+
+	// A reload provisions the new config before cleaning up the old one, so the table is reused
+	reloaded := provision(t, []string{"203.0.113.0/24", "198.51.100.0/24"}, nil)
+	require.Same(t, second.ipChecker, reloaded.ipChecker)
+
+	matcher := &MatchDefender{Ranges: []string{"198.51.100.0/24", "203.0.113.0/24"}}
+	require.NoError(t, matcher.Provision(caddy.Context{Context: context.Background()}))
+	require.Same(t, second.ipChecker, matcher.ipChecker, "matchers share the handler's table")
+	require.NoError(t, matcher.Cleanup())
+
+	require.NoError(t, second.Cleanup())
+	require.NoError(t, reloaded.Cleanup())
+	require.NoError(t, other.Cleanup())
+	_, ok = rangeTables.References(second.rangeTableKey)
+	require.False(t, ok, "table should be released once unused")
+}
+
+// gatherCounters returns the value of every counter in ctx's metrics registry, summed over labels.
+func gatherCounters(t *testing.T, ctx caddy.Context) map[string]float64 {
+	t.Helper()
+	families, err := ctx.GetMetricsRegistry().Gather()
+	require.NoError(t, err)
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			values[family.GetName()] += metric.GetCounter().GetValue()
+		}
+	}
+	return values
+}
+
+func TestDefenderProvision_CacheMetrics(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	defender := &Defender{
+		RawResponder: "block",
+		Ranges:       []string{"192.0.2.0/24"},
+		responder:    &responders.BlockResponder{},
+	}
+	require.NoError(t, defender.Provision(ctx))
+	defer func() { require.NoError(t, defender.Cleanup()) }()
+
+	before := gatherCounters(t, ctx)
+	require.Contains(t, before, "caddy_defender_cache_hits_total")
+	require.Contains(t, before, "caddy_defender_cache_misses_total")
+
+	for range 2 {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.10:12345"
+		require.NoError(t, defender.ServeHTTP(httptest.NewRecorder(), req, &mockHandler{}))
+	}
+	after := gatherCounters(t, ctx)
+	require.Equal(t, before["caddy_defender_cache_misses_total"]+1, after["caddy_defender_cache_misses_total"])
+	require.Equal(t, before["caddy_defender_cache_hits_total"]+1, after["caddy_defender_cache_hits_total"])
+}
+
+func TestDefenderProvision_CacheDisabled(t *testing.T) {
+	defender := &Defender{
+		RawResponder: "block",
+		Ranges:       []string{"192.0.2.0/24"},
+		Cache:        ip.CacheConfig{Disabled: true},
+		responder:    &responders.BlockResponder{},
+	}
+	require.NoError(t, defender.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, defender.Cleanup()) }()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.10:12345"
+	recorder := httptest.NewRecorder()
+	require.NoError(t, defender.ServeHTTP(recorder, req, &mockHandler{}))
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+}
+
+func TestDefenderServeHTTP_MonitorMode(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	defender := &Defender{
+		RawResponder:  "block",
+		Ranges:        []string{"203.0.113.0/24"},
+		Mode:          "monitor",
+		MonitorHeader: "X-Defender-Monitor",
+		responder:     &responders.BlockResponder{},
+	}
+	require.NoError(t, defender.Validate())
+	require.NoError(t, defender.Provision(ctx))
+	defer func() { require.NoError(t, defender.Cleanup()) }()
+
+	before := gatherCounters(t, ctx)
+
+	t.Run("matched request is passed on", func(t *testing.T) {
+		repl := caddy.NewReplacer()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "203.0.113.10:12345"
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+		recorder := httptest.NewRecorder()
+
+		require.NoError(t, defender.ServeHTTP(recorder, req, &mockHandler{}))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Equal(t, "OK", recorder.Body.String())
+		require.Equal(t, "block; group=203.0.113.0/24", recorder.Header().Get("X-Defender-Monitor"))
+
+		action, _ := repl.GetString("http.defender.action")
+		require.Equal(t, "monitored", action)
+	})
+
+	t.Run("unmatched request is not annotated", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "198.51.100.10:12345"
+		recorder := httptest.NewRecorder()
+
+		require.NoError(t, defender.ServeHTTP(recorder, req, &mockHandler{}))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Empty(t, recorder.Header().Get("X-Defender-Monitor"))
+	})
+
+	after := gatherCounters(t, ctx)
+	require.Equal(t, before["caddy_defender_monitored_requests_total"]+1, after["caddy_defender_monitored_requests_total"])
+	require.Equal(t, before["caddy_defender_blocked_requests_total"], after["caddy_defender_blocked_requests_total"])
+}
+
+func TestDefenderServeHTTP_MonitorModeBans(t *testing.T) {
+	defender := &Defender{
+		RawResponder: "block",
+		Ranges:       []string{"203.0.113.0/24"},
+		Mode:         "monitor",
+		Traps:        &TrapConfig{Paths: []string{"/wp-admin/"}},
+		responder:    &responders.BlockResponder{},
+	}
+	require.NoError(t, defender.Validate())
+	require.NoError(t, defender.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, defender.Cleanup()) }()
+	defer banTable.Remove(netip.MustParsePrefix("198.51.100.40/32"))
+
+	serve := func(path string, vars map[string]any) *httptest.ResponseRecorder {
+		repl := caddy.NewReplacer()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "198.51.100.40:12345"
+		ctx := context.WithValue(req.Context(), caddyhttp.VarsCtxKey, vars)
+		req = req.WithContext(context.WithValue(ctx, caddy.ReplacerCtxKey, repl))
+		recorder := httptest.NewRecorder()
+		require.NoError(t, defender.ServeHTTP(recorder, req, &mockHandler{}))
+
+		action, _ := repl.GetString("http.defender.action")
+		require.Equal(t, "monitored", action)
+		return recorder
+	}
+
+	// Trap hits and ban requests are only logged, since bans apply to every handler
+	require.Equal(t, http.StatusOK, serve("/wp-admin/install.php", map[string]any{}).Code)
+	require.Equal(t, http.StatusOK, serve("/", map[string]any{"defender_ban": "1h; reason=login"}).Code)
+	require.Empty(t, banTable.List())
+}
+
+func TestDefenderServeHTTP_BanVar(t *testing.T) {
+	defender := &Defender{
+		RawResponder: "block",
+		Ranges:       []string{"203.0.113.0/24"},
+		Message:      "Banned",
+		StatusCode:   http.StatusTooManyRequests,
+		responder:    &responders.BlockResponder{},
+	}
+	require.NoError(t, defender.Validate())
+	require.NoError(t, defender.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, defender.Cleanup()) }()
+	defer banTable.Remove(netip.MustParsePrefix("198.51.100.20/32"))
+
+	serve := func(vars map[string]any) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "198.51.100.20:12345"
+		req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, vars))
+		recorder := httptest.NewRecorder()
+		require.NoError(t, defender.ServeHTTP(recorder, req, &mockHandler{}))
+		return recorder
+	}
+
+	// Invalid ban requests are ignored
+	recorder := serve(map[string]any{"defender_ban": "soon"})
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	// The request setting the ban is already handled by the ban's responder
+	recorder = serve(map[string]any{"defender_ban": "1h; reason=login; responder=custom"})
+	require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	require.Equal(t, "Banned", recorder.Body.String())
+
+	// Later requests stay banned
+	recorder = serve(map[string]any{})
+	require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+
+	ban, ok := banTable.Lookup(netip.MustParseAddr("198.51.100.20"))
+	require.True(t, ok)
+	require.Equal(t, "login", ban.Reason)
+	require.False(t, ban.Permanent())
+}
+
+func TestDefenderLookup_Bans(t *testing.T) {
+	defender := &Defender{
+		RawResponder: "block",
+		Ranges:       []string{"10.0.0.0/8"},
+		Whitelist:    []string{"10.0.0.7"},
+		responder:    &responders.BlockResponder{},
+	}
+	require.NoError(t, defender.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, defender.Cleanup()) }()
+	ctx := context.Background()
+
+	// Warm the cache, so the ban must be checked in front of it
+	require.True(t, defender.ipChecker.Lookup(ctx, net.ParseIP("198.51.100.10")).Allowed)
+
+	for _, prefix := range []string{"198.51.100.10/32", "10.0.0.7/32"} {
+		ban := bans.Spec{Duration: time.Hour, Reason: "scrape", Responder: "tarpit"}.
+			Ban(netip.MustParsePrefix(prefix), time.Now())
+		require.NoError(t, banTable.Add(ban))
+		defer banTable.Remove(ban.Prefix)
+	}
+
+	result := defender.ipChecker.Lookup(ctx, net.ParseIP("198.51.100.10"))
+	require.False(t, result.Allowed)
+	require.NotNil(t, result.Ban)
+	require.Equal(t, "scrape", result.Ban.Reason)
+	require.Equal(t, []string{groupBan}, result.Match.Groups)
+	require.Equal(t, netip.MustParsePrefix("198.51.100.10/32"), result.Match.Prefix)
+
+	// The whitelist still wins over bans
+	result = defender.ipChecker.Lookup(ctx, net.ParseIP("10.0.0.7"))
+	require.True(t, result.Allowed)
+	require.Nil(t, result.Ban)
+
+	banTable.Remove(netip.MustParsePrefix("198.51.100.10/32"))
+	require.True(t, defender.ipChecker.Lookup(ctx, net.ParseIP("198.51.100.10")).Allowed)
+}
+
+// banningHandler responds like an upstream application asking the defender to ban the client.
+type banningHandler struct{}
+
+func (banningHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) error {
+	w.Header().Set("X-Defender-Ban", "2h; reason=scrape")
+	_, err := w.Write([]byte("OK"))
+	return err
+}
+
+func TestDefenderServeHTTP_BanHeader(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	defender := &Defender{
+		RawResponder: "block",
+		Ranges:       []string{"203.0.113.0/24"},
+		BanHeader:    &BanHeaderConfig{Header: "X-Defender-Ban", IPv4Prefix: 24},
+		responder:    &responders.BlockResponder{},
+		storage:      storage,
+	}
+	require.NoError(t, defender.Validate())
+	require.NoError(t, defender.Provision(ctx))
+	defer func() { require.NoError(t, defender.Cleanup()) }()
+	banned := netip.MustParsePrefix("198.51.100.0/24")
+	defer banTable.Remove(banned)
+
+	serve := func(remoteAddr string, next caddyhttp.Handler) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		recorder := httptest.NewRecorder()
+		require.NoError(t, defender.ServeHTTP(recorder, req, next))
+		return recorder
+	}
+
+	// The upstream response is passed on without the header
+	recorder := serve("198.51.100.20:12345", banningHandler{})
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "OK", recorder.Body.String())
+	require.Empty(t, recorder.Header().Get("X-Defender-Ban"))
+
+	// Later requests from the client's /24 are blocked
+	recorder = serve("198.51.100.77:12345", &mockHandler{})
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+
+	// The ban is persisted, so it is restored after a restart
+	key := banStorageKey(banned)
+	require.Eventually(t, func() bool {
+		return storage.Exists(ctx, key)
+	}, time.Second, 10*time.Millisecond)
+
+	banTable.Remove(banned)
+	require.Equal(t, http.StatusOK, serve("198.51.100.77:12345", &mockHandler{}).Code)
+
+	require.NoError(t, syncBans(ctx, storage, zap.NewNop()))
+	ban, ok := banTable.Lookup(netip.MustParseAddr("198.51.100.77"))
+	require.True(t, ok)
+	require.Equal(t, "scrape", ban.Reason)
+	require.Equal(t, banned, ban.Prefix)
+}
+
+func TestDefenderProvision_SharedBanSyncer(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	provision := func(t *testing.T) *Defender {
+		t.Helper()
+		defender := &Defender{
+			RawResponder: "block",
+			Ranges:       []string{"203.0.113.0/24"},
+			BanHeader:    &BanHeaderConfig{Header: "X-Defender-Ban"},
+			responder:    &responders.BlockResponder{},
+			storage:      storage,
+		}
+		require.NoError(t, defender.Provision(ctx))
+		return defender
+	}
+
+	first := provision(t)
+	second := provision(t)
+	refs, ok := banSyncers.References(banStorageID(storage))
+	require.True(t, ok)
+	require.Equal(t, 2, refs, "handlers sharing a storage should share its sync loop")
+
+	require.NoError(t, first.Cleanup())
+	require.NoError(t, second.Cleanup())
+	_, ok = banSyncers.References(banStorageID(storage))
+	require.False(t, ok, "sync loop should stop once unused")
+}
+
+func TestDefenderServeHTTP_Traps(t *testing.T) {
+	defender := &Defender{
+		RawResponder: "block",
+		Ranges:       []string{"203.0.113.0/24"},
+		Message:      "Trapped",
+		StatusCode:   http.StatusGone,
+		Traps:        &TrapConfig{Paths: []string{"/wp-admin/"}, Responder: "custom"},
+		responder:    &responders.BlockResponder{},
+	}
+	require.NoError(t, defender.Validate())
+	require.NoError(t, defender.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, defender.Cleanup()) }()
+	defer banTable.Remove(netip.MustParsePrefix("198.51.100.30/32"))
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "198.51.100.30:12345"
+		recorder := httptest.NewRecorder()
+		require.NoError(t, defender.ServeHTTP(recorder, req, &mockHandler{}))
+		return recorder
+	}
+
+	// The trap is disallowed for every crawler
+	recorder := serve("/robots.txt")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "\nUser-agent: *\nDisallow: /wp-admin/\n", recorder.Body.String())
+
+	recorder = serve("/wp-admin")
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	// The request falling into the trap is already handled by the trap's responder
+	recorder = serve("/wp-admin/install.php")
+	require.Equal(t, http.StatusGone, recorder.Code)
+	require.Equal(t, "Trapped", recorder.Body.String())
+
+	recorder = serve("/")
+	require.Equal(t, http.StatusGone, recorder.Code)
+
+	ban, ok := banTable.Lookup(netip.MustParseAddr("198.51.100.30"))
+	require.True(t, ok)
+	require.Equal(t, "trap", ban.Reason)
+	require.WithinDuration(t, time.Now().Add(defaultTrapDuration), ban.Expires, time.Minute)
+}
+
+// robotsHandler serves an upstream robots.txt disallowing /private/ for everyone.
+type robotsHandler struct{}
+
+func (robotsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Path == "/robots.txt" {
+		_, err := w.Write([]byte("User-agent: *\nDisallow: /private/\n"))
+		return err
+	}
+	_, err := w.Write([]byte("OK"))
+	return err
+}
+
+func TestDefenderServeHTTP_EnforceRobots(t *testing.T) {
+	tests := []struct {
+		name        string
+		ip          string
+		userAgent   string
+		allowedPath string
+		trapPath    string
+		serveIgnore bool
+	}{
+		{
+			name:        "served robots.txt",
+			ip:          "198.51.100.40",
+			userAgent:   "ExampleBot/1.0",
+			serveIgnore: true,
+			trapPath:    "/blog/",
+		},
+		{
+			name:        "served robots.txt allowing the agent",
+			ip:          "198.51.100.41",
+			userAgent:   "Mozilla/5.0 (compatible; Googlebot/2.1)",
+			serveIgnore: true,
+			allowedPath: "/blog/",
+		},
+		{
+			name:        "upstream robots.txt",
+			ip:          "198.51.100.42",
+			userAgent:   "ExampleBot/1.0",
+			allowedPath: "/blog/",
+			trapPath:    "/private/report",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defender := &Defender{
+				RawResponder:  "block",
+				Ranges:        []string{"203.0.113.0/24"},
+				ServeIgnore:   tt.serveIgnore,
+				EnforceRobots: &RobotsPolicyConfig{},
+				responder:     &responders.BlockResponder{},
+			}
+			require.NoError(t, defender.Validate())
+			require.NoError(t, defender.Provision(caddy.Context{Context: context.Background()}))
+			defer func() { require.NoError(t, defender.Cleanup()) }()
+			defer banTable.Remove(netip.MustParsePrefix(tt.ip + "/32"))
+
+			serve := func(path string) int {
+				req := httptest.NewRequest(http.MethodGet, path, nil)
+				req.RemoteAddr = tt.ip + ":12345"
+				req.Header.Set("User-Agent", tt.userAgent)
+				recorder := httptest.NewRecorder()
+				require.NoError(t, defender.ServeHTTP(recorder, req, robotsHandler{}))
+				return recorder.Code
+			}
+
+			// Clients that never fetched robots.txt aren't held to it
+			require.Equal(t, http.StatusOK, serve("/private/"))
+
+			require.Equal(t, http.StatusOK, serve("/robots.txt"))
+			if tt.allowedPath != "" {
+				require.Equal(t, http.StatusOK, serve(tt.allowedPath))
+			}
+			if tt.trapPath == "" {
+				return
+			}
+
+			require.Equal(t, http.StatusForbidden, serve(tt.trapPath))
+			require.Equal(t, http.StatusForbidden, serve("/"))
+
+			ban, ok := banTable.Lookup(netip.MustParseAddr(tt.ip))
+			require.True(t, ok)
+			require.Contains(t, ban.Reason, "robots.txt User-agent: *")
+		})
+	}
+}
+
+func TestDefenderServeHTTP_UserAgents(t *testing.T) {
+	defender := &Defender{
+		RawResponder: "block",
+		Ranges:       []string{"203.0.113.0/24"},
+		UserAgents:   []string{"ai_crawlers", `^curl/`},
+		Whitelist:    []string{"198.51.100.60"},
+		responder:    &responders.BlockResponder{},
+	}
+	require.NoError(t, defender.Validate())
+	require.NoError(t, defender.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, defender.Cleanup()) }()
+
+	tests := []struct {
+		name      string
+		ip        string
+		userAgent string
+		group     string
+		status    int
+	}{
+		{
+			name:      "catalog crawler from an unlisted network",
+			ip:        "192.0.2.10",
+			userAgent: "Mozilla/5.0 (compatible; ClaudeBot/1.0; +claudebot@anthropic.com)",
+			group:     "ai_crawlers",
+			status:    http.StatusForbidden,
+		},
+		{
+			name:      "regular expression",
+			ip:        "192.0.2.10",
+			userAgent: "curl/8.5.0",
+			group:     `^curl/`,
+			status:    http.StatusForbidden,
+		},
+		{
+			name:      "browser",
+			ip:        "192.0.2.10",
+			userAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:138.0) Gecko/20100101 Firefox/138.0",
+			status:    http.StatusOK,
+		},
+		{
+			name:      "whitelisted crawler",
+			ip:        "198.51.100.60",
+			userAgent: "GPTBot/1.2",
+			status:    http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.ip + ":12345"
+			req.Header.Set("User-Agent", tt.userAgent)
+			repl := caddy.NewReplacer()
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+			recorder := httptest.NewRecorder()
+
+			require.NoError(t, defender.ServeHTTP(recorder, req, &mockHandler{}))
+			require.Equal(t, tt.status, recorder.Code)
+			group, _ := repl.GetString(placeholderGroup)
+			require.Equal(t, tt.group, group)
+			_, ok := repl.Get(placeholderPrefix)
+			require.False(t, ok)
+		})
+	}
+}
+
+func TestDefenderServeHTTP_RateLimit(t *testing.T) {
+	defender := &Defender{
+		RawResponder: "ratelimit",
+		Ranges:       []string{"203.0.113.0/24"},
+		RateLimitConfig: ratelimit.Config{
+			Limit:      ratelimit.Limit{Events: 2, Window: caddy.Duration(time.Hour)},
+			IPv4Prefix: 24,
+		},
+	}
+	defender.responder = &ratelimit.Responder{Config: &defender.RateLimitConfig}
+	require.NoError(t, defender.Validate())
+	require.NoError(t, defender.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, defender.Cleanup()) }()
+
+	serve := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = ip + ":12345"
+		recorder := httptest.NewRecorder()
+		require.NoError(t, defender.ServeHTTP(recorder, req, &mockHandler{}))
+		return recorder
+	}
+
+	require.Equal(t, http.StatusOK, serve("203.0.113.70").Code)
+	require.Equal(t, http.StatusOK, serve("203.0.113.71").Code)
+	recorder := serve("203.0.113.72")
+	require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	require.Equal(t, "1800", recorder.Header().Get("Retry-After"))
+	require.Equal(t, http.StatusOK, serve("192.0.2.70").Code, "clients outside the ranges are not limited")
+}
+
+func TestDefenderServeHTTP_Challenge(t *testing.T) {
+	defender := &Defender{
+		RawResponder:    "challenge",
+		Ranges:          []string{"203.0.113.0/24"},
+		ChallengeConfig: challenge.Config{Difficulty: 4},
+	}
+	defender.responder = &challenge.Responder{Config: &defender.ChallengeConfig}
+	require.NoError(t, defender.Validate())
+	require.NoError(t, defender.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, defender.Cleanup()) }()
+
+	serve := func(header http.Header, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "203.0.113.80:12345"
+		maps.Copy(req.Header, header)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		recorder := httptest.NewRecorder()
+		require.NoError(t, defender.ServeHTTP(recorder, req, &mockHandler{}))
+		return recorder
+	}
+
+	page := serve(nil)
+	require.Equal(t, http.StatusForbidden, page.Code)
+	token := regexp.MustCompile(`"token":"([^"]+)"`).FindStringSubmatch(page.Body.String())
+	require.NotNil(t, token)
+
+	// Difficulty 4 needs a hash starting with a zero nibble.
+	nonce := 0
+	for sha256.Sum256([]byte(token[1] + strconv.Itoa(nonce)))[0] >= 0x10 {
+		nonce++
+	}
+	verified := serve(http.Header{
+		challenge.HeaderChallenge: {token[1]},
+		challenge.HeaderNonce:     {strconv.Itoa(nonce)},
+	})
+	require.Equal(t, http.StatusNoContent, verified.Code)
+	require.Equal(t, http.StatusOK, serve(nil, verified.Result().Cookies()...).Code)
+}
+
+// teapotResponder is a responder module from outside the plugin.
+type teapotResponder struct {
+	Message     string `json:"message,omitempty"`
+	provisioned bool
+}
+
+// teapotCleanups counts the cleanups of teapotResponders.
+var teapotCleanups atomic.Int32
+
+func init() {
+	caddy.RegisterModule(teapotResponder{})
+}
+
+func (teapotResponder) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  responders.Namespace + ".teapot",
+		New: func() caddy.Module { return new(teapotResponder) },
+	}
+}
+
+func (r *teapotResponder) Provision(caddy.Context) error {
+	r.provisioned = true
+	return nil
+}
+
+func (r *teapotResponder) Cleanup() error {
+	teapotCleanups.Add(1)
+	return nil
+}
+
+func (r *teapotResponder) ServeHTTP(w http.ResponseWriter, _ *http.Request, _ caddyhttp.Handler) error {
+	if !r.provisioned {
+		return errors.New("not provisioned")
+	}
+	w.WriteHeader(http.StatusTeapot)
+	_, err := w.Write([]byte(r.Message))
+	return err
+}
+
+func TestDefenderServeHTTP_ResponderModules(t *testing.T) {
+	serve := func(t *testing.T, input string) *httptest.ResponseRecorder {
+		t.Helper()
+		teapotCleanups.Store(0)
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		defer cancel()
+
+		var defender Defender
+		require.NoError(t, json.Unmarshal([]byte(input), &defender))
+		require.NoError(t, defender.Provision(ctx))
+		defer func() { require.NoError(t, defender.Cleanup()) }()
+		require.NoError(t, defender.Validate())
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "203.0.113.95:12345"
+		recorder := httptest.NewRecorder()
+		require.NoError(t, defender.ServeHTTP(recorder, req, &mockHandler{}))
+		return recorder
+	}
+
+	t.Run("built-in module", func(t *testing.T) {
+		recorder := serve(t, `{
+			"responder": {"responder": "custom", "message": "Go away", "status_code": 451},
+			"ranges": ["203.0.113.0/24"]
+		}`)
+		require.Equal(t, http.StatusUnavailableForLegalReasons, recorder.Code)
+		require.Equal(t, "Go away", recorder.Body.String())
+	})
+
+	t.Run("third-party module", func(t *testing.T) {
+		recorder := serve(t, `{
+			"responder": {"responder": "teapot", "message": "short and stout"},
+			"ranges": ["203.0.113.0/24"]
+		}`)
+		require.Equal(t, http.StatusTeapot, recorder.Code)
+		require.Equal(t, "short and stout", recorder.Body.String())
+		require.Equal(t, int32(1), teapotCleanups.Load(), "cleaned up by Caddy only")
+	})
+
+	t.Run("third-party module by name", func(t *testing.T) {
+		recorder := serve(t, `{"raw_responder": "teapot", "ranges": ["203.0.113.0/24"]}`)
+		require.Equal(t, http.StatusTeapot, recorder.Code)
+		require.Equal(t, int32(1), teapotCleanups.Load())
+	})
+
+	t.Run("third-party module for bans", func(t *testing.T) {
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		defer cancel()
+		defender := &Defender{
+			RawResponder: "block",
+			Ranges:       []string{"203.0.113.0/24"},
+			Traps:        &TrapConfig{Paths: []string{"/wp-admin/"}, Responder: "teapot"},
+			responder:    &responders.BlockResponder{},
+		}
+		require.NoError(t, defender.Validate())
+		require.NoError(t, defender.Provision(ctx))
+		defer func() { require.NoError(t, defender.Cleanup()) }()
+
+		name, responder := defender.namedResponder("teapot")
+		require.Equal(t, "teapot", name)
+		require.IsType(t, &teapotResponder{}, responder)
+	})
+
+	t.Run("ban responders set up on first use", func(t *testing.T) {
+		teapotCleanups.Store(0)
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		defer cancel()
+		defender := &Defender{
+			RawResponder: "block",
+			Ranges:       []string{"203.0.113.0/24"},
+			responder:    &responders.BlockResponder{},
+		}
+		require.NoError(t, defender.Validate())
+		require.NoError(t, defender.Provision(ctx))
+		require.NotContains(t, defender.banResponders.responders, "teapot")
+
+		name, responder := defender.namedResponder("teapot")
+		require.Equal(t, "teapot", name)
+		_, again := defender.namedResponder("teapot")
+		require.Same(t, responder, again, "cached")
+
+		name, _ = defender.namedResponder("redirect")
+		require.Equal(t, "block", name, "redirects need a url")
+
+		require.NoError(t, defender.Cleanup())
+		require.Equal(t, int32(1), teapotCleanups.Load())
+	})
+
+	t.Run("mismatched raw_responder", func(t *testing.T) {
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		defer cancel()
+		var defender Defender
+		require.NoError(t, json.Unmarshal([]byte(`{"raw_responder":"block","responder":{"responder":"drop"}}`), &defender))
+		require.ErrorContains(t, defender.Provision(ctx), `doesn't match the responder module "drop"`)
+		require.NoError(t, defender.Cleanup())
+	})
+}
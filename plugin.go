@@ -1,23 +1,33 @@
 package caddydefender
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
+	"slices"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
 	"go.uber.org/zap"
 	"pkg.jsn.cam/caddy-defender/matchers/ip"
+	"pkg.jsn.cam/caddy-defender/matchers/useragent"
+	"pkg.jsn.cam/caddy-defender/ranges/sources"
 	"pkg.jsn.cam/caddy-defender/responders"
+	"pkg.jsn.cam/caddy-defender/responders/challenge"
+	"pkg.jsn.cam/caddy-defender/responders/ratelimit"
 	"pkg.jsn.cam/caddy-defender/responders/tarpit"
+	"pkg.jsn.cam/caddy-defender/strikes"
 )
 
 func init() {
 	// Register the module with Caddy
 	caddy.RegisterModule(Defender{})
+	caddy.RegisterModule(MatchDefender{})
+	caddy.RegisterModule(MatchDefenderRanges{})
 	httpcaddyfile.RegisterHandlerDirective("defender", parseCaddyfile)
 	httpcaddyfile.RegisterDirectiveOrder("defender", "after", "header")
 }
@@ -32,13 +42,10 @@ var (
 		"deepseek",
 		"githubcopilot",
 	}
-	// Tarpit Defaults
-	// defaultTarpitTimeout is the default duration for a request to be closed after.
-	defaultTarpitTimeout = time.Second * 30
-	// defaultTarpitBytesPerSecond is the default amount of bytes to stream per second.
-	defaultTarpitBytesPerSecond = 24
-	// defaultTarpitResponseCode is the default HTTP respond code for the tarpit responder.
-	defaultTarpitResponseCode = http.StatusOK
+	// minRefreshInterval is the shortest allowed interval between runtime range refreshes.
+	minRefreshInterval = time.Minute
+	// fileCheckInterval is how often range files are checked for modifications.
+	fileCheckInterval = 5 * time.Second
 )
 
 // Defender implements an HTTP middleware that enforces IP-based rules to protect your site from AIs/Scrapers.
@@ -58,6 +65,18 @@ var (
 //
 // ```
 //
+// Or, with a responder module:
+//
+// ```json
+//
+//	{
+//	  "handler": "defender",
+//	  "responder": {"responder": "custom", "message": "Custom block message"},
+//	  "ranges": ["openai", "10.0.0.0/8"]
+//	}
+//
+// ```
+//
 // **Caddyfile Syntax:**
 // ```
 //
@@ -68,11 +87,28 @@ var (
 //
 // ```
 //
-// Supported responder types:
+// Or, with a responder per group of ranges:
+// ```
+//
+//	defender {
+//	    rule tarpit {
+//	        ranges openai
+//	    }
+//	    rule {
+//	        ranges aws
+//	        responder redirect https://status.example.com
+//	    }
+//	}
+//
+// ```
+//
+// Responders are modules in the http.handlers.defender.responders namespace. Built in:
 // - `block`: Immediately block requests with 403 Forbidden
+// - `challenge`: Let browsers through once they solve a proof-of-work challenge
 // - `custom`: Return a custom message (requires `message` field)
 // - `drop`: Drops the connection
 // - `garbage`: Respond with random garbage data
+// - `ratelimit`: Let requests through at a limited rate, answering the excess with 429 Too Many Requests
 // - `redirect`: Redirect requests to a URL with 308 permanent redirect
 // - `tarpit`: Stream data at a slow, but configurable rate to stall bots and pollute AI training.
 //
@@ -83,6 +119,30 @@ type Defender struct {
 	responder responders.Responder
 	ipChecker *ip.IPChecker
 	log       *zap.Logger
+	// rangeTableKey identifies the shared range table in rangeTables
+	rangeTableKey string
+	// resolver resolves range entries to the prefixes the shared range table currently holds
+	resolver *sources.Resolver
+	// banResponders holds the responders bans, spoofed crawlers and escalation steps can name, by type
+	banResponders *banResponderSet
+	// storage persists the bans requested by upstream responses
+	storage certmagic.Storage
+	// banSyncerKey identifies the storage's sync loop in banSyncers
+	banSyncerKey string
+	// robotsTxt is the robots.txt served by the handler, if any
+	robotsTxt string
+	// robots holds the robots.txt rules enforced by the handler
+	robots *robotsPolicy
+	// userAgents matches the User-Agent of requests allowed by their IP
+	userAgents *useragent.Matcher
+	// verifier checks the IP of clients claiming to be a known crawler
+	verifier *useragent.Verifier
+	// strikes counts the matched requests of each client for escalation
+	strikes *strikes.Counter
+	// adminID identifies the handler in the admin API
+	adminID uint64
+	// loadedResponder reports whether responder was loaded from ResponderRaw, so Caddy cleans it up
+	loadedResponder bool
 	// Message specifies the custom response message for 'custom' responder type.
 	// Required when using 'custom' responder.
 	Message string `json:"message,omitempty"`
@@ -91,18 +151,49 @@ type Defender struct {
 	// Required only when using 'redirect' responder.
 	URL string `json:"url,omitempty"`
 
-	// RawResponder defines the response strategy for blocked requests.
-	// Required. Must be one of: "block", "custom", "drop", "garbage", "redirect", "tarpit"
+	// RawResponder defines the response strategy for blocked requests, naming a responder module
+	// set up from the handler's settings (message, url, tarpit_config, ...).
+	// Required unless ResponderRaw is set. Built in: "block", "challenge", "custom", "drop", "garbage",
+	// "ratelimit", "redirect", "tarpit"
 	RawResponder string `json:"raw_responder,omitempty"`
 
+	// ResponderRaw is the responder module handling blocked requests with its own settings, e.g.
+	// {"responder": "tarpit", "timeout": 60000000000}. It takes the place of RawResponder, which
+	// is set to its name. Responders named elsewhere, such as by bans, are still set up from the
+	// handler's settings.
+	ResponderRaw json.RawMessage `json:"responder,omitempty" caddy:"namespace=http.handlers.defender.responders inline_key=responder"` //nolint:lll // Struct tags can't be wrapped.
+
 	// Ranges specifies IP ranges to block, which can be either:
 	// - CIDR notations (e.g., "192.168.1.0/24")
 	// - Predefined service keys (e.g., "openai", "aws")
-	// Default:
+	// - Local files with one CIDR or IP per line (e.g., "file:///etc/defender/scrapers.txt"),
+	//   reloaded automatically when they change
+	// - HTTP(S) URLs serving such a list or a JSON document (e.g., "https://example.com/ranges.json"),
+	//   cached on disk so the last good copy survives restarts
+	// Either can be prefixed with "!" (e.g., "!203.0.113.0/24") to exclude it from blocking.
+	// The most specific matching prefix decides whether a client is blocked.
+	// If only exclusions are given and there are no Rules, they are applied to the default ranges.
+	// Default: DefaultRanges, or none if Rules are set
 	Ranges []string `json:"ranges,omitempty"`
 
-	// An optional whitelist of IP addresses to exclude from blocking. If empty, no IPs are whitelisted.
-	// NOTE: this only supports IP addresses, not ranges.
+	// Rules hand the requests from their own ranges to their own responders, e.g. tarpitting
+	// "openai" while redirecting "aws" to a status page. The handler's ranges come first, then the
+	// rules in order: a client in the ranges of several is handled by the first of them. Rules are
+	// compiled into the handler's range table and share its whitelist and bans. They can't be
+	// combined with Escalation, which picks the responder itself.
+	// Default: [] (every range is handled by the handler's responder)
+	Rules []Rule `json:"rules,omitempty"`
+
+	// UserAgents blocks requests whose User-Agent matches, even if their IP isn't in Ranges, which
+	// catches crawlers announcing themselves from residential or unlisted networks. Entries are keys
+	// of the bundled AI crawler catalog (e.g. "ai_crawlers", "openai", "anthropic") or regular
+	// expressions, matched ignoring case. Whitelisted clients are never blocked.
+	// Default: [] (User-Agents aren't checked)
+	UserAgents []string `json:"user_agents,omitempty"`
+
+	// An optional whitelist of IP addresses, CIDRs (e.g., "10.20.0.0/16") and predefined
+	// service keys (e.g., "cloudflare") to exclude from blocking. Whitelisted addresses are
+	// never blocked, even when they fall inside a more specific blocked range.
 	// Default: []
 	Whitelist []string `json:"whitelist,omitempty"`
 
@@ -110,6 +201,14 @@ type Defender struct {
 	// Default: {Headers: {}, timeout: 30s, ResponseCode: 200}
 	TarpitConfig tarpit.Config `json:"tarpit_config,omitempty"`
 
+	// An optional configuration for the 'ratelimit' responder
+	// Default: {events: 10, window: 1m, algorithm: token_bucket, ipv4_prefix: 32, ipv6_prefix: 128}
+	RateLimitConfig ratelimit.Config `json:"ratelimit_config,omitempty"`
+
+	// An optional configuration for the 'challenge' responder
+	// Default: {difficulty: 16, duration: 24h, cookie_name: defender_challenge, keys: [random]}
+	ChallengeConfig challenge.Config `json:"challenge_config,omitempty"`
+
 	// StatusCode specifies the HTTP status code for 'custom' responder type.
 	// Optional. Default: 200
 	StatusCode int `json:"status_code,omitempty"`
@@ -117,49 +216,234 @@ type Defender struct {
 	// ServeIgnore specifies whether to serve a robots.txt file with a "Disallow: /" directive
 	// Default: false
 	ServeIgnore bool `json:"serve_ignore,omitempty"`
+
+	// Mode controls what happens to requests from blocked ranges:
+	// - "enforce": hand them to the responder
+	// - "monitor": log them, set the {http.defender.action} placeholder to "monitored" and pass them on,
+	//   so new ranges can be tried out in production first. Bans the handler would add are
+	//   only logged, since they apply to every handler
+	// Default: "enforce"
+	Mode string `json:"mode,omitempty"`
+
+	// MonitorHeader is an optional response header set on requests passed on in monitor mode,
+	// naming the responder and groups that would have handled them (e.g. "block; group=openai").
+	// Default: "" (no header)
+	MonitorHeader string `json:"monitor_header,omitempty"`
+
+	// RefreshInterval enables refreshing predefined ranges (e.g. "openai", "aws") and URL ranges
+	// at runtime on this interval. Failed fetches fall back to the embedded data for predefined
+	// ranges and to the last good copy for URLs.
+	// Optional. Minimum: 1m. Default: 0 (disabled, URLs are only fetched when provisioning)
+	RefreshInterval caddy.Duration `json:"refresh_interval,omitempty"`
+
+	// Remote configures how URL ranges are fetched and validated.
+	// Default: {max_size: 10MiB, min_count: 1, timeout: 30s, json_keys: [ipv4Prefix, ipv6Prefix, ip_prefix, ipv6_prefix]}
+	Remote sources.RemoteConfig `json:"remote,omitempty"`
+
+	// Cache configures the cache of lookup results kept in front of the range table.
+	// Hits, misses and evictions are exported as caddy_defender_cache_* metrics.
+	// Default: {capacity: 10000, shards: 10, ttl: 10m}
+	Cache ip.CacheConfig `json:"cache,omitempty"`
+
+	// ClientIP reads the client IP from a header set by trusted proxies (e.g. Cloudflare's
+	// CF-Connecting-IP) instead of Caddy's client_ip, which depends on the server-wide trusted_proxies.
+	// Default: nil (Caddy's client_ip, falling back to the remote address)
+	ClientIP *ClientIPConfig `json:"client_ip,omitempty"`
+
+	// BanVar names the request variable earlier handlers set to ban the client, e.g.
+	// `vars defender_ban "2h; reason=login; responder=tarpit"`. The value is a duration or
+	// "permanent", optionally followed by a reason and the responder for the banned client.
+	// Bans are kept in memory, shared by all defender handlers and consulted before the ranges.
+	// Default: "defender_ban"
+	BanVar string `json:"ban_var,omitempty"`
+
+	// BanHeader lets upstream applications ban the client with a response header, e.g.
+	// `X-Defender-Ban: 2h; reason=scrape`, which is removed from the response. These bans are
+	// stored in Caddy's configured storage, so they survive reloads and restarts and are shared
+	// by instances using the same storage.
+	// Default: nil (disabled)
+	BanHeader *BanHeaderConfig `json:"ban_header,omitempty"`
+
+	// Traps lists honeypot paths, such as "/wp-admin/" or links hidden in the site's pages. They are
+	// disallowed in the served robots.txt, and clients requesting them anyway are banned for the
+	// configured duration, whatever their IP, with their own responder if one is set.
+	// Default: nil (disabled)
+	Traps *TrapConfig `json:"traps,omitempty"`
+
+	// EnforceRobots turns the served robots.txt into a policy: clients that fetch it and then
+	// request a path it disallows for their User-Agent are banned, and the violated rule is logged
+	// and recorded as the ban's reason. Without serve_ignore or traps, the upstream robots.txt
+	// is enforced instead.
+	// Default: nil (disabled)
+	EnforceRobots *RobotsPolicyConfig `json:"enforce_robots,omitempty"`
+
+	// Robots customizes the served robots.txt: the user-agents allowed to crawl the site, those
+	// disallowed from it, and disallowed paths. Crawlers run from the blocked predefined ranges
+	// (e.g. GPTBot for "openai") are disallowed automatically. It can merge the generated file with
+	// the upstream robots.txt and serve ai.txt and llms.txt opt-out files.
+	// Default: nil (robots.txt is only served with serve_ignore or traps)
+	Robots *RobotsConfig `json:"robots,omitempty"`
+
+	// VerifyCrawlers flags requests whose User-Agent claims a known crawler (e.g. GPTBot) but whose
+	// IP is outside the crawler's published ranges as spoofed, handling them with their own
+	// responder. Verified crawlers can be allowed explicitly.
+	// Default: nil (disabled)
+	VerifyCrawlers *VerifyCrawlersConfig `json:"verify_crawlers,omitempty"`
+
+	// Escalation picks the responder by how many matched requests the client made recently,
+	// e.g. letting it through for its first few requests, tarpitting it next and dropping it
+	// after that. It replaces the handler's responder, except for banned clients, and can't be
+	// combined with Rules.
+	// Default: nil (always use the handler's responder)
+	Escalation *EscalationConfig `json:"escalation,omitempty"`
 }
 
 // Provision sets up the middleware, logger, and responder configurations.
 func (m *Defender) Provision(ctx caddy.Context) error {
 	m.log = ctx.Logger(m)
 
-	if len(m.Ranges) == 0 {
+	switch {
+	case len(m.Rules) > 0:
+		// the rules say what to block, so the default ranges aren't added
+	case len(m.Ranges) == 0:
 		// set the default ranges to be all of the predefined ranges
 		m.log.Debug("no ranges specified, defaulting to default ranges", zap.Strings("ranges", DefaultRanges))
 		m.Ranges = DefaultRanges
+	case !slices.ContainsFunc(m.Ranges, isBlockedRange):
+		// only exclusions were given, so carve them out of the default ranges
+		m.log.Debug("only exclusions specified, applying them to the default ranges", zap.Strings("ranges", DefaultRanges))
+		m.Ranges = slices.Concat(DefaultRanges, m.Ranges)
+	}
+
+	if m.BanVar == "" {
+		m.BanVar = defaultBanVar
+	}
+
+	if err := registerMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return fmt.Errorf("registering metrics: %w", err)
 	}
 
 	// ensure to keep AFTER the ranges are checked (above)
-	m.ipChecker = ip.NewIPChecker(m.Ranges, m.Whitelist, m.log)
+	cfg := m.rangeConfig()
+	key, err := cfg.key()
+	if err != nil {
+		return err
+	}
+	table, err := loadRangeTable(ctx, key, cfg, m.log)
+	if err != nil {
+		return err
+	}
+	m.rangeTableKey = key
+	m.ipChecker = table.checker
+	m.resolver = table.resolver
 
-	// Finish configuring tarpit responder's content reader / defaults
-	if m.RawResponder == responderTarpit {
-		tarpitResponder, ok := m.responder.(*tarpit.Responder)
-		if !ok {
-			return fmt.Errorf("expected tarpit responder but got %T", m.responder)
+	if len(m.UserAgents) > 0 {
+		userAgents, err := useragent.New(m.UserAgents)
+		if err != nil {
+			return err
 		}
+		m.userAgents = userAgents
+	}
 
-		err := tarpitResponder.ConfigureContentReader()
-		if err != nil {
+	if m.VerifyCrawlers != nil {
+		if err := m.provisionCrawlerVerifier(); err != nil {
+			return err
+		}
+	}
+
+	if m.Escalation != nil {
+		m.provisionEscalation()
+	}
+
+	if m.ClientIP != nil {
+		if err := m.ClientIP.provision(); err != nil {
 			return err
 		}
+	}
 
-		if m.TarpitConfig.Timeout == 0 {
-			m.TarpitConfig.Timeout = defaultTarpitTimeout
+	if err := m.provisionResponder(ctx); err != nil {
+		return err
+	}
+
+	if err := m.provisionRules(ctx); err != nil {
+		return err
+	}
+
+	m.robotsTxt = m.buildRobotsTxt()
+	if m.EnforceRobots != nil {
+		if err := m.provisionRobotsPolicy(); err != nil {
+			return err
 		}
+	}
+
+	if err := m.provisionBanResponders(ctx); err != nil {
+		return err
+	}
 
-		if m.TarpitConfig.BytesPerSecond == 0 {
-			m.TarpitConfig.BytesPerSecond = defaultTarpitBytesPerSecond
+	if m.BanHeader != nil {
+		if m.storage == nil {
+			m.storage = ctx.Storage()
+		}
+		if err := m.provisionBanStorage(ctx); err != nil {
+			return err
 		}
+	}
+
+	registerDefender(m)
+	return nil
+}
 
-		if m.TarpitConfig.ResponseCode == 0 {
-			m.TarpitConfig.ResponseCode = defaultTarpitResponseCode
+// provisionResponder loads the responder module, or provisions the responder set up from
+// the handler's settings.
+func (m *Defender) provisionResponder(ctx caddy.Context) error {
+	if m.ResponderRaw == nil {
+		if provisioner, ok := m.responder.(caddy.Provisioner); ok {
+			return provisioner.Provision(ctx)
 		}
+		return nil
 	}
 
+	mod, err := ctx.LoadModule(m, "ResponderRaw")
+	if err != nil {
+		return fmt.Errorf("loading responder module: %w", err)
+	}
+	responder, ok := mod.(responders.Responder)
+	if !ok {
+		return fmt.Errorf("module %T is not a responder", mod)
+	}
+	name := mod.(caddy.Module).CaddyModule().ID.Name()
+	if m.RawResponder != "" && m.RawResponder != name {
+		return fmt.Errorf("raw_responder %q doesn't match the responder module %q", m.RawResponder, name)
+	}
+	m.RawResponder = name
+	m.responder = responder
+	m.loadedResponder = true
 	return nil
 }
 
+// Cleanup releases the shared range table and the state shared by the responders.
+func (m *Defender) Cleanup() error {
+	unregisterDefender(m)
+	err := m.cleanupResponders()
+	if m.banSyncerKey != "" {
+		_, syncErr := banSyncers.Delete(m.banSyncerKey)
+		m.banSyncerKey = ""
+		err = errors.Join(err, syncErr)
+	}
+	if m.rangeTableKey == "" {
+		return err
+	}
+	_, tableErr := rangeTables.Delete(m.rangeTableKey)
+	m.rangeTableKey = ""
+	return errors.Join(err, tableErr)
+}
+
+// isBlockedRange reports whether a range entry blocks (rather than excludes) its prefixes.
+func isBlockedRange(entry string) bool {
+	_, excluded := ip.ParseEntry(entry)
+	return !excluded
+}
+
 // CaddyModule returns the Caddy module information.
 func (Defender) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
@@ -171,6 +455,7 @@ func (Defender) CaddyModule() caddy.ModuleInfo {
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*Defender)(nil)
+	_ caddy.CleanerUpper          = (*Defender)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Defender)(nil)
 	_ caddyfile.Unmarshaler       = (*Defender)(nil)
 )
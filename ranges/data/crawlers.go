@@ -0,0 +1,36 @@
+package data
+
+// CrawlerAgents maps predefined range keys to the robots.txt user-agent tokens of the crawlers
+// their operator runs from those ranges, which are disallowed when the ranges are blocked.
+// Unlike IPRanges, it is maintained by hand.
+var CrawlerAgents = map[string][]string{
+	// https://developer.amazon.com/amazonbot
+	"aws": {"Amazonbot"},
+	// Seen in the wild, DeepSeek documents no crawlers
+	"deepseek": {"DeepSeekBot"},
+	// https://developers.google.com/search/docs/crawling-indexing/google-common-crawlers#google-extended
+	"gcloud": {"Google-Extended"},
+	// https://aspiegel.com/petalbot
+	"huawei": {"PetalBot"},
+	// https://docs.mistral.ai/robots
+	"mistral": {"MistralAI-User"},
+	// https://platform.openai.com/docs/bots
+	"openai": {"GPTBot", "ChatGPT-User", "OAI-SearchBot"},
+}
+
+// VerifiedCrawlers maps predefined range keys to the User-Agent tokens of the crawlers their
+// operator documents as connecting only from those ranges, so a client sending the token from
+// elsewhere is spoofing it. Unlike CrawlerAgents, it only lists tokens sent as User-Agents and
+// ranges published for the crawler itself. It is maintained by hand.
+var VerifiedCrawlers = map[string][]string{
+	// https://developer.amazon.com/amazonbot
+	"aws": {"Amazonbot"},
+	// https://developers.google.com/search/docs/crawling-indexing/verifying-googlebot
+	"googlebot": {"Googlebot"},
+	// https://aspiegel.com/petalbot
+	"huawei": {"PetalBot"},
+	// https://docs.mistral.ai/robots
+	"mistral": {"MistralAI-User"},
+	// https://platform.openai.com/docs/bots
+	"openai": {"GPTBot", "ChatGPT-User", "OAI-SearchBot"},
+}
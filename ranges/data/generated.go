@@ -24455,6 +24455,7 @@ var IPRanges = map[string][]string{
 		"138.91.182.224/32",
 		"13.107.5.93/32",
 	},
+	"googlebot": {},
 	"huawei": {
 		"111.91.0.0/18",
 		"111.91.64.0/18",
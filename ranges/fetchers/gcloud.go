@@ -20,10 +20,11 @@ func (f GCloudFetcher) Description() string {
 
 func (f GCloudFetcher) FetchIPRanges() ([]string, error) {
 	// Fetch all GCP IP ranges
-	return fetchGCloudIPRanges()
+	return fetchGoogleIPRanges("https://www.gstatic.com/ipranges/cloud.json")
 }
 
-// GCloudIPRanges represents the structure of the GCP IP ranges JSON file.
+// GCloudIPRanges represents the structure of the IP ranges JSON files Google publishes,
+// such as those of GCP and Googlebot.
 type GCloudIPRanges struct {
 	SyncToken    string `json:"syncToken"`
 	CreationTime string `json:"creationTime"`
@@ -35,12 +36,11 @@ type GCloudIPRanges struct {
 	} `json:"prefixes"`
 }
 
-// fetchGCloudIPRanges fetches and parses the GCP IP ranges JSON file.
-func fetchGCloudIPRanges() ([]string, error) {
-	const url = "https://www.gstatic.com/ipranges/cloud.json"
-	resp, err := http.Get(url)
+// fetchGoogleIPRanges fetches and parses one of Google's IP ranges JSON files.
+func fetchGoogleIPRanges(url string) ([]string, error) {
+	resp, err := http.Get(url) //nolint:gosec
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch GCP IP ranges from %s: %v", url, err)
+		return nil, fmt.Errorf("failed to fetch Google IP ranges from %s: %v", url, err)
 	}
 	defer resp.Body.Close()
 
@@ -51,7 +51,7 @@ func fetchGCloudIPRanges() ([]string, error) {
 
 	var ipRanges GCloudIPRanges
 	if err := json.Unmarshal(body, &ipRanges); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal GCP IP ranges JSON: %v", err)
+		return nil, fmt.Errorf("failed to unmarshal Google IP ranges JSON from %s: %v", url, err)
 	}
 
 	// Extract all IP ranges (both IPv4 and IPv6)
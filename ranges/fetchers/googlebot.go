@@ -0,0 +1,17 @@
+package fetchers
+
+// GooglebotFetcher implements the IPRangeFetcher interface for Google's crawlers.
+type GooglebotFetcher struct{}
+
+func (f GooglebotFetcher) Name() string {
+	return "Googlebot"
+}
+
+func (f GooglebotFetcher) Description() string {
+	return "Fetches IP ranges for Google's common crawlers, such as Googlebot."
+}
+
+func (f GooglebotFetcher) FetchIPRanges() ([]string, error) {
+	// https://developers.google.com/search/docs/crawling-indexing/verifying-googlebot
+	return fetchGoogleIPRanges("https://developers.google.com/static/search/apis/ipranges/googlebot.json")
+}
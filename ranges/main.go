@@ -12,7 +12,7 @@ import (
 
 	"pkg.jsn.cam/caddy-defender/ranges/data"
 	"pkg.jsn.cam/caddy-defender/ranges/fetchers"
-	"pkg.jsn.cam/caddy-defender/ranges/fetchers/aws"
+	"pkg.jsn.cam/caddy-defender/ranges/sources"
 )
 
 var (
@@ -31,28 +31,7 @@ func main() {
 	flag.Parse()
 
 	// Create an array of all IP range fetchers
-	fetchersList := []fetchers.IPRangeFetcher{
-		fetchers.VPNFetcher{},                  // Known VPN services
-		fetchers.LinodeFetcher{},               // Linode
-		fetchers.DigitalOceanFetcher{},         // Digital Ocean
-		fetchers.OpenAIFetcher{},               // OpenAI services
-		fetchers.DeepSeekFetcher{},             // DeepSeek
-		fetchers.OracleFetcher{},               // Oracle Cloud
-		fetchers.GithubCopilotFetcher{},        // GitHub Copilot
-		fetchers.AzurePublicCloudFetcher{},     // Azure Public Cloud
-		fetchers.GCloudFetcher{},               // Google Cloud Platform
-		aws.AWSFetcher{},                       // Global AWS IP ranges
-		aws.RegionFetcher{Region: "us-east-1"}, // us-east-1 region
-		aws.RegionFetcher{Region: "us-west-1"}, // us-west-1 region
-		// aws.RegionFetcher{Region: "eu-west-1"}, // eu-west-1 region
-		fetchers.PrivateFetcher{},     // Private IP ranges (RFC 1918)
-		fetchers.AllFetcher{},         // All IP ranges
-		fetchers.MistralFetcher{},     // Mistral IP ranges
-		fetchers.VultrFetcher{},       // Vultr Cloud IP ranges
-		fetchers.CloudflareFetcher{},  // Cloudflare IP ranges
-		fetchers.AliyunFetcher{},      // Aliyun IP ranges
-		fetchers.HuaweiCloudFetcher{}, // Huawei Cloud IP ranges
-	}
+	fetchersList := sources.DefaultFetchers()
 
 	if fetchTor {
 		// the issue with the tor fetcher is that TOR is a network of individual nodes,
@@ -105,7 +84,7 @@ func main() {
 
 			// Update the map with the fetched ranges
 			mu.Lock()
-			ipRanges[strings.ToLower(f.Name())] = ranges
+			ipRanges[sources.Key(f)] = ranges
 			mu.Unlock()
 
 			// Print the completion of the fetching process
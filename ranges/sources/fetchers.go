@@ -0,0 +1,50 @@
+package sources
+
+import (
+	"strings"
+
+	"pkg.jsn.cam/caddy-defender/ranges/fetchers"
+	"pkg.jsn.cam/caddy-defender/ranges/fetchers/aws"
+)
+
+// DefaultFetchers returns the fetchers whose results are embedded in data.IPRanges.
+// Opt-in fetchers such as Tor and ASN are not included.
+func DefaultFetchers() []fetchers.IPRangeFetcher {
+	return []fetchers.IPRangeFetcher{
+		fetchers.VPNFetcher{},                  // Known VPN services
+		fetchers.LinodeFetcher{},               // Linode
+		fetchers.DigitalOceanFetcher{},         // Digital Ocean
+		fetchers.OpenAIFetcher{},               // OpenAI services
+		fetchers.DeepSeekFetcher{},             // DeepSeek
+		fetchers.OracleFetcher{},               // Oracle Cloud
+		fetchers.GithubCopilotFetcher{},        // GitHub Copilot
+		fetchers.AzurePublicCloudFetcher{},     // Azure Public Cloud
+		fetchers.GCloudFetcher{},               // Google Cloud Platform
+		fetchers.GooglebotFetcher{},            // Google crawlers
+		aws.AWSFetcher{},                       // Global AWS IP ranges
+		aws.RegionFetcher{Region: "us-east-1"}, // us-east-1 region
+		aws.RegionFetcher{Region: "us-west-1"}, // us-west-1 region
+		// aws.RegionFetcher{Region: "eu-west-1"}, // eu-west-1 region
+		fetchers.PrivateFetcher{},     // Private IP ranges (RFC 1918)
+		fetchers.AllFetcher{},         // All IP ranges
+		fetchers.MistralFetcher{},     // Mistral IP ranges
+		fetchers.VultrFetcher{},       // Vultr Cloud IP ranges
+		fetchers.CloudflareFetcher{},  // Cloudflare IP ranges
+		fetchers.AliyunFetcher{},      // Aliyun IP ranges
+		fetchers.HuaweiCloudFetcher{}, // Huawei Cloud IP ranges
+	}
+}
+
+// Key returns the predefined range key a fetcher's results are stored under.
+func Key(f fetchers.IPRangeFetcher) string {
+	return strings.ToLower(f.Name())
+}
+
+// fetchersByKey indexes the given fetchers by their predefined range key.
+func fetchersByKey(list []fetchers.IPRangeFetcher) map[string]fetchers.IPRangeFetcher {
+	byKey := make(map[string]fetchers.IPRangeFetcher, len(list))
+	for _, f := range list {
+		byKey[Key(f)] = f
+	}
+	return byKey
+}
@@ -0,0 +1,103 @@
+package sources
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// FileScheme prefixes range entries that load their CIDRs from a local file,
+// e.g. "file:///etc/defender/scrapers.txt".
+const FileScheme = "file://"
+
+// filePath returns the path of a file range entry.
+func filePath(entry string) (string, bool) {
+	return strings.CutPrefix(entry, FileScheme)
+}
+
+// IsFile reports whether a range entry refers to a local file.
+func IsFile(entry string) bool {
+	_, ok := filePath(entry)
+	return ok
+}
+
+// fileSource is the last successfully parsed contents of a range file.
+type fileSource struct {
+	modTime time.Time
+	ranges  []string
+}
+
+// ReadFile parses a range file containing one CIDR or IP address per line.
+// Blank lines and anything following a '#' are ignored. Every invalid line is
+// reported with the file name and line number.
+func ReadFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseList(path, f)
+}
+
+// parseList parses a list of CIDRs or IP addresses, one per line, naming the
+// source in errors. Blank lines and anything following a '#' are ignored.
+func parseList(name string, r io.Reader) ([]string, error) {
+	var (
+		ranges []string
+		errs   []error
+	)
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		cidr, err := parseCIDROrIP(line)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: invalid IP or CIDR %q", name, lineNo, line))
+			continue
+		}
+		ranges = append(ranges, cidr)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return ranges, nil
+}
+
+// parseCIDROrIP normalizes a CIDR or a single IP address into CIDR notation.
+func parseCIDROrIP(s string) (string, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()).String(), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return "", err
+	}
+	return prefix.String(), nil
+}
+
+// loadFile reads and parses a range file, recording its modification time.
+func loadFile(path string) (*fileSource, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSource{modTime: info.ModTime(), ranges: ranges}, nil
+}
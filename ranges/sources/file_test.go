@@ -0,0 +1,93 @@
+package sources
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func writeRangeFile(t *testing.T, path, contents string, modTime time.Time) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestReadFile(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("valid file", func(t *testing.T) {
+		path := filepath.Join(dir, "valid.txt")
+		writeRangeFile(t, path, `# scrapers
+203.0.113.0/24
+198.51.100.7   # single address
+
+2001:db8::/32
+2001:db8:1::1
+`, time.Now())
+
+		ranges, err := ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, []string{"203.0.113.0/24", "198.51.100.7/32", "2001:db8::/32", "2001:db8:1::1/128"}, ranges)
+	})
+
+	t.Run("invalid lines are reported with line numbers", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.txt")
+		writeRangeFile(t, path, "203.0.113.0/24\nnot-an-ip\n# fine\n10.0.0.0/33\n", time.Now())
+
+		_, err := ReadFile(path)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), path+`:2: invalid IP or CIDR "not-an-ip"`)
+		require.Contains(t, err.Error(), path+`:4: invalid IP or CIDR "10.0.0.0/33"`)
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := ReadFile(filepath.Join(dir, "missing.txt"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestResolverFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.txt")
+	entry := FileScheme + path
+	start := time.Now().Add(-time.Hour)
+	writeRangeFile(t, path, "203.0.113.0/24\n", start)
+
+	resolver := NewResolver(zap.NewNop())
+	require.NoError(t, resolver.Load(context.Background(), []string{entry, "openai"}))
+
+	ranges, err := resolver.Resolve(entry)
+	require.NoError(t, err)
+	require.Equal(t, []string{"203.0.113.0/24"}, ranges)
+
+	t.Run("unchanged file is not reloaded", func(t *testing.T) {
+		require.False(t, resolver.ReloadFiles())
+	})
+
+	t.Run("modified file is reloaded", func(t *testing.T) {
+		writeRangeFile(t, path, "198.51.100.0/24\n", start.Add(time.Minute))
+		require.True(t, resolver.ReloadFiles())
+
+		ranges, err := resolver.Resolve(entry)
+		require.NoError(t, err)
+		require.Equal(t, []string{"198.51.100.0/24"}, ranges)
+	})
+
+	t.Run("invalid modification keeps previous contents", func(t *testing.T) {
+		writeRangeFile(t, path, "garbage\n", start.Add(2*time.Minute))
+		require.False(t, resolver.ReloadFiles())
+
+		ranges, err := resolver.Resolve(entry)
+		require.NoError(t, err)
+		require.Equal(t, []string{"198.51.100.0/24"}, ranges)
+	})
+
+	t.Run("load reports invalid files", func(t *testing.T) {
+		err := NewResolver(zap.NewNop()).Load(context.Background(), []string{entry})
+		require.ErrorContains(t, err, path+":1")
+	})
+}
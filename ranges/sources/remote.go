@@ -0,0 +1,291 @@
+package sources
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"pkg.jsn.cam/caddy-defender/cache"
+)
+
+const (
+	// remoteCacheDirectory is where the last good copy of remote range lists is kept.
+	remoteCacheDirectory = "ranges"
+	// remoteMetaSuffix is appended to a URL to form the cache key of its validators.
+	remoteMetaSuffix = "#meta"
+
+	defaultRemoteMaxSize  = 10 << 20 // 10 MiB
+	defaultRemoteMinCount = 1
+	defaultRemoteTimeout  = 30 * time.Second
+)
+
+var errNotModified = errors.New("not modified")
+
+// defaultJSONKeys name the prefix fields of the published lists of Google, OpenAI and AWS.
+var defaultJSONKeys = []string{"ipv4Prefix", "ipv6Prefix", "ip_prefix", "ipv6_prefix"}
+
+// RemoteConfig controls how remote range lists are fetched and validated.
+type RemoteConfig struct {
+	// MaxSize is the largest response body accepted, in bytes.
+	// Default: 10 MiB
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// MinCount is the minimum number of prefixes a response must contain to replace the active set.
+	// Default: 1
+	MinCount int `json:"min_count,omitempty"`
+
+	// Timeout bounds each fetch.
+	// Default: 30s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// JSONKeys are the object keys whose values are read as prefixes from JSON documents,
+	// at any depth. A value may be a string or an array of strings.
+	// Default: ["ipv4Prefix", "ipv6Prefix", "ip_prefix", "ipv6_prefix"]
+	JSONKeys []string `json:"json_keys,omitempty"`
+}
+
+func (c RemoteConfig) maxSize() int64 {
+	if c.MaxSize > 0 {
+		return c.MaxSize
+	}
+	return defaultRemoteMaxSize
+}
+
+func (c RemoteConfig) minCount() int {
+	if c.MinCount > 0 {
+		return c.MinCount
+	}
+	return defaultRemoteMinCount
+}
+
+func (c RemoteConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout)
+	}
+	return defaultRemoteTimeout
+}
+
+func (c RemoteConfig) jsonKeys() []string {
+	if len(c.JSONKeys) > 0 {
+		return c.JSONKeys
+	}
+	return defaultJSONKeys
+}
+
+// IsRemote reports whether a range entry refers to an HTTP(S) URL.
+func IsRemote(entry string) bool {
+	return strings.HasPrefix(entry, "http://") || strings.HasPrefix(entry, "https://")
+}
+
+// remoteSource is the last accepted copy of a remote range list and its cache validators.
+type remoteSource struct {
+	ETag         string   `json:"etag,omitempty"`
+	LastModified string   `json:"last_modified,omitempty"`
+	Ranges       []string `json:"-"`
+}
+
+// fetchRemote downloads and validates a remote range list. When prev is given, the
+// request is conditional and errNotModified is returned if the list is unchanged.
+func fetchRemote(ctx context.Context, client *http.Client, cfg RemoteConfig,
+	url string, prev *remoteSource) (*remoteSource, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if prev != nil {
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if prev.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.LastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if prev != nil {
+			return prev, nil, errNotModified
+		}
+		return nil, nil, fmt.Errorf("unexpected status %s for unconditional request", resp.Status)
+	default:
+		return nil, nil, fmt.Errorf("bad status: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, cfg.maxSize()+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading response: %w", err)
+	}
+	if int64(len(body)) > cfg.maxSize() {
+		return nil, nil, fmt.Errorf("response exceeds maximum size of %d bytes", cfg.maxSize())
+	}
+
+	ranges, err := parseRemote(url, resp.Header.Get("Content-Type"), body, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &remoteSource{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Ranges:       ranges,
+	}, body, nil
+}
+
+// parseRemote extracts the prefixes from a remote range list. In JSON documents the
+// values of the configured keys are used, anything else is parsed as a plain list.
+// Every value or line must be a CIDR or IP address.
+func parseRemote(name, contentType string, body []byte, cfg RemoteConfig) ([]string, error) {
+	var (
+		ranges []string
+		err    error
+	)
+	trimmed := bytes.TrimSpace(body)
+	if strings.Contains(contentType, "json") || bytes.HasPrefix(trimmed, []byte("{")) || bytes.HasPrefix(trimmed, []byte("[")) {
+		ranges, err = parseJSONPrefixes(name, body, cfg.jsonKeys())
+	} else {
+		ranges, err = parseList(name, bytes.NewReader(body))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ranges) < cfg.minCount() {
+		return nil, fmt.Errorf("%s: got %d prefixes, expected at least %d", name, len(ranges), cfg.minCount())
+	}
+	return ranges, nil
+}
+
+// parseJSONPrefixes walks a JSON document and collects the values of the given keys.
+// Other values are ignored, so metadata such as timestamps can't be mistaken for prefixes.
+func parseJSONPrefixes(name string, body []byte, keys []string) ([]string, error) {
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	var (
+		ranges []string
+		errs   []error
+	)
+	add := func(key string, v any) {
+		s, ok := v.(string)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %q holds %T, expected a string", name, key, v))
+			return
+		}
+		cidr, err := parseCIDROrIP(strings.TrimSpace(s))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %q: invalid IP or CIDR %q", name, key, s))
+			return
+		}
+		ranges = append(ranges, cidr)
+	}
+
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case []any:
+			for _, item := range v {
+				walk(item)
+			}
+		case map[string]any:
+			for key, item := range v {
+				if !slices.Contains(keys, key) {
+					walk(item)
+					continue
+				}
+				if items, ok := item.([]any); ok {
+					for _, item := range items {
+						add(key, item)
+					}
+					continue
+				}
+				add(key, item)
+			}
+		}
+	}
+	walk(doc)
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("%s: no prefixes found under the JSON keys %s", name, strings.Join(keys, ", "))
+	}
+
+	slices.Sort(ranges)
+	return slices.Compact(ranges), nil
+}
+
+// remoteCache stores the last accepted copy of each remote range list on disk.
+type remoteCache struct {
+	cache *cache.Cache
+}
+
+func newRemoteCache() *remoteCache {
+	return &remoteCache{cache: cache.New(&cache.Config{Directory: remoteCacheDirectory})}
+}
+
+// get returns the cached copy of url, or nil if there is no copy that is still valid
+// under cfg.
+func (c *remoteCache) get(url string, cfg RemoteConfig) (*remoteSource, error) {
+	body, ok, err := c.read(url)
+	if err != nil || !ok {
+		return nil, err
+	}
+	meta, ok, err := c.read(url + remoteMetaSuffix)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	var src remoteSource
+	if err := json.Unmarshal(meta, &src); err != nil {
+		return nil, fmt.Errorf("invalid cache metadata for %s: %w", url, err)
+	}
+	src.Ranges, err = parseRemote(url, "", body, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cached copy of %s: %w", url, err)
+	}
+	return &src, nil
+}
+
+// set replaces the cached copy of url.
+func (c *remoteCache) set(url string, src *remoteSource, body []byte) error {
+	meta, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	if err := c.cache.Set(url, io.NopCloser(bytes.NewReader(body))); err != nil {
+		return err
+	}
+	return c.cache.Set(url+remoteMetaSuffix, io.NopCloser(bytes.NewReader(meta)))
+}
+
+func (c *remoteCache) read(key string) ([]byte, bool, error) {
+	r, ok, err := c.cache.Get(key)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	return b, err == nil, err
+}
@@ -0,0 +1,188 @@
+package sources
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseRemote(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		errContains string
+		expected    []string
+		cfg         RemoteConfig
+	}{
+		{
+			name:     "plain list",
+			body:     "# list\n203.0.113.0/24\n198.51.100.7\n",
+			expected: []string{"203.0.113.0/24", "198.51.100.7/32"},
+		},
+		{
+			name:        "JSON document",
+			contentType: "application/json",
+			body:        `{"creationTime":"2025-01-01","prefixes":[{"ipv4Prefix":"203.0.113.0/24"},{"ipv6Prefix":"2001:db8::/32"}]}`,
+			expected:    []string{"2001:db8::/32", "203.0.113.0/24"},
+		},
+		{
+			name:     "JSON without content type",
+			body:     `{"prefixes":[{"ip_prefix":"203.0.113.0/24","region":"10.0.0.1"},{"ip_prefix":"203.0.113.0/24"}]}`,
+			expected: []string{"203.0.113.0/24"},
+		},
+		{
+			name:     "configured JSON keys",
+			body:     `{"updated":"198.51.100.1","blocked":{"cidrs":["203.0.113.0/24","198.51.100.7"]}}`,
+			expected: []string{"198.51.100.7/32", "203.0.113.0/24"},
+			cfg:      RemoteConfig{JSONKeys: []string{"cidrs"}},
+		},
+		{
+			name:        "JSON without the configured keys",
+			contentType: "application/json",
+			body:        `["203.0.113.0/24", "198.51.100.7"]`,
+			errContains: "no prefixes found under the JSON keys",
+		},
+		{
+			name:        "invalid value under a JSON key",
+			contentType: "application/json",
+			body:        `{"prefixes":[{"ipv4Prefix":"203.0.113.0/24"},{"ipv4Prefix":"<html>"}]}`,
+			errContains: `remote: "ipv4Prefix": invalid IP or CIDR "<html>"`,
+		},
+		{
+			name:        "invalid line",
+			body:        "203.0.113.0/24\n<html>\n",
+			errContains: `remote:2: invalid IP or CIDR "<html>"`,
+		},
+		{
+			name:        "too few prefixes",
+			body:        "203.0.113.0/24\n",
+			errContains: "got 1 prefixes, expected at least 2",
+			cfg:         RemoteConfig{MinCount: 2},
+		},
+		{
+			name:        "invalid JSON",
+			contentType: "application/json",
+			body:        `{"prefixes": [`,
+			errContains: "invalid JSON",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, err := parseRemote("remote", tt.contentType, []byte(tt.body), tt.cfg)
+			if tt.errContains != "" {
+				require.ErrorContains(t, err, tt.errContains)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, ranges)
+		})
+	}
+}
+
+func TestResolverRemote(t *testing.T) {
+	var (
+		body     atomic.Value
+		requests atomic.Int32
+		fail     atomic.Bool
+	)
+	body.Store("203.0.113.0/24\n")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if fail.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		current := body.Load().(string)
+		etag := `"` + strings.TrimSpace(current) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(current))
+	}))
+	defer server.Close()
+
+	url := server.URL + "/ranges.txt"
+	resolver := NewResolver(zap.NewNop())
+	require.NoError(t, resolver.Load(context.Background(), []string{url}))
+	require.True(t, resolver.HasRemotes())
+
+	ranges, err := resolver.Resolve(url)
+	require.NoError(t, err)
+	require.Equal(t, []string{"203.0.113.0/24"}, ranges)
+
+	t.Run("unchanged list is not downloaded again", func(t *testing.T) {
+		require.False(t, resolver.RefreshRemotes(context.Background()))
+	})
+
+	t.Run("changed list replaces the active set", func(t *testing.T) {
+		body.Store("198.51.100.0/24\n")
+		require.True(t, resolver.RefreshRemotes(context.Background()))
+
+		ranges, err := resolver.Resolve(url)
+		require.NoError(t, err)
+		require.Equal(t, []string{"198.51.100.0/24"}, ranges)
+	})
+
+	t.Run("invalid list keeps the active set", func(t *testing.T) {
+		body.Store("<html>oops</html>\n")
+		require.False(t, resolver.RefreshRemotes(context.Background()))
+
+		ranges, err := resolver.Resolve(url)
+		require.NoError(t, err)
+		require.Equal(t, []string{"198.51.100.0/24"}, ranges)
+	})
+
+	t.Run("oversized list keeps the active set", func(t *testing.T) {
+		body.Store(strings.Repeat("203.0.113.0/24\n", 10))
+		resolver.Remote.MaxSize = 20
+		defer func() { resolver.Remote.MaxSize = 0 }()
+		require.False(t, resolver.RefreshRemotes(context.Background()))
+
+		ranges, err := resolver.Resolve(url)
+		require.NoError(t, err)
+		require.Equal(t, []string{"198.51.100.0/24"}, ranges)
+	})
+
+	t.Run("restart with unreachable origin uses the disk cache", func(t *testing.T) {
+		fail.Store(true)
+		restarted := NewResolver(zap.NewNop())
+		require.NoError(t, restarted.Load(context.Background(), []string{url}))
+
+		ranges, err := restarted.Resolve(url)
+		require.NoError(t, err)
+		require.Equal(t, []string{"198.51.100.0/24"}, ranges)
+	})
+
+	t.Run("restart ignores a disk cache below min_count", func(t *testing.T) {
+		restarted := NewResolver(zap.NewNop())
+		restarted.Remote.MinCount = 2
+		require.NoError(t, restarted.Load(context.Background(), []string{url}))
+
+		ranges, err := restarted.Resolve(url)
+		require.NoError(t, err)
+		require.Empty(t, ranges)
+	})
+
+	t.Run("restart sends conditional request from the disk cache", func(t *testing.T) {
+		fail.Store(false)
+		body.Store("198.51.100.0/24\n")
+		restarted := NewResolver(zap.NewNop())
+		require.NoError(t, restarted.Load(context.Background(), []string{url}))
+		require.False(t, restarted.RefreshRemotes(context.Background()))
+
+		ranges, err := restarted.Resolve(url)
+		require.NoError(t, err)
+		require.Equal(t, []string{"198.51.100.0/24"}, ranges)
+	})
+}
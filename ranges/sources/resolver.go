@@ -0,0 +1,298 @@
+package sources
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"pkg.jsn.cam/caddy-defender/ranges/data"
+	"pkg.jsn.cam/caddy-defender/ranges/fetchers"
+)
+
+var errEmptyFetch = errors.New("fetcher returned no ranges")
+
+// Resolver expands range entries into the CIDRs they cover.
+// Predefined keys resolve to freshly fetched ranges when a refresh has succeeded,
+// and to the embedded data.IPRanges otherwise. File and URL entries resolve to the
+// last successfully parsed contents of the file or response.
+type Resolver struct {
+	// Remote controls how URL entries are fetched and validated.
+	Remote RemoteConfig
+
+	// OnRefresh, if set, is called after every runtime refresh of a predefined key or URL
+	// with the error if the refresh failed. Unmodified URLs count as successful refreshes.
+	OnRefresh func(source string, err error)
+
+	fetchers map[string]fetchers.IPRangeFetcher
+	client   *http.Client
+	cache    *remoteCache
+	log      *zap.Logger
+
+	mu      sync.RWMutex
+	live    map[string][]string
+	files   map[string]*fileSource
+	remotes map[string]*remoteSource
+}
+
+// NewResolver returns a Resolver that refreshes predefined keys using the given fetchers.
+// If no fetchers are given, DefaultFetchers is used.
+func NewResolver(log *zap.Logger, list ...fetchers.IPRangeFetcher) *Resolver {
+	if len(list) == 0 {
+		list = DefaultFetchers()
+	}
+	return &Resolver{
+		fetchers: fetchersByKey(list),
+		log:      log,
+		client:   &http.Client{},
+		cache:    newRemoteCache(),
+		live:     make(map[string][]string),
+		files:    make(map[string]*fileSource),
+		remotes:  make(map[string]*remoteSource),
+	}
+}
+
+// Load eagerly loads the sources referenced by entries so configuration errors
+// surface during provisioning. Range files must parse without errors. URLs are
+// fetched, falling back to the last good copy cached on disk when the origin is
+// unreachable or serves an invalid list.
+func (r *Resolver) Load(ctx context.Context, entries []string) error {
+	var errs []error
+	for _, entry := range entries {
+		switch {
+		case IsFile(entry):
+			path, _ := filePath(entry)
+			if _, err := r.resolveFile(path); err != nil {
+				errs = append(errs, err)
+			}
+		case IsRemote(entry):
+			cached, err := r.cache.get(entry, r.Remote)
+			if err != nil {
+				r.log.Warn("Ignoring cached copy of remote ranges",
+					zap.String("url", entry),
+					zap.Error(err))
+			}
+			r.mu.Lock()
+			r.remotes[entry] = cached
+			r.mu.Unlock()
+			r.refreshRemote(ctx, entry)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Resolve returns the CIDRs for a range entry. Predefined keys expand to their group,
+// anything else is returned unchanged so it can be parsed as a CIDR by the caller.
+func (r *Resolver) Resolve(entry string) ([]string, error) {
+	if path, ok := filePath(entry); ok {
+		return r.resolveFile(path)
+	}
+	if IsRemote(entry) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		if src := r.remotes[entry]; src != nil {
+			return src.Ranges, nil
+		}
+		return nil, nil
+	}
+
+	r.mu.RLock()
+	ranges, ok := r.live[entry]
+	r.mu.RUnlock()
+	if ok {
+		return ranges, nil
+	}
+
+	if ranges, ok := data.IPRanges[entry]; ok {
+		return ranges, nil
+	}
+	return []string{entry}, nil
+}
+
+// Refreshable reports whether a predefined key can be refreshed at runtime.
+func (r *Resolver) Refreshable(key string) bool {
+	_, ok := r.fetchers[key]
+	return ok
+}
+
+// Refresh runs the fetchers for the given predefined keys and stores their results.
+// Keys without a fetcher are ignored. When a fetch fails the key falls back to the
+// embedded data. It reports whether any key now resolves differently than before.
+func (r *Resolver) Refresh(keys []string) bool {
+	changed := false
+	for _, key := range keys {
+		f, ok := r.fetchers[key]
+		if !ok {
+			continue
+		}
+
+		ranges, err := f.FetchIPRanges()
+		if err == nil && len(ranges) == 0 {
+			err = errEmptyFetch
+		}
+		r.reportRefresh(key, err)
+
+		r.mu.Lock()
+		previous, hadLive := r.live[key]
+		if err != nil {
+			r.log.Warn("Failed to refresh predefined ranges, using embedded data",
+				zap.String("group", key),
+				zap.Error(err))
+			delete(r.live, key)
+			changed = changed || hadLive
+		} else {
+			r.live[key] = ranges
+			changed = changed || !slices.Equal(previous, ranges)
+			r.log.Debug("Refreshed predefined ranges",
+				zap.String("group", key),
+				zap.Int("count", len(ranges)))
+		}
+		r.mu.Unlock()
+	}
+	return changed
+}
+
+// resolveFile returns the contents of a range file, loading it on first use.
+func (r *Resolver) resolveFile(path string) ([]string, error) {
+	r.mu.RLock()
+	src, ok := r.files[path]
+	r.mu.RUnlock()
+	if ok {
+		return src.ranges, nil
+	}
+
+	src, err := loadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.files[path] = src
+	r.mu.Unlock()
+	return src.ranges, nil
+}
+
+// ReloadFiles re-reads every loaded range file whose modification time changed.
+// Files that can no longer be read or contain invalid lines keep their previous
+// contents and the error is logged. It reports whether any file was reloaded.
+func (r *Resolver) ReloadFiles() bool {
+	r.mu.RLock()
+	paths := make(map[string]time.Time, len(r.files))
+	for path, src := range r.files {
+		paths[path] = src.modTime
+	}
+	r.mu.RUnlock()
+
+	changed := false
+	for path, modTime := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			r.log.Warn("Failed to check range file, keeping previous contents",
+				zap.String("file", path),
+				zap.Error(err))
+			continue
+		}
+		if info.ModTime().Equal(modTime) {
+			continue
+		}
+
+		src, err := loadFile(path)
+		if err != nil {
+			r.log.Error("Failed to reload range file, keeping previous contents",
+				zap.String("file", path),
+				zap.Error(err))
+			// Remember this version so the same error isn't logged on every check
+			r.mu.Lock()
+			r.files[path] = &fileSource{modTime: info.ModTime(), ranges: r.files[path].ranges}
+			r.mu.Unlock()
+			continue
+		}
+
+		r.mu.Lock()
+		r.files[path] = src
+		r.mu.Unlock()
+		changed = true
+		r.log.Info("Reloaded range file",
+			zap.String("file", path),
+			zap.Int("count", len(src.ranges)))
+	}
+	return changed
+}
+
+// RefreshRemotes re-fetches every loaded URL, using conditional requests to skip
+// unchanged lists. Failed fetches keep the previous copy. It reports whether any
+// list changed.
+func (r *Resolver) RefreshRemotes(ctx context.Context) bool {
+	r.mu.RLock()
+	urls := make([]string, 0, len(r.remotes))
+	for url := range r.remotes {
+		urls = append(urls, url)
+	}
+	r.mu.RUnlock()
+
+	changed := false
+	for _, url := range urls {
+		changed = r.refreshRemote(ctx, url) || changed
+	}
+	return changed
+}
+
+// reportRefresh passes the outcome of refreshing source to OnRefresh.
+func (r *Resolver) reportRefresh(source string, err error) {
+	if r.OnRefresh != nil {
+		r.OnRefresh(source, err)
+	}
+}
+
+// HasRemotes reports whether any URL entries were loaded.
+func (r *Resolver) HasRemotes() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.remotes) > 0
+}
+
+// refreshRemote conditionally fetches url and stores the result if it is valid
+// and differs from the current copy, which is also written to the disk cache.
+func (r *Resolver) refreshRemote(ctx context.Context, url string) bool {
+	r.mu.RLock()
+	prev := r.remotes[url]
+	r.mu.RUnlock()
+
+	src, body, err := fetchRemote(ctx, r.client, r.Remote, url, prev)
+	if errors.Is(err, errNotModified) {
+		r.reportRefresh(url, nil)
+		r.log.Debug("Remote ranges not modified", zap.String("url", url))
+		return false
+	}
+	r.reportRefresh(url, err)
+	if err != nil {
+		if prev != nil {
+			r.log.Error("Failed to fetch remote ranges, keeping last good copy",
+				zap.String("url", url),
+				zap.Error(err))
+		} else {
+			r.log.Error("Failed to fetch remote ranges and no cached copy is available",
+				zap.String("url", url),
+				zap.Error(err))
+		}
+		return false
+	}
+
+	if err := r.cache.set(url, src, body); err != nil {
+		r.log.Warn("Failed to cache remote ranges",
+			zap.String("url", url),
+			zap.Error(err))
+	}
+
+	r.mu.Lock()
+	r.remotes[url] = src
+	r.mu.Unlock()
+	r.log.Info("Fetched remote ranges",
+		zap.String("url", url),
+		zap.Int("count", len(src.Ranges)))
+	return prev == nil || !slices.Equal(prev.Ranges, src.Ranges)
+}
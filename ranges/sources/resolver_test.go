@@ -0,0 +1,96 @@
+package sources
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"pkg.jsn.cam/caddy-defender/ranges/data"
+)
+
+// fakeFetcher is an IPRangeFetcher returning canned results.
+type fakeFetcher struct {
+	err    error
+	name   string
+	ranges []string
+}
+
+func (f *fakeFetcher) Name() string                     { return f.name }
+func (f *fakeFetcher) Description() string              { return "fake fetcher" }
+func (f *fakeFetcher) FetchIPRanges() ([]string, error) { return f.ranges, f.err }
+
+func TestResolver(t *testing.T) {
+	originalIPRanges := data.IPRanges
+	defer func() { data.IPRanges = originalIPRanges }()
+	data.IPRanges = map[string][]string{
+		"fake": {"203.0.113.0/24"},
+	}
+
+	fetcher := &fakeFetcher{name: "Fake", ranges: []string{"198.51.100.0/24"}}
+	resolver := NewResolver(zap.NewNop(), fetcher)
+	var refreshErrs []error
+	resolver.OnRefresh = func(source string, err error) {
+		require.Equal(t, "fake", source)
+		refreshErrs = append(refreshErrs, err)
+	}
+
+	t.Run("embedded data before refresh", func(t *testing.T) {
+		ranges, err := resolver.Resolve("fake")
+		require.NoError(t, err)
+		require.Equal(t, []string{"203.0.113.0/24"}, ranges)
+	})
+
+	t.Run("CIDR entries are passed through", func(t *testing.T) {
+		ranges, err := resolver.Resolve("10.0.0.0/8")
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.0.0/8"}, ranges)
+	})
+
+	t.Run("refresh replaces embedded data", func(t *testing.T) {
+		require.True(t, resolver.Refreshable("fake"))
+		require.True(t, resolver.Refresh([]string{"fake", "unknown"}))
+
+		ranges, err := resolver.Resolve("fake")
+		require.NoError(t, err)
+		require.Equal(t, []string{"198.51.100.0/24"}, ranges)
+	})
+
+	t.Run("unchanged refresh reports no change", func(t *testing.T) {
+		require.False(t, resolver.Refresh([]string{"fake"}))
+	})
+
+	t.Run("failed refresh falls back to embedded data", func(t *testing.T) {
+		fetcher.err = errors.New("upstream unavailable")
+		require.True(t, resolver.Refresh([]string{"fake"}))
+
+		ranges, err := resolver.Resolve("fake")
+		require.NoError(t, err)
+		require.Equal(t, []string{"203.0.113.0/24"}, ranges)
+	})
+
+	t.Run("empty refresh falls back to embedded data", func(t *testing.T) {
+		fetcher.err = nil
+		fetcher.ranges = nil
+		require.False(t, resolver.Refresh([]string{"fake"}))
+
+		ranges, err := resolver.Resolve("fake")
+		require.NoError(t, err)
+		require.Equal(t, []string{"203.0.113.0/24"}, ranges)
+	})
+
+	t.Run("refreshes are reported", func(t *testing.T) {
+		require.Len(t, refreshErrs, 4)
+		require.NoError(t, refreshErrs[0])
+		require.NoError(t, refreshErrs[1])
+		require.Error(t, refreshErrs[2])
+		require.ErrorIs(t, refreshErrs[3], errEmptyFetch)
+	})
+}
+
+func TestDefaultFetchersMatchEmbeddedKeys(t *testing.T) {
+	for _, f := range DefaultFetchers() {
+		_, ok := data.IPRanges[Key(f)]
+		require.True(t, ok, "fetcher %s has no embedded ranges under key %q", f.Name(), Key(f))
+	}
+}
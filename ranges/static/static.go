@@ -0,0 +1,14 @@
+// Package static resolves range entries against the embedded ranges, for callers that
+// don't have a sources.Resolver.
+package static
+
+import "pkg.jsn.cam/caddy-defender/ranges/data"
+
+// Resolve resolves predefined keys using the embedded data.IPRanges.
+// Entries that are not predefined keys are returned unchanged.
+func Resolve(entry string) ([]string, error) {
+	if ranges, ok := data.IPRanges[entry]; ok {
+		return ranges, nil
+	}
+	return []string{entry}, nil
+}
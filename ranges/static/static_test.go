@@ -0,0 +1,18 @@
+package static
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"pkg.jsn.cam/caddy-defender/ranges/data"
+)
+
+func TestResolve(t *testing.T) {
+	ranges, err := Resolve("openai")
+	require.NoError(t, err)
+	require.Equal(t, data.IPRanges["openai"], ranges)
+
+	ranges, err = Resolve("203.0.113.0/24")
+	require.NoError(t, err)
+	require.Equal(t, []string{"203.0.113.0/24"}, ranges)
+}
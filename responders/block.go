@@ -3,14 +3,41 @@ package responders
 import (
 	"net/http"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
+func init() {
+	caddy.RegisterModule(BlockResponder{})
+}
+
 // BlockResponder blocks the request with a 403 Forbidden response.
 type BlockResponder struct{}
 
+// CaddyModule returns the Caddy module information.
+func (BlockResponder) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  Namespace + ".block",
+		New: func() caddy.Module { return new(BlockResponder) },
+	}
+}
+
+// UnmarshalCaddyfile sets up the responder from Caddyfile tokens. Syntax:
+//
+//	block
+func (*BlockResponder) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return unmarshalBare(d)
+}
+
 func (b BlockResponder) ServeHTTP(w http.ResponseWriter, _ *http.Request, _ caddyhttp.Handler) error {
 	w.WriteHeader(http.StatusForbidden)
 	_, err := w.Write([]byte("Access denied"))
 	return err
 }
+
+// Interface guards
+var (
+	_ Responder             = (*BlockResponder)(nil)
+	_ caddyfile.Unmarshaler = (*BlockResponder)(nil)
+)
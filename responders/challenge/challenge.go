@@ -0,0 +1,389 @@
+// Package challenge implements the challenge responder, which lets browsers through once they
+// solve a proof-of-work puzzle, remembering them with a signed cookie.
+package challenge
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"math/bits"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"pkg.jsn.cam/caddy-defender/responders"
+)
+
+const (
+	// DefaultDifficulty is the number of leading zero bits solutions need by default.
+	DefaultDifficulty = 16
+	// MaxDifficulty bounds the difficulty, above which browsers take too long.
+	MaxDifficulty = 32
+	// DefaultDuration is how long a solved challenge is remembered by default.
+	DefaultDuration = caddy.Duration(24 * time.Hour)
+	// DefaultCookieName is the name of the cookie proving a solved challenge by default.
+	DefaultCookieName = "defender_challenge"
+	// MinKeyLength is the minimum length of signing keys in bytes.
+	MinKeyLength = 32
+
+	// HeaderChallenge and HeaderNonce carry a solution, posted by the challenge page.
+	HeaderChallenge = "X-Defender-Challenge"
+	HeaderNonce     = "X-Defender-Nonce"
+
+	// challengeTTL is how long a served challenge can be solved.
+	challengeTTL = 10 * time.Minute
+	// maxNonceLength bounds the length of submitted nonces.
+	maxNonceLength = 20
+)
+
+func init() {
+	caddy.RegisterModule(Responder{})
+}
+
+var (
+	//go:embed page.html
+	defaultPage string
+	//go:embed solver.js
+	solverJS string
+
+	defaultTemplate = template.Must(template.New("challenge").Parse(defaultPage))
+
+	// processKey signs cookies when no keys are configured. Its cookies don't survive
+	// restarts and aren't accepted by other instances.
+	processKey = sync.OnceValue(func() []byte {
+		key := make([]byte, MinKeyLength)
+		_, _ = rand.Read(key)
+		return key
+	})
+)
+
+// Config holds the challenge responder's configuration.
+type Config struct {
+	// Keys sign and verify the cookies of solved challenges. The first key signs new cookies
+	// and every key is accepted, so keys can be rotated by prepending a new one and dropping
+	// the oldest once its cookies have expired. Placeholders such as {env.CHALLENGE_KEY} are
+	// replaced. Keys must be at least 32 bytes long.
+	// Default: a random key, generated when Caddy starts
+	Keys []string `json:"keys,omitempty"`
+
+	// Template is the path of an html/template file rendering the challenge page. It must
+	// include {{.Script}} in a <script> element and may show {{.Difficulty}}. The script
+	// reports progress in the element with id "defender-status", if any.
+	// Default: a built-in page
+	Template string `json:"template,omitempty"`
+
+	// CookieName is the name of the cookie proving a solved challenge.
+	// Default: "defender_challenge"
+	CookieName string `json:"cookie_name,omitempty"`
+
+	// Duration is how long a solved challenge lets the client through.
+	// Default: 24h
+	Duration caddy.Duration `json:"duration,omitempty"`
+
+	// Difficulty is the number of leading zero bits the SHA-256 hash of a solution must have.
+	// Each bit doubles the work; 16 takes browsers well under a second.
+	// Default: 16
+	Difficulty int `json:"difficulty,omitempty"`
+}
+
+// Validate checks the difficulty and duration.
+func (c *Config) Validate() error {
+	if c.Difficulty < 0 || c.Difficulty > MaxDifficulty {
+		return fmt.Errorf("invalid challenge difficulty: %d (must be at most %d)", c.Difficulty, MaxDifficulty)
+	}
+	if c.Duration < 0 {
+		return fmt.Errorf("invalid challenge duration: %s", time.Duration(c.Duration))
+	}
+	return nil
+}
+
+// UnmarshalBlock parses the settings in the block at the dispenser's current token.
+func (c *Config) UnmarshalBlock(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		key := d.Val()
+		if key == "keys" {
+			keys := d.RemainingArgs()
+			if len(keys) == 0 {
+				return d.ArgErr()
+			}
+			c.Keys = append(c.Keys, keys...)
+			continue
+		}
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		switch key {
+		case "difficulty":
+			difficulty, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return fmt.Errorf("invalid difficulty value: '%s'", d.Val())
+			}
+			c.Difficulty = difficulty
+		case "duration":
+			duration, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return fmt.Errorf("invalid duration value: '%s'", d.Val())
+			}
+			c.Duration = caddy.Duration(duration)
+		case "template":
+			c.Template = d.Val()
+		case "cookie_name":
+			c.CookieName = d.Val()
+		default:
+			return d.Errf("unknown nested config key: %s", key)
+		}
+	}
+	return nil
+}
+
+// pageData is what the challenge page template is rendered with.
+type pageData struct {
+	// Script solves the challenge and reloads the page once the solution is accepted.
+	Script template.JS
+	// Difficulty is the number of leading zero bits solutions need.
+	Difficulty int
+}
+
+// Responder serves a proof-of-work challenge page to clients without a valid cookie, and lets
+// the clients that solved it through to the next handler. The cookie is bound to the client IP.
+type Responder struct {
+	*Config
+
+	page       *template.Template
+	now        func() time.Time
+	cookieName string
+	keys       [][]byte
+	duration   time.Duration
+	difficulty int
+}
+
+// CaddyModule returns the Caddy module information.
+func (Responder) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  responders.Namespace + ".challenge",
+		New: func() caddy.Module { return new(Responder) },
+	}
+}
+
+// UnmarshalCaddyfile sets up the responder from Caddyfile tokens. Syntax:
+//
+//	challenge {
+//	    difficulty <bits>
+//	    duration <duration>
+//	    keys <keys...>
+//	    template <path>
+//	    cookie_name <name>
+//	}
+func (r *Responder) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume responder name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	if r.Config == nil {
+		r.Config = new(Config)
+	}
+	return r.Config.UnmarshalBlock(d)
+}
+
+// Provision loads the keys and template.
+func (r *Responder) Provision(_ caddy.Context) error {
+	if r.Config == nil {
+		r.Config = new(Config)
+	}
+	cfg := r.Config
+
+	r.keys = nil
+	repl := caddy.NewReplacer()
+	for i, key := range cfg.Keys {
+		key = repl.ReplaceAll(key, "")
+		if len(key) < MinKeyLength {
+			return fmt.Errorf("challenge key %d is shorter than %d bytes", i+1, MinKeyLength)
+		}
+		r.keys = append(r.keys, []byte(key))
+	}
+	if len(r.keys) == 0 {
+		r.keys = [][]byte{processKey()}
+	}
+
+	r.page = defaultTemplate
+	if cfg.Template != "" {
+		page, err := template.ParseFiles(cfg.Template)
+		if err != nil {
+			return fmt.Errorf("parsing challenge template: %w", err)
+		}
+		r.page = page
+	}
+
+	r.cookieName = cmp.Or(cfg.CookieName, DefaultCookieName)
+	r.duration = time.Duration(cmp.Or(cfg.Duration, DefaultDuration))
+	r.difficulty = cmp.Or(cfg.Difficulty, DefaultDifficulty)
+	r.now = time.Now
+	return nil
+}
+
+func (r *Responder) ServeHTTP(w http.ResponseWriter, req *http.Request, next caddyhttp.Handler) error {
+	if r.page == nil {
+		return errors.New("challenge responder not provisioned")
+	}
+	addr := responders.ClientIP(req)
+	now := r.now()
+
+	if cookie, err := req.Cookie(r.cookieName); err == nil && r.validCookie(cookie.Value, addr, now) {
+		return next.ServeHTTP(w, req)
+	}
+	if req.Header.Get(HeaderChallenge) != "" {
+		return r.verify(w, req, addr, now)
+	}
+	return r.serveChallenge(w, addr, now)
+}
+
+// serveChallenge renders the challenge page with a new challenge for addr.
+func (r *Responder) serveChallenge(w http.ResponseWriter, addr netip.Addr, now time.Time) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("generating challenge: %w", err)
+	}
+	payload := fmt.Sprintf("%d|%d|%s|%x", now.Add(challengeTTL).Unix(), r.difficulty, addr, nonce)
+	params, err := json.Marshal(map[string]any{
+		"token":       r.sign("challenge", payload),
+		"difficulty":  r.difficulty,
+		"header":      HeaderChallenge,
+		"nonceHeader": HeaderNonce,
+	})
+	if err != nil {
+		return err
+	}
+
+	var page bytes.Buffer
+	data := pageData{
+		Script:     template.JS("var challenge = " + string(params) + ";\n" + solverJS),
+		Difficulty: r.difficulty,
+	}
+	if err := r.page.Execute(&page, data); err != nil {
+		return fmt.Errorf("rendering challenge page: %w", err)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	_, err = page.WriteTo(w)
+	return err
+}
+
+// verify checks a posted solution, and sets the cookie letting addr through if it is valid.
+func (r *Responder) verify(w http.ResponseWriter, req *http.Request, addr netip.Addr, now time.Time) error {
+	if !r.validSolution(req.Header.Get(HeaderChallenge), req.Header.Get(HeaderNonce), addr, now) {
+		w.WriteHeader(http.StatusForbidden)
+		_, err := w.Write([]byte("Invalid challenge solution"))
+		return err
+	}
+
+	expires := now.Add(r.duration)
+	http.SetCookie(w, &http.Cookie{
+		Name:     r.cookieName,
+		Value:    r.sign("cookie", fmt.Sprintf("%d|%s", expires.Unix(), addr)),
+		Path:     "/",
+		Expires:  expires,
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// validSolution reports whether nonce solves the challenge token served to addr.
+func (r *Responder) validSolution(token, nonce string, addr netip.Addr, now time.Time) bool {
+	if nonce == "" || len(nonce) > maxNonceLength {
+		return false
+	}
+	fields, ok := r.open("challenge", token, 4)
+	if !ok || !r.current(fields[0], now) || fields[1] != strconv.Itoa(r.difficulty) || fields[2] != addr.String() {
+		return false
+	}
+	return leadingZeros(sha256.Sum256([]byte(token+nonce))) >= r.difficulty
+}
+
+// validCookie reports whether a cookie value lets addr through.
+func (r *Responder) validCookie(value string, addr netip.Addr, now time.Time) bool {
+	fields, ok := r.open("cookie", value, 2)
+	return ok && r.current(fields[0], now) && fields[1] == addr.String()
+}
+
+// current reports whether the unix time expires is after now.
+func (r *Responder) current(expires string, now time.Time) bool {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	return err == nil && now.Before(time.Unix(unix, 0))
+}
+
+// sign returns payload and its signature with the first key, for the given purpose.
+func (r *Responder) sign(purpose, payload string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac(r.keys[0], purpose, payload))
+}
+
+// open verifies a value made by sign with any key, and returns the n fields of its payload.
+func (r *Responder) open(purpose, value string, n int) ([]string, bool) {
+	encoded, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, false
+	}
+	for _, key := range r.keys {
+		if subtle.ConstantTimeCompare(sig, mac(key, purpose, string(payload))) == 1 {
+			fields := strings.Split(string(payload), "|")
+			return fields, len(fields) == n
+		}
+	}
+	return nil, false
+}
+
+// mac returns the HMAC-SHA256 of payload for purpose, so signatures can't be reused across
+// purposes.
+func mac(key []byte, purpose, payload string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(purpose + "|" + payload))
+	return h.Sum(nil)
+}
+
+// leadingZeros returns the number of leading zero bits of hash.
+func leadingZeros(hash [sha256.Size]byte) int {
+	zeros := 0
+	for _, b := range hash {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*Responder)(nil)
+	_ caddy.Validator       = (*Responder)(nil)
+	_ caddyfile.Unmarshaler = (*Responder)(nil)
+)
@@ -0,0 +1,148 @@
+package challenge
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/require"
+	"pkg.jsn.cam/caddy-defender/responders"
+)
+
+const (
+	oldKey = "0123456789abcdef0123456789abcdef"
+	newKey = "fedcba9876543210fedcba9876543210"
+)
+
+var challengeParams = regexp.MustCompile(`var challenge = (\{.*?\});`)
+
+func newResponder(t *testing.T, cfg *Config) *Responder {
+	t.Helper()
+	require.NoError(t, cfg.Validate())
+	r := &Responder{Config: cfg}
+	require.NoError(t, r.Provision(caddy.Context{Context: context.Background()}))
+	return r
+}
+
+// serve sends a request from ip through r, with the given cookies and headers.
+func serve(t *testing.T, r *Responder, ip string, cookies []*http.Cookie, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/page", nil)
+	req = responders.WithMatch(req, responders.Match{ClientIP: netip.MustParseAddr(ip)})
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	recorder := httptest.NewRecorder()
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	require.NoError(t, r.ServeHTTP(recorder, req, next))
+	return recorder
+}
+
+// solve fetches the challenge page from ip and returns a solution to it.
+func solve(t *testing.T, r *Responder, ip string) http.Header {
+	t.Helper()
+	page := serve(t, r, ip, nil, nil)
+	require.Equal(t, http.StatusForbidden, page.Code)
+	require.Equal(t, "no-store", page.Header().Get("Cache-Control"))
+
+	match := challengeParams.FindStringSubmatch(page.Body.String())
+	require.NotNil(t, match)
+	var params struct {
+		Token      string `json:"token"`
+		Difficulty int    `json:"difficulty"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(match[1]), &params))
+
+	for nonce := 0; ; nonce++ {
+		n := strconv.Itoa(nonce)
+		if leadingZeros(sha256.Sum256([]byte(params.Token+n))) >= params.Difficulty {
+			return http.Header{HeaderChallenge: {params.Token}, HeaderNonce: {n}}
+		}
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	r := newResponder(t, &Config{Keys: []string{oldKey}, Difficulty: 8})
+
+	solution := solve(t, r, "203.0.113.1")
+	verified := serve(t, r, "203.0.113.1", nil, solution)
+	require.Equal(t, http.StatusNoContent, verified.Code)
+	cookies := verified.Result().Cookies()
+	require.Len(t, cookies, 1)
+	require.Equal(t, DefaultCookieName, cookies[0].Name)
+	require.True(t, cookies[0].HttpOnly)
+
+	require.Equal(t, http.StatusOK, serve(t, r, "203.0.113.1", cookies, nil).Code)
+	require.Equal(t, http.StatusForbidden, serve(t, r, "203.0.113.2", cookies, nil).Code, "cookies are bound to the IP")
+	require.Equal(t, http.StatusForbidden, serve(t, r, "203.0.113.2", nil, solution).Code,
+		"challenges are bound to the IP")
+
+	wrong := solution.Clone()
+	for nonce := 0; ; nonce++ {
+		n := strconv.Itoa(nonce)
+		if leadingZeros(sha256.Sum256([]byte(wrong.Get(HeaderChallenge)+n))) < 8 {
+			wrong.Set(HeaderNonce, n)
+			break
+		}
+	}
+	require.Equal(t, http.StatusForbidden, serve(t, r, "203.0.113.1", nil, wrong).Code)
+
+	r.now = func() time.Time { return time.Now().Add(25 * time.Hour) }
+	require.Equal(t, http.StatusForbidden, serve(t, r, "203.0.113.1", cookies, nil).Code, "cookies expire")
+	require.Equal(t, http.StatusForbidden, serve(t, r, "203.0.113.1", nil, solution).Code, "challenges expire")
+}
+
+func TestChallengeKeyRotation(t *testing.T) {
+	old := newResponder(t, &Config{Keys: []string{oldKey}, Difficulty: 4})
+	cookies := serve(t, old, "2001:db8::1", nil, solve(t, old, "2001:db8::1")).Result().Cookies()
+
+	rotated := newResponder(t, &Config{Keys: []string{newKey, oldKey}, Difficulty: 4})
+	require.Equal(t, http.StatusOK, serve(t, rotated, "2001:db8::1", cookies, nil).Code)
+
+	dropped := newResponder(t, &Config{Keys: []string{newKey}, Difficulty: 4})
+	require.Equal(t, http.StatusForbidden, serve(t, dropped, "2001:db8::1", cookies, nil).Code)
+}
+
+func TestChallengeTemplate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "challenge.html")
+	page := `<html><body><h1>Difficulty {{.Difficulty}}</h1><script>{{.Script}}</script></body></html>`
+	require.NoError(t, os.WriteFile(path, []byte(page), 0o600))
+
+	r := newResponder(t, &Config{Template: path, Difficulty: 4})
+	body := serve(t, r, "203.0.113.1", nil, nil).Body.String()
+	require.Contains(t, body, "<h1>Difficulty 4</h1>")
+	require.Contains(t, body, "var challenge = {")
+
+	bad := &Responder{Config: &Config{Template: filepath.Join(t.TempDir(), "missing.html")}}
+	require.ErrorContains(t, bad.Provision(caddy.Context{Context: context.Background()}), "parsing challenge template")
+}
+
+func TestChallengeConfig(t *testing.T) {
+	require.ErrorContains(t, (&Config{Difficulty: 33}).Validate(), "invalid challenge difficulty")
+	require.ErrorContains(t, (&Config{Duration: -1}).Validate(), "invalid challenge duration")
+
+	short := &Responder{Config: &Config{Keys: []string{"secret"}}}
+	require.ErrorContains(t, short.Provision(caddy.Context{Context: context.Background()}), "shorter than 32 bytes")
+
+	t.Setenv("DEFENDER_CHALLENGE_KEY", oldKey)
+	env := &Responder{Config: &Config{Keys: []string{"{env.DEFENDER_CHALLENGE_KEY}"}}}
+	require.NoError(t, env.Provision(caddy.Context{Context: context.Background()}))
+	require.Equal(t, []byte(oldKey), env.keys[0])
+}
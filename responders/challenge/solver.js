@@ -0,0 +1,104 @@
+(function () {
+  "use strict";
+
+  // SHA-256 round constants and initial hash values, from the fractional parts of the cube
+  // and square roots of the first primes. Implemented here because crypto.subtle is only
+  // available on HTTPS.
+  var K = [], H = [];
+  for (var n = 2, found = 0; found < 64; n++) {
+    var prime = true;
+    for (var f = 2; f * f <= n; f++) {
+      if (n % f === 0) {
+        prime = false;
+        break;
+      }
+    }
+    if (prime) {
+      if (found < 8) H[found] = fraction(Math.pow(n, 1 / 2));
+      K[found++] = fraction(Math.pow(n, 1 / 3));
+    }
+  }
+
+  function fraction(x) {
+    return ((x - Math.floor(x)) * 4294967296) | 0;
+  }
+
+  function rotr(x, bits) {
+    return (x >>> bits) | (x << (32 - bits));
+  }
+
+  // sha256 returns the hash of an ASCII string as eight 32-bit words.
+  function sha256(ascii) {
+    var words = [], length = ascii.length * 8, i;
+    ascii += "\x80";
+    while (ascii.length % 64 !== 56) ascii += "\x00";
+    for (i = 0; i < ascii.length; i++) {
+      words[i >> 2] |= ascii.charCodeAt(i) << (24 - (i % 4) * 8);
+    }
+    words.push((length / 4294967296) | 0, length | 0);
+
+    var hash = H.slice(0), w = [];
+    for (var j = 0; j < words.length; j += 16) {
+      var a = hash.slice(0);
+      for (i = 0; i < 64; i++) {
+        if (i < 16) {
+          w[i] = words[j + i] | 0;
+        } else {
+          var w15 = w[i - 15], w2 = w[i - 2];
+          var s0 = rotr(w15, 7) ^ rotr(w15, 18) ^ (w15 >>> 3);
+          var s1 = rotr(w2, 17) ^ rotr(w2, 19) ^ (w2 >>> 10);
+          w[i] = (w[i - 16] + s0 + w[i - 7] + s1) | 0;
+        }
+        var e = a[4], x = a[0];
+        var t1 = (a[7] + (rotr(e, 6) ^ rotr(e, 11) ^ rotr(e, 25)) + ((e & a[5]) ^ (~e & a[6])) + K[i] + w[i]) | 0;
+        var t2 = ((rotr(x, 2) ^ rotr(x, 13) ^ rotr(x, 22)) + ((x & a[1]) ^ (x & a[2]) ^ (a[1] & a[2]))) | 0;
+        a = [(t1 + t2) | 0, a[0], a[1], a[2], (a[3] + t1) | 0, a[4], a[5], a[6]];
+      }
+      for (i = 0; i < 8; i++) hash[i] = (hash[i] + a[i]) | 0;
+    }
+    return hash;
+  }
+
+  function leadingZeros(hash) {
+    var zeros = 0;
+    for (var i = 0; i < hash.length; i++) {
+      var z = Math.clz32(hash[i]);
+      zeros += z;
+      if (z < 32) break;
+    }
+    return zeros;
+  }
+
+  function status(text) {
+    var el = document.getElementById("defender-status");
+    if (el) el.textContent = text;
+  }
+
+  function submit(nonce) {
+    status("Verifying…");
+    var headers = {};
+    headers[challenge.header] = challenge.token;
+    headers[challenge.nonceHeader] = nonce;
+    fetch(location.href, { method: "POST", headers: headers, credentials: "same-origin" })
+      .then(function (res) {
+        if (!res.ok) throw new Error(res.status);
+        location.reload();
+      })
+      .catch(function () {
+        status("Verification failed, please reload the page.");
+      });
+  }
+
+  var nonce = 0;
+  function work() {
+    for (var end = nonce + 5000; nonce < end; nonce++) {
+      if (leadingZeros(sha256(challenge.token + nonce)) >= challenge.difficulty) {
+        submit(String(nonce));
+        return;
+      }
+    }
+    setTimeout(work, 0);
+  }
+
+  work();
+})();
@@ -1,11 +1,19 @@
 package responders
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
+func init() {
+	caddy.RegisterModule(CustomResponder{})
+}
+
 // CustomResponder returns a custom response with configurable message and status code.
 type CustomResponder struct {
 	// Message is the custom response message to return to clients.
@@ -17,6 +25,50 @@ type CustomResponder struct {
 	StatusCode int `json:"status_code,omitempty"`
 }
 
+// CaddyModule returns the Caddy module information.
+func (CustomResponder) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  Namespace + ".custom",
+		New: func() caddy.Module { return new(CustomResponder) },
+	}
+}
+
+// UnmarshalCaddyfile sets up the responder from Caddyfile tokens. Syntax:
+//
+//	custom [<message>] {
+//	    message <message>
+//	    status_code <code>
+//	}
+func (c *CustomResponder) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume responder name
+	if d.NextArg() {
+		c.Message = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		key := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		switch key {
+		case "message":
+			c.Message = d.Val()
+		case "status_code":
+			statusCode, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return fmt.Errorf("invalid status_code value: '%s'", d.Val())
+			}
+			c.StatusCode = statusCode
+		default:
+			return d.Errf("unknown subdirective '%s'", key)
+		}
+	}
+	return nil
+}
+
 func (c CustomResponder) ServeHTTP(w http.ResponseWriter, _ *http.Request, _ caddyhttp.Handler) error {
 	// Use default status code if not specified
 	statusCode := c.StatusCode
@@ -29,3 +81,9 @@ func (c CustomResponder) ServeHTTP(w http.ResponseWriter, _ *http.Request, _ cad
 	_, err := w.Write([]byte(c.Message))
 	return err
 }
+
+// Interface guards
+var (
+	_ Responder             = (*CustomResponder)(nil)
+	_ caddyfile.Unmarshaler = (*CustomResponder)(nil)
+)
@@ -3,12 +3,39 @@ package responders
 import (
 	"net/http"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
+func init() {
+	caddy.RegisterModule(DropResponder{})
+}
+
 // DropResponder drops the connection.
 type DropResponder struct{}
 
+// CaddyModule returns the Caddy module information.
+func (DropResponder) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  Namespace + ".drop",
+		New: func() caddy.Module { return new(DropResponder) },
+	}
+}
+
+// UnmarshalCaddyfile sets up the responder from Caddyfile tokens. Syntax:
+//
+//	drop
+func (*DropResponder) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return unmarshalBare(d)
+}
+
 func (d *DropResponder) ServeHTTP(w http.ResponseWriter, _ *http.Request, _ caddyhttp.Handler) error {
 	panic(http.ErrAbortHandler)
 }
+
+// Interface guards
+var (
+	_ Responder             = (*DropResponder)(nil)
+	_ caddyfile.Unmarshaler = (*DropResponder)(nil)
+)
@@ -6,12 +6,33 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
+func init() {
+	caddy.RegisterModule(GarbageResponder{})
+}
+
 // GarbageResponder returns garbage data to the client.
 type GarbageResponder struct{}
 
+// CaddyModule returns the Caddy module information.
+func (GarbageResponder) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  Namespace + ".garbage",
+		New: func() caddy.Module { return new(GarbageResponder) },
+	}
+}
+
+// UnmarshalCaddyfile sets up the responder from Caddyfile tokens. Syntax:
+//
+//	garbage
+func (*GarbageResponder) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return unmarshalBare(d)
+}
+
 func (g GarbageResponder) ServeHTTP(w http.ResponseWriter, _ *http.Request, _ caddyhttp.Handler) error {
 	garbage := generateTerribleText(100)
 	w.Header().Set("Content-Type", "text/plain")
@@ -20,6 +41,12 @@ func (g GarbageResponder) ServeHTTP(w http.ResponseWriter, _ *http.Request, _ ca
 	return err
 }
 
+// Interface guards
+var (
+	_ Responder             = (*GarbageResponder)(nil)
+	_ caddyfile.Unmarshaler = (*GarbageResponder)(nil)
+)
+
 var (
 	// A mix of characters, symbols, and numbers to create irregularity
 	characters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!@#$%^&*()_+-=[]{};':\",./<>?\\|`~")
@@ -0,0 +1,44 @@
+package responders
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+// matchKey is the context key of the Match a responder is handling.
+type matchKey struct{}
+
+// Match describes the blocked request a responder is handling.
+type Match struct {
+	// ClientIP is the client address the request was matched by.
+	ClientIP netip.Addr
+	// Groups are the range groups the request matched, e.g. "openai" or "ban".
+	Groups []string
+}
+
+// WithMatch returns a copy of r carrying match for the responder.
+func WithMatch(r *http.Request, match Match) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), matchKey{}, match))
+}
+
+// MatchFrom returns the Match carried by r, if any.
+func MatchFrom(r *http.Request) (Match, bool) {
+	match, ok := r.Context().Value(matchKey{}).(Match)
+	return match, ok
+}
+
+// ClientIP returns the client address r was matched by, or the address of its peer for
+// requests not matched by the defender handler.
+func ClientIP(r *http.Request) netip.Addr {
+	if match, ok := MatchFrom(r); ok {
+		return match.ClientIP
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
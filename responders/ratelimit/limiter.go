@@ -0,0 +1,150 @@
+package ratelimit
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+// maxClients bounds the number of clients whose usage is tracked. Beyond it, the least
+// recently seen client is forgotten.
+const maxClients = 100_000
+
+// sweepInterval is the minimum time between removals of idle clients.
+const sweepInterval = time.Minute
+
+// usage is a client's consumption of its limit.
+type usage struct {
+	// key identifies the client in limiter.clients.
+	key string
+	// last is when the client last made a request.
+	last time.Time
+	// start is the start of the current window, for sliding windows.
+	start time.Time
+	// tokens is the number of requests left, for token buckets.
+	tokens float64
+	// window is the window of the client's limit.
+	window time.Duration
+	// previous and current count the requests of the previous and current windows, for
+	// sliding windows.
+	previous int
+	current  int
+}
+
+// limiter tracks the usage of clients. It is safe for concurrent use.
+type limiter struct {
+	lastSweep time.Time
+	// clients holds the elements of recent, whose values are the clients' *usage.
+	clients map[string]*list.Element
+	// recent orders the clients from the most to the least recently seen.
+	recent     *list.List
+	now        func() time.Time
+	maxClients int
+	mu         sync.Mutex
+}
+
+// newLimiter returns a limiter tracking no clients.
+func newLimiter() *limiter {
+	return &limiter{
+		clients:    make(map[string]*list.Element),
+		recent:     list.New(),
+		now:        time.Now,
+		maxClients: maxClients,
+	}
+}
+
+// Destruct lets limiters be shared through a caddy.UsagePool.
+func (l *limiter) Destruct() error {
+	return nil
+}
+
+// allow counts a request from the client identified by key against limit, and reports
+// whether it is within the limit. Otherwise it returns how long the client should wait.
+// Once too many clients are tracked, the least recently seen one is forgotten, so a flood of
+// new (possibly spoofed) clients can't lock out the others.
+func (l *limiter) allow(key string, limit Limit) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	var u *usage
+	if elem, ok := l.clients[key]; ok {
+		l.recent.MoveToFront(elem)
+		u = elem.Value.(*usage)
+	} else {
+		if len(l.clients) >= l.maxClients {
+			l.remove(l.recent.Back())
+		}
+		u = &usage{key: key, last: now, start: now, tokens: float64(limit.Events)}
+		l.clients[key] = l.recent.PushFront(u)
+	}
+	u.window = time.Duration(limit.Window)
+	if limit.Algorithm == AlgorithmSlidingWindow {
+		return u.slidingWindow(now, limit)
+	}
+	return u.tokenBucket(now, limit)
+}
+
+// tokenBucket refills the bucket at Events per Window, up to Events, and takes a token.
+func (u *usage) tokenBucket(now time.Time, limit Limit) (bool, time.Duration) {
+	rate := float64(limit.Events) / float64(limit.Window)
+	u.tokens = math.Min(float64(limit.Events), u.tokens+float64(now.Sub(u.last))*rate)
+	u.last = now
+	if u.tokens >= 1 {
+		u.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - u.tokens) / rate)
+}
+
+// slidingWindow estimates the requests of the last Window by weighting the previous window's
+// count by its overlap with it, and counts the request if the estimate stays within Events.
+func (u *usage) slidingWindow(now time.Time, limit Limit) (bool, time.Duration) {
+	window := time.Duration(limit.Window)
+	if elapsed := now.Sub(u.start); elapsed >= window {
+		u.previous = u.current
+		if elapsed >= 2*window {
+			u.previous = 0
+		}
+		u.current = 0
+		u.start = u.start.Add(elapsed.Truncate(window))
+	}
+	u.last = now
+
+	elapsed := now.Sub(u.start)
+	weight := 1 - float64(elapsed)/float64(window)
+	if float64(u.previous)*weight+float64(u.current) < float64(limit.Events) {
+		u.current++
+		return true, 0
+	}
+
+	// Wait for enough of the previous window to slide out, or for the current one to end.
+	// The previous window can't be empty if the current one has room left.
+	wait := window - elapsed + 1
+	if u.current < limit.Events {
+		free := float64(limit.Events - u.current)
+		wait = time.Duration((1-free/float64(u.previous))*float64(window)) - elapsed + 1
+	}
+	return false, wait
+}
+
+// sweep removes the clients idle for two windows, whose usage no longer counts. l.mu must
+// be held.
+func (l *limiter) sweep(now time.Time) {
+	for _, elem := range l.clients {
+		if u := elem.Value.(*usage); now.Sub(u.last) >= 2*u.window {
+			l.remove(elem)
+		}
+	}
+	l.lastSweep = now
+}
+
+// remove forgets the client of elem. l.mu must be held.
+func (l *limiter) remove(elem *list.Element) {
+	delete(l.clients, elem.Value.(*usage).key)
+	l.recent.Remove(elem)
+}
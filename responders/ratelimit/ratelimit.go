@@ -0,0 +1,332 @@
+// Package ratelimit implements the ratelimit responder, which lets matched clients through
+// at a limited rate and answers the excess with 429 Too Many Requests.
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"pkg.jsn.cam/caddy-defender/responders"
+)
+
+const (
+	// AlgorithmTokenBucket lets clients burst up to Events requests, refilled at Events per Window.
+	AlgorithmTokenBucket = "token_bucket"
+	// AlgorithmSlidingWindow lets clients make Events requests in any Window.
+	AlgorithmSlidingWindow = "sliding_window"
+
+	// DefaultEvents is the number of requests allowed per window by default.
+	DefaultEvents = 10
+	// DefaultWindow is the window of the limits by default.
+	DefaultWindow = caddy.Duration(time.Minute)
+)
+
+func init() {
+	caddy.RegisterModule(Responder{})
+}
+
+// limiters holds the usage of clients, keyed by the hash of the Config it is counted
+// against. Responders with identical configurations share it, including across reloads.
+var limiters = caddy.NewUsagePool()
+
+// Limit is a number of requests allowed per window.
+type Limit struct {
+	// Algorithm is "token_bucket" or "sliding_window".
+	// Default: "token_bucket"
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// Window is the period the requests are counted over.
+	// Default: 1m
+	Window caddy.Duration `json:"window,omitempty"`
+
+	// Events is the number of requests allowed per window. With a token bucket, it is also
+	// the largest burst.
+	// Default: 10
+	Events int `json:"events,omitempty"`
+}
+
+// validate checks the algorithm and bounds of the limit.
+func (l Limit) validate() error {
+	switch l.Algorithm {
+	case "", AlgorithmTokenBucket, AlgorithmSlidingWindow:
+	default:
+		return fmt.Errorf("invalid rate limit algorithm: %s", l.Algorithm)
+	}
+	if l.Events < 0 {
+		return fmt.Errorf("invalid rate limit events: %d", l.Events)
+	}
+	if l.Window < 0 {
+		return fmt.Errorf("invalid rate limit window: %s", time.Duration(l.Window))
+	}
+	return nil
+}
+
+// inherit fills in the unset settings of l from parent.
+func (l Limit) inherit(parent Limit) Limit {
+	if l.Algorithm == "" {
+		l.Algorithm = parent.Algorithm
+	}
+	if l.Window == 0 {
+		l.Window = parent.Window
+	}
+	if l.Events == 0 {
+		l.Events = parent.Events
+	}
+	return l
+}
+
+// Config holds the ratelimit responder's configuration.
+type Config struct {
+	// Groups overrides the limit for requests matching a range group, e.g. "openai". Unset
+	// settings are taken from the default limit. Each group counts requests separately.
+	Groups map[string]Limit `json:"groups,omitempty"`
+
+	// Limit is the default limit.
+	Limit
+
+	// IPv4Prefix is the length of the prefix IPv4 clients are limited by, e.g. 24 to share a
+	// limit across a /24.
+	// Default: 32
+	IPv4Prefix int `json:"ipv4_prefix,omitempty"`
+
+	// IPv6Prefix is the length of the prefix IPv6 clients are limited by, e.g. 64.
+	// Default: 128
+	IPv6Prefix int `json:"ipv6_prefix,omitempty"`
+}
+
+// Validate checks the limits and prefix lengths.
+func (c *Config) Validate() error {
+	if err := c.Limit.validate(); err != nil {
+		return err
+	}
+	for group, limit := range c.Groups {
+		if err := limit.validate(); err != nil {
+			return fmt.Errorf("rate limit group %s: %w", group, err)
+		}
+	}
+	if c.IPv4Prefix < 0 || c.IPv4Prefix > 32 {
+		return fmt.Errorf("invalid rate limit ipv4_prefix: %d", c.IPv4Prefix)
+	}
+	if c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		return fmt.Errorf("invalid rate limit ipv6_prefix: %d", c.IPv6Prefix)
+	}
+	return nil
+}
+
+// UnmarshalBlock parses the settings in the block at the dispenser's current token.
+func (c *Config) UnmarshalBlock(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch key := d.Val(); key {
+		case "ipv4_prefix", "ipv6_prefix":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			bits, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return fmt.Errorf("invalid %s value: '%s'", key, d.Val())
+			}
+			if key == "ipv4_prefix" {
+				c.IPv4Prefix = bits
+			} else {
+				c.IPv6Prefix = bits
+			}
+		case "group":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			group := d.Val()
+			var limit Limit
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				if err := limit.unmarshalSetting(d); err != nil {
+					return err
+				}
+			}
+			if c.Groups == nil {
+				c.Groups = make(map[string]Limit)
+			}
+			c.Groups[group] = limit
+		default:
+			if err := c.Limit.unmarshalSetting(d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalSetting parses the limit setting at the dispenser's current token.
+func (l *Limit) unmarshalSetting(d *caddyfile.Dispenser) error {
+	key := d.Val()
+	switch key {
+	case "algorithm", "events", "window":
+	default:
+		return d.Errf("unknown nested config key: %s", key)
+	}
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+
+	switch key {
+	case "algorithm":
+		l.Algorithm = d.Val()
+	case "events":
+		events, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return fmt.Errorf("invalid events value: '%s'", d.Val())
+		}
+		l.Events = events
+	case "window":
+		window, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return fmt.Errorf("invalid duration value: '%s'", d.Val())
+		}
+		l.Window = caddy.Duration(window)
+	}
+	return nil
+}
+
+// withDefaults returns a copy of c with the unset settings defaulted.
+func (c *Config) withDefaults() Config {
+	cfg := *c
+	cfg.Limit = cfg.Limit.inherit(Limit{Algorithm: AlgorithmTokenBucket, Window: DefaultWindow, Events: DefaultEvents})
+	if cfg.IPv4Prefix == 0 {
+		cfg.IPv4Prefix = 32
+	}
+	if cfg.IPv6Prefix == 0 {
+		cfg.IPv6Prefix = 128
+	}
+	return cfg
+}
+
+// Responder passes requests to the next handler while the client is within its limit, and
+// responds with 429 Too Many Requests and a Retry-After header once it is exceeded.
+type Responder struct {
+	*Config
+
+	limiter *limiter
+	cfg     Config
+	key     string
+}
+
+// CaddyModule returns the Caddy module information.
+func (Responder) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  responders.Namespace + ".ratelimit",
+		New: func() caddy.Module { return new(Responder) },
+	}
+}
+
+// UnmarshalCaddyfile sets up the responder from Caddyfile tokens. Syntax:
+//
+//	ratelimit {
+//	    algorithm <token_bucket|sliding_window>
+//	    events <requests>
+//	    window <duration>
+//	    ipv4_prefix <bits>
+//	    ipv6_prefix <bits>
+//	    group <name> {
+//	        algorithm <token_bucket|sliding_window>
+//	        events <requests>
+//	        window <duration>
+//	    }
+//	}
+func (r *Responder) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume responder name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	if r.Config == nil {
+		r.Config = new(Config)
+	}
+	return r.Config.UnmarshalBlock(d)
+}
+
+// Provision loads the usage shared by the responders with the same configuration.
+func (r *Responder) Provision(_ caddy.Context) error {
+	if r.Config == nil {
+		r.Config = new(Config)
+	}
+	r.cfg = r.Config.withDefaults()
+
+	b, err := json.Marshal(r.cfg)
+	if err != nil {
+		return fmt.Errorf("encoding rate limit config: %w", err)
+	}
+	sum := sha256.Sum256(b)
+	r.key = hex.EncodeToString(sum[:])
+	val, _, err := limiters.LoadOrNew(r.key, func() (caddy.Destructor, error) {
+		return newLimiter(), nil
+	})
+	if err != nil {
+		return err
+	}
+	r.limiter = val.(*limiter)
+	return nil
+}
+
+// Cleanup releases the shared usage.
+func (r *Responder) Cleanup() error {
+	if r.key == "" {
+		return nil
+	}
+	_, err := limiters.Delete(r.key)
+	r.key = ""
+	return err
+}
+
+func (r *Responder) ServeHTTP(w http.ResponseWriter, req *http.Request, next caddyhttp.Handler) error {
+	if r.limiter == nil {
+		return errors.New("rate limit responder not provisioned")
+	}
+	match, _ := responders.MatchFrom(req)
+	group, limit := r.limitFor(match.Groups)
+	allowed, wait := r.limiter.allow(group+" "+r.prefix(responders.ClientIP(req)).String(), limit)
+	if allowed {
+		return next.ServeHTTP(w, req)
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	_, err := w.Write([]byte("Too many requests"))
+	return err
+}
+
+// limitFor returns the first of groups with its own limit along with the limit, or the
+// default limit.
+func (r *Responder) limitFor(groups []string) (string, Limit) {
+	for _, group := range groups {
+		if limit, ok := r.cfg.Groups[group]; ok {
+			return group, limit.inherit(r.cfg.Limit)
+		}
+	}
+	return "", r.cfg.Limit
+}
+
+// prefix returns the prefix addr is limited by.
+func (r *Responder) prefix(addr netip.Addr) netip.Prefix {
+	bits := r.cfg.IPv6Prefix
+	if addr.Is4() {
+		bits = r.cfg.IPv4Prefix
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*Responder)(nil)
+	_ caddy.Validator       = (*Responder)(nil)
+	_ caddy.CleanerUpper    = (*Responder)(nil)
+	_ caddyfile.Unmarshaler = (*Responder)(nil)
+)
@@ -0,0 +1,178 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/require"
+	"pkg.jsn.cam/caddy-defender/responders"
+)
+
+// clock is a manually advanced time source.
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func TestTokenBucket(t *testing.T) {
+	c := &clock{now: time.Unix(1_700_000_000, 0)}
+	l := newLimiter()
+	l.now = c.Now
+	limit := Limit{Algorithm: AlgorithmTokenBucket, Window: caddy.Duration(time.Minute), Events: 3}
+
+	for range 3 {
+		allowed, _ := l.allow("client", limit)
+		require.True(t, allowed)
+	}
+	allowed, wait := l.allow("client", limit)
+	require.False(t, allowed)
+	require.Equal(t, 20*time.Second, wait)
+
+	allowed, _ = l.allow("other", limit)
+	require.True(t, allowed, "clients are limited separately")
+
+	c.now = c.now.Add(20 * time.Second)
+	allowed, _ = l.allow("client", limit)
+	require.True(t, allowed, "a token is refilled every window/events")
+	allowed, _ = l.allow("client", limit)
+	require.False(t, allowed)
+}
+
+func TestSlidingWindow(t *testing.T) {
+	c := &clock{now: time.Unix(1_700_000_000, 0)}
+	l := newLimiter()
+	l.now = c.Now
+	limit := Limit{Algorithm: AlgorithmSlidingWindow, Window: caddy.Duration(time.Minute), Events: 4}
+
+	for range 4 {
+		allowed, _ := l.allow("client", limit)
+		require.True(t, allowed)
+	}
+	allowed, wait := l.allow("client", limit)
+	require.False(t, allowed)
+	require.Equal(t, time.Minute+1, wait)
+
+	// A second into the next window, 59/60 of the previous window's requests still count.
+	c.now = c.now.Add(61 * time.Second)
+	allowed, _ = l.allow("client", limit)
+	require.True(t, allowed)
+	allowed, wait = l.allow("client", limit)
+	require.False(t, allowed)
+	require.Equal(t, 14*time.Second+1, wait, "a quarter of the previous window must slide out")
+
+	c.now = c.now.Add(wait)
+	allowed, _ = l.allow("client", limit)
+	require.True(t, allowed)
+
+	// Idle clients are forgotten after two windows.
+	c.now = c.now.Add(3 * time.Minute)
+	allowed, _ = l.allow("other", limit)
+	require.True(t, allowed)
+	require.NotContains(t, l.clients, "client")
+}
+
+func TestClientCap(t *testing.T) {
+	l := newLimiter()
+	l.maxClients = 2
+	limit := Limit{Algorithm: AlgorithmTokenBucket, Window: caddy.Duration(time.Minute), Events: 1}
+
+	for _, key := range []string{"first", "second"} {
+		allowed, _ := l.allow(key, limit)
+		require.True(t, allowed)
+	}
+	allowed, _ := l.allow("first", limit)
+	require.False(t, allowed, "first is now the most recently seen client")
+
+	allowed, _ = l.allow("third", limit)
+	require.True(t, allowed, "new clients aren't limited once the cap is reached")
+	require.Len(t, l.clients, 2)
+	require.NotContains(t, l.clients, "second", "the least recently seen client is forgotten")
+	require.Contains(t, l.clients, "first")
+}
+
+func TestResponder(t *testing.T) {
+	cfg := &Config{
+		Limit:      Limit{Events: 1, Window: caddy.Duration(time.Hour)},
+		Groups:     map[string]Limit{"openai": {Events: 2}},
+		IPv4Prefix: 24,
+	}
+	require.NoError(t, cfg.Validate())
+
+	responder := &Responder{Config: cfg}
+	require.NoError(t, responder.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, responder.Cleanup()) }()
+
+	// A second responder with the same configuration shares the usage.
+	shared := &Responder{Config: &Config{Limit: cfg.Limit, Groups: cfg.Groups, IPv4Prefix: 24}}
+	require.NoError(t, shared.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, shared.Cleanup()) }()
+	require.Same(t, responder.limiter, shared.limiter)
+
+	serve := func(r *Responder, ip string, groups ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = responders.WithMatch(req, responders.Match{ClientIP: netip.MustParseAddr(ip), Groups: groups})
+		recorder := httptest.NewRecorder()
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+			w.WriteHeader(http.StatusOK)
+			return nil
+		})
+		require.NoError(t, r.ServeHTTP(recorder, req, next))
+		return recorder
+	}
+
+	require.Equal(t, http.StatusOK, serve(responder, "203.0.113.1").Code)
+	recorder := serve(shared, "203.0.113.2")
+	require.Equal(t, http.StatusTooManyRequests, recorder.Code, "the /24 shares a limit")
+	require.Equal(t, "3600", recorder.Header().Get("Retry-After"))
+
+	require.Equal(t, http.StatusOK, serve(responder, "203.0.113.1", "openai").Code, "groups are counted separately")
+	require.Equal(t, http.StatusOK, serve(responder, "203.0.113.1", "openai").Code)
+	require.Equal(t, http.StatusTooManyRequests, serve(responder, "203.0.113.1", "openai").Code)
+
+	require.Equal(t, http.StatusOK, serve(responder, "198.51.100.1").Code)
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         Config
+		errContains string
+	}{
+		{name: "defaults"},
+		{
+			name:        "unknown algorithm",
+			cfg:         Config{Limit: Limit{Algorithm: "leaky_bucket"}},
+			errContains: "invalid rate limit algorithm",
+		},
+		{
+			name:        "negative group events",
+			cfg:         Config{Groups: map[string]Limit{"openai": {Events: -1}}},
+			errContains: "rate limit group openai",
+		},
+		{
+			name:        "ipv6 prefix too long",
+			cfg:         Config{IPv6Prefix: 129},
+			errContains: "invalid rate limit ipv6_prefix",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if tt.errContains == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tt.errContains)
+		})
+	}
+}
@@ -1,17 +1,75 @@
 package responders
 
 import (
+	"errors"
 	"net/http"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
+func init() {
+	caddy.RegisterModule(RedirectResponder{})
+}
+
 // RedirectResponder redirects a request with a 308 permanent redirect response.
 type RedirectResponder struct {
-	URL string
+	// URL is where clients are redirected to.
+	// Required.
+	URL string `json:"url"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (RedirectResponder) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  Namespace + ".redirect",
+		New: func() caddy.Module { return new(RedirectResponder) },
+	}
+}
+
+// UnmarshalCaddyfile sets up the responder from Caddyfile tokens. Syntax:
+//
+//	redirect [<url>] {
+//	    url <url>
+//	}
+func (r *RedirectResponder) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume responder name
+	if d.NextArg() {
+		r.URL = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() != "url" {
+			return d.Errf("unknown subdirective '%s'", d.Val())
+		}
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		r.URL = d.Val()
+	}
+	return nil
+}
+
+// Validate checks that the URL is set.
+func (r *RedirectResponder) Validate() error {
+	if r.URL == "" {
+		return errors.New("redirect responder requires 'url' to be set")
+	}
+	return nil
 }
 
 func (r *RedirectResponder) ServeHTTP(w http.ResponseWriter, req *http.Request, _ caddyhttp.Handler) error {
 	http.Redirect(w, req, r.URL, http.StatusPermanentRedirect)
 	return nil
 }
+
+// Interface guards
+var (
+	_ Responder             = (*RedirectResponder)(nil)
+	_ caddy.Validator       = (*RedirectResponder)(nil)
+	_ caddyfile.Unmarshaler = (*RedirectResponder)(nil)
+)
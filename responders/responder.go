@@ -3,10 +3,37 @@ package responders
 import (
 	"net/http"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
+// Namespace is the Caddy module namespace of responders. A responder module named
+// "http.handlers.defender.responders.<name>" can be used by the defender handler as <name>.
+const Namespace = "http.handlers.defender.responders"
+
 // Responder defines the interface for handling responses.
 type Responder interface {
 	ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error
 }
+
+// Lookup returns the module of the responder named name.
+func Lookup(name string) (caddy.ModuleInfo, bool) {
+	module, err := caddy.GetModule(Namespace + "." + name)
+	if err != nil {
+		return caddy.ModuleInfo{}, false
+	}
+	return module, true
+}
+
+// unmarshalBare parses the Caddyfile tokens of a responder without settings.
+func unmarshalBare(d *caddyfile.Dispenser) error {
+	d.Next() // consume responder name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	if d.NextBlock(0) {
+		return d.Errf("unknown subdirective '%s'", d.Val())
+	}
+	return nil
+}
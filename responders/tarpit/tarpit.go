@@ -5,10 +5,15 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"pkg.jsn.cam/caddy-defender/cache"
+	"pkg.jsn.cam/caddy-defender/responders"
 )
 
 const (
@@ -16,8 +21,19 @@ const (
 	contentProtocolHTTP  = "http"
 	contentProtocolHTTPS = "https"
 	tarpitCacheDirectory = "tarpit"
+
+	// DefaultTimeout is the default duration for a request to be closed after.
+	DefaultTimeout = 30 * time.Second
+	// DefaultBytesPerSecond is the default amount of bytes to stream per second.
+	DefaultBytesPerSecond = 24
+	// DefaultResponseCode is the default HTTP response code.
+	DefaultResponseCode = http.StatusOK
 )
 
+func init() {
+	caddy.RegisterModule(Responder{})
+}
+
 // ContentReader is an interface for fetching data from different data Contents to supply data to the tarpit.
 type ContentReader interface {
 	Read() (io.ReadCloser, error)
@@ -39,6 +55,87 @@ type Config struct {
 	ResponseCode   int           `json:"code"`
 }
 
+// SetDefaults fills in the unset settings.
+func (c *Config) SetDefaults() {
+	if c.Timeout == 0 {
+		c.Timeout = DefaultTimeout
+	}
+	if c.BytesPerSecond == 0 {
+		c.BytesPerSecond = DefaultBytesPerSecond
+	}
+	if c.ResponseCode == 0 {
+		c.ResponseCode = DefaultResponseCode
+	}
+}
+
+// UnmarshalBlock parses the settings in the block at the dispenser's current token.
+func (c *Config) UnmarshalBlock(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "headers":
+			headers := map[string]string{}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				k := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				headers[k] = d.Val()
+			}
+			c.Headers = headers
+		case "content":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+
+			content := strings.Split(d.Val(), "://")
+			if len(content) != 2 {
+				return errors.New("invalid content format. expected <content protocol>://<content path>")
+			}
+
+			c.Content = Content{
+				Protocol: content[0],
+				Path:     content[1],
+			}
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+
+			timeout, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return fmt.Errorf("invalid timeout value: '%s'", d.Val())
+			}
+
+			c.Timeout = timeout
+		case "bytes_per_second":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+
+			bps, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return fmt.Errorf("invalid bytes_per_second value: '%s'", d.Val())
+			}
+
+			c.BytesPerSecond = bps
+		case "response_code":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+
+			responseCode, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return fmt.Errorf("invalid response_code value: '%s'", d.Val())
+			}
+
+			c.ResponseCode = responseCode
+		default:
+			return d.Errf("unknown nested config key: %s", d.Val())
+		}
+	}
+	return nil
+}
+
 // ConfigureContentReader checks the content protocol configuration
 // and configures the appropriate content reader for the tarpit responder.
 func (r *Responder) ConfigureContentReader() error {
@@ -82,8 +179,47 @@ func (r *Responder) ConfigureContentReader() error {
 
 // Responder returns a custom response.
 type Responder struct {
-	Config        *Config
-	ContentReader ContentReader
+	*Config
+	ContentReader ContentReader `json:"-"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (Responder) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  responders.Namespace + ".tarpit",
+		New: func() caddy.Module { return new(Responder) },
+	}
+}
+
+// UnmarshalCaddyfile sets up the responder from Caddyfile tokens. Syntax:
+//
+//	tarpit {
+//	    headers {
+//	        <name> <value>
+//	    }
+//	    content <protocol>://<path>
+//	    timeout <duration>
+//	    bytes_per_second <bytes>
+//	    response_code <code>
+//	}
+func (r *Responder) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume responder name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	if r.Config == nil {
+		r.Config = new(Config)
+	}
+	return r.Config.UnmarshalBlock(d)
+}
+
+// Provision fills in the unset settings and configures the content reader.
+func (r *Responder) Provision(_ caddy.Context) error {
+	if r.Config == nil {
+		r.Config = new(Config)
+	}
+	r.Config.SetDefaults()
+	return r.ConfigureContentReader()
 }
 
 func (r *Responder) ServeHTTP(w http.ResponseWriter, req *http.Request, _ caddyhttp.Handler) error {
@@ -166,3 +302,10 @@ func (r *Responder) Validate() error {
 	}
 	return nil
 }
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*Responder)(nil)
+	_ caddy.Validator       = (*Responder)(nil)
+	_ caddyfile.Unmarshaler = (*Responder)(nil)
+)
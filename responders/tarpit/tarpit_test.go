@@ -3,6 +3,7 @@ package tarpit
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"pkg.jsn.cam/caddy-defender/cache"
 )
 
@@ -108,6 +110,20 @@ func TestConfigureContentReader(t *testing.T) {
 	})
 }
 
+func TestProvision(t *testing.T) {
+	responder := &Responder{}
+	if err := responder.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if responder.Timeout != DefaultTimeout || responder.BytesPerSecond != DefaultBytesPerSecond ||
+		responder.ResponseCode != DefaultResponseCode {
+		t.Errorf("Expected the defaults, but got: %+v", *responder.Config)
+	}
+	if _, ok := responder.ContentReader.(TimeoutReader); !ok {
+		t.Error("Expected TimeoutReader, but got a different type")
+	}
+}
+
 func TestServeHTTP(t *testing.T) {
 	// Mock HTTP request and response writer
 	req := &http.Request{}
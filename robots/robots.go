@@ -0,0 +1,237 @@
+// Package robots parses robots.txt files and remembers which clients fetched them,
+// so requests for disallowed paths can be told apart from honest mistakes.
+package robots
+
+import (
+	"bufio"
+	"io"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxSize is the largest robots.txt parsed, as crawlers must parse at least 500 KiB (RFC 9309).
+const MaxSize = 500 << 10
+
+// maxFetches bounds the number of remembered fetches.
+const maxFetches = 100_000
+
+// sweepInterval is the minimum time between removals of expired fetches.
+const sweepInterval = time.Minute
+
+// Rule is an allow or disallow line of a robots.txt group.
+type Rule struct {
+	// Agent is the user-agent of the group holding the rule, e.g. "GPTBot" or "*".
+	Agent string
+	// Path is the path pattern, which may contain "*" wildcards and end with "$".
+	Path string
+	// Allow is true for allow rules and false for disallow rules.
+	Allow bool
+}
+
+// String returns the rule as written in robots.txt, e.g. "User-agent: * Disallow: /private/".
+func (r Rule) String() string {
+	kind := "Disallow"
+	if r.Allow {
+		kind = "Allow"
+	}
+	return "User-agent: " + r.Agent + " " + kind + ": " + r.Path
+}
+
+// group is a set of rules for one or more user-agents.
+type group struct {
+	agents []string
+	rules  []Rule
+}
+
+// Rules are the groups of a parsed robots.txt file.
+type Rules struct {
+	groups []group
+}
+
+// Parse reads a robots.txt file. Unknown lines, such as Sitemap and Crawl-delay, are ignored,
+// as are rules before the first User-agent line. At most MaxSize bytes are read.
+func Parse(r io.Reader) (*Rules, error) {
+	rules := new(Rules)
+	var current *group
+	scanner := bufio.NewScanner(io.LimitReader(r, MaxSize))
+	scanner.Buffer(make([]byte, 0, 4096), MaxSize)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "user-agent":
+			// Consecutive User-agent lines share the rules that follow them
+			if current == nil || len(current.rules) > 0 {
+				rules.groups = append(rules.groups, group{})
+				current = &rules.groups[len(rules.groups)-1]
+			}
+			current.agents = append(current.agents, value)
+		case "allow", "disallow":
+			if current == nil {
+				continue
+			}
+			allow := strings.EqualFold(strings.TrimSpace(key), "allow")
+			if value == "" {
+				// An empty disallow allows everything; record it so the group isn't extended
+				// by the next User-agent line
+				current.rules = append(current.rules, Rule{Allow: true})
+				continue
+			}
+			current.rules = append(current.rules, Rule{Path: value, Allow: allow})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range rules.groups {
+		for j := range rules.groups[i].rules {
+			rules.groups[i].rules[j].Agent = strings.Join(rules.groups[i].agents, ", ")
+		}
+	}
+	return rules, nil
+}
+
+// Disallowed returns the rule disallowing a crawler with the given User-Agent header from
+// fetching path (including any query), if there is one.
+//
+// As in RFC 9309, the groups naming the longest user-agent found in userAgent apply, falling
+// back to the "*" groups. Of their rules, the one with the longest matching path decides, and
+// allow rules win ties.
+func (r *Rules) Disallowed(userAgent, path string) (Rule, bool) {
+	var decisive Rule
+	found := false
+	for _, rule := range r.rulesFor(userAgent) {
+		if rule.Path == "" || !matchPath(rule.Path, path) {
+			continue
+		}
+		if !found || len(rule.Path) > len(decisive.Path) || (len(rule.Path) == len(decisive.Path) && rule.Allow) {
+			decisive = rule
+			found = true
+		}
+	}
+	if !found || decisive.Allow {
+		return Rule{}, false
+	}
+	return decisive, true
+}
+
+// rulesFor returns the rules of the groups that apply to userAgent.
+func (r *Rules) rulesFor(userAgent string) []Rule {
+	userAgent = strings.ToLower(userAgent)
+	best := ""
+	for _, g := range r.groups {
+		for _, agent := range g.agents {
+			agent = strings.ToLower(agent)
+			if agent != "*" && len(agent) > len(best) && strings.Contains(userAgent, agent) {
+				best = agent
+			}
+		}
+	}
+	if best == "" {
+		best = "*"
+	}
+
+	var rules []Rule
+	for _, g := range r.groups {
+		for _, agent := range g.agents {
+			if strings.EqualFold(agent, best) {
+				rules = append(rules, g.rules...)
+				break
+			}
+		}
+	}
+	return rules
+}
+
+// matchPath reports whether path matches a rule pattern, where "*" matches any sequence of
+// characters and a trailing "$" anchors the pattern at the end of the path.
+func matchPath(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	parts := strings.Split(strings.TrimSuffix(pattern, "$"), "*")
+
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	if len(parts) == 1 {
+		return !anchored || path == parts[0]
+	}
+	pos := len(parts[0])
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(path[pos:], part)
+		if i < 0 {
+			return false
+		}
+		pos += i + len(part)
+	}
+
+	last := parts[len(parts)-1]
+	if anchored {
+		return len(path)-len(last) >= pos && strings.HasSuffix(path, last)
+	}
+	return strings.Contains(path[pos:], last)
+}
+
+// fetch identifies a client that fetched robots.txt.
+type fetch struct {
+	agent string
+	addr  netip.Addr
+}
+
+// Fetches remembers which clients fetched robots.txt, and under which User-Agent, for a
+// while. It is safe for concurrent use.
+type Fetches struct {
+	lastSweep time.Time
+	entries   map[fetch]time.Time
+	now       func() time.Time
+	ttl       time.Duration
+	mu        sync.Mutex
+}
+
+// NewFetches returns an empty set of fetches remembered for ttl.
+func NewFetches(ttl time.Duration) *Fetches {
+	return &Fetches{entries: make(map[fetch]time.Time), now: time.Now, ttl: ttl}
+}
+
+// Record remembers that addr fetched robots.txt with the given User-Agent. Once too many
+// fetches are remembered, new ones are dropped until the oldest expire.
+func (f *Fetches) Record(addr netip.Addr, userAgent string) {
+	key := fetch{addr: addr.Unmap(), agent: userAgent}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now()
+	if now.Sub(f.lastSweep) >= sweepInterval {
+		f.sweep(now)
+	}
+	if _, ok := f.entries[key]; !ok && len(f.entries) >= maxFetches {
+		return
+	}
+	f.entries[key] = now.Add(f.ttl)
+}
+
+// Fetched reports whether addr fetched robots.txt with the given User-Agent recently.
+func (f *Fetches) Fetched(addr netip.Addr, userAgent string) bool {
+	key := fetch{addr: addr.Unmap(), agent: userAgent}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	expires, ok := f.entries[key]
+	return ok && f.now().Before(expires)
+}
+
+// sweep removes the fetches that have expired at now. f.mu must be held.
+func (f *Fetches) sweep(now time.Time) {
+	for key, expires := range f.entries {
+		if !now.Before(expires) {
+			delete(f.entries, key)
+		}
+	}
+	f.lastSweep = now
+}
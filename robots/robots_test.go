@@ -0,0 +1,131 @@
+package robots
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const robotsTxt = `
+# Search engines may crawl everything but the archive
+User-agent: Googlebot
+User-agent: Bingbot
+Disallow: /archive/
+Allow: /archive/public/
+
+User-agent: GPTBot
+Disallow: /
+
+User-agent: *
+Disallow: /private/
+Disallow: /*.pdf$
+Disallow: /search*q=
+Sitemap: https://example.com/sitemap.xml
+`
+
+func TestDisallowed(t *testing.T) {
+	rules, err := Parse(strings.NewReader(robotsTxt))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		userAgent string
+		path      string
+		rule      string
+	}{
+		{
+			name:      "group sharing agents",
+			userAgent: "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)",
+			path:      "/archive/2009/",
+			rule:      "User-agent: Googlebot, Bingbot Disallow: /archive/",
+		},
+		{
+			name:      "longer allow wins",
+			userAgent: "Googlebot/2.1",
+			path:      "/archive/public/index.html",
+		},
+		{
+			name:      "named group replaces the wildcard group",
+			userAgent: "Googlebot/2.1",
+			path:      "/private/",
+		},
+		{
+			name:      "disallowed everywhere",
+			userAgent: "Mozilla/5.0 AppleWebKit/537.36 (KHTML, like Gecko; compatible; GPTBot/1.2)",
+			path:      "/",
+			rule:      "User-agent: GPTBot Disallow: /",
+		},
+		{
+			name:      "wildcard group",
+			userAgent: "curl/8.5.0",
+			path:      "/private/keys",
+			rule:      "User-agent: * Disallow: /private/",
+		},
+		{
+			name:      "anchored pattern",
+			userAgent: "curl/8.5.0",
+			path:      "/docs/manual.pdf",
+			rule:      "User-agent: * Disallow: /*.pdf$",
+		},
+		{
+			name:      "anchored pattern with trailing path",
+			userAgent: "curl/8.5.0",
+			path:      "/docs/manual.pdf.html",
+		},
+		{
+			name:      "wildcard in the middle",
+			userAgent: "curl/8.5.0",
+			path:      "/search?lang=en&q=bots",
+			rule:      "User-agent: * Disallow: /search*q=",
+		},
+		{
+			name:      "allowed",
+			userAgent: "curl/8.5.0",
+			path:      "/blog/",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, disallowed := rules.Disallowed(tt.userAgent, tt.path)
+			require.Equal(t, tt.rule != "", disallowed)
+			if disallowed {
+				require.Equal(t, tt.rule, rule.String())
+			}
+		})
+	}
+}
+
+func TestDisallowedEmptyRules(t *testing.T) {
+	rules, err := Parse(strings.NewReader("User-agent: *\nDisallow:\n\nUser-agent: GPTBot\nDisallow: /\n"))
+	require.NoError(t, err)
+
+	_, disallowed := rules.Disallowed("curl/8.5.0", "/private/")
+	require.False(t, disallowed)
+	_, disallowed = rules.Disallowed("GPTBot/1.2", "/private/")
+	require.True(t, disallowed)
+}
+
+func TestFetches(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	fetches := NewFetches(time.Hour)
+	fetches.now = func() time.Time { return now }
+
+	addr := netip.MustParseAddr("198.51.100.1")
+	fetches.Record(addr, "GPTBot/1.2")
+
+	require.True(t, fetches.Fetched(addr, "GPTBot/1.2"))
+	require.True(t, fetches.Fetched(netip.MustParseAddr("::ffff:198.51.100.1"), "GPTBot/1.2"))
+	require.False(t, fetches.Fetched(addr, "curl/8.5.0"))
+	require.False(t, fetches.Fetched(netip.MustParseAddr("198.51.100.2"), "GPTBot/1.2"))
+
+	now = now.Add(time.Hour)
+	require.False(t, fetches.Fetched(addr, "GPTBot/1.2"))
+
+	// Expired fetches are swept when new ones are recorded
+	fetches.Record(netip.MustParseAddr("198.51.100.2"), "GPTBot/1.2")
+	require.Len(t, fetches.entries, 1)
+}
@@ -0,0 +1,213 @@
+package caddydefender
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"pkg.jsn.cam/caddy-defender/bans"
+	"pkg.jsn.cam/caddy-defender/robots"
+)
+
+const (
+	// robotsPath is the path of the robots.txt file.
+	robotsPath = "/robots.txt"
+	// defaultRobotsBanDuration is how long robots.txt violators are banned unless Duration is set.
+	defaultRobotsBanDuration = 24 * time.Hour
+	// robotsFetchTTL is how long a robots.txt fetch is remembered.
+	robotsFetchTTL = 24 * time.Hour
+	// maxRobotsHosts bounds the number of hosts whose upstream robots.txt is kept.
+	maxRobotsHosts = 1000
+)
+
+// robotsFetches remembers the clients that fetched robots.txt through any defender handler.
+// Like banTable, it belongs to the process, so fetches are remembered across config reloads.
+var robotsFetches = robots.NewFetches(robotsFetchTTL)
+
+// RobotsPolicyConfig bans clients that fetch robots.txt and then request a path it disallows
+// for their User-Agent. The robots.txt served by the handler is enforced if there is one,
+// otherwise the one served upstream.
+type RobotsPolicyConfig struct {
+	// Responder names the responder handling requests from violators.
+	// Default: "" (the handler's responder)
+	Responder string `json:"responder,omitempty"`
+
+	// Duration is how long violators are banned.
+	// Default: 24h
+	Duration caddy.Duration `json:"duration,omitempty"`
+}
+
+// validate checks that the duration and responder are valid.
+func (c *RobotsPolicyConfig) validate() error {
+	if c.Duration < 0 {
+		return errors.New("enforce_robots duration must not be negative")
+	}
+	if c.Responder != "" && !validResponder(c.Responder) {
+		return fmt.Errorf("invalid enforce_robots responder: %s", c.Responder)
+	}
+	return nil
+}
+
+// spec returns the ban of clients violating rule.
+func (c *RobotsPolicyConfig) spec(rule robots.Rule) bans.Spec {
+	duration := time.Duration(c.Duration)
+	if duration == 0 {
+		duration = defaultRobotsBanDuration
+	}
+	return bans.Spec{Duration: duration, Reason: "robots.txt " + rule.String(), Responder: c.Responder}
+}
+
+// robotsPolicy holds the robots.txt rules enforced by a handler.
+type robotsPolicy struct {
+	// served are the rules of the robots.txt served by the handler, if it serves one
+	served *robots.Rules
+	// upstream are the rules of the robots.txt files served upstream, by host, merged with the
+	// served ones if configured
+	upstream map[string]*robots.Rules
+	mu       sync.RWMutex
+}
+
+// provisionRobotsPolicy parses the robots.txt served by the handler, if any.
+func (m *Defender) provisionRobotsPolicy() error {
+	m.robots = &robotsPolicy{upstream: make(map[string]*robots.Rules)}
+	if m.robotsTxt == "" {
+		return nil
+	}
+	served, err := robots.Parse(strings.NewReader(m.robotsTxt))
+	if err != nil {
+		return fmt.Errorf("parsing robots.txt: %w", err)
+	}
+	m.robots.served = served
+	return nil
+}
+
+// rules returns the robots.txt rules enforced for host, or nil if they aren't known yet. The upstream
+// rules, merged with the served ones if configured, take precedence.
+func (p *robotsPolicy) rules(host string) *robots.Rules {
+	p.mu.RLock()
+	rules, ok := p.upstream[strings.ToLower(host)]
+	p.mu.RUnlock()
+	if ok {
+		return rules
+	}
+	return p.served
+}
+
+// setUpstream replaces the upstream robots.txt rules of host.
+func (p *robotsPolicy) setUpstream(host string, rules *robots.Rules) {
+	host = strings.ToLower(host)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.upstream[host]; !ok && len(p.upstream) >= maxRobotsHosts {
+		return
+	}
+	p.upstream[host] = rules
+}
+
+// isRobotsTxt reports whether r fetches robots.txt.
+func isRobotsTxt(r *http.Request) bool {
+	return r.URL.Path == robotsPath && r.Method == http.MethodGet
+}
+
+// recordRobotsFetch remembers that the client fetched the robots.txt served by the handler.
+func (m *Defender) recordRobotsFetch(r *http.Request) {
+	if m.robots == nil {
+		return
+	}
+	clientIP, err := m.ClientIP.clientIP(r)
+	if err != nil {
+		return
+	}
+	if addr, ok := netip.AddrFromSlice(clientIP); ok {
+		robotsFetches.Record(addr, r.UserAgent())
+	}
+}
+
+// applyRobotsPolicy bans the client if it fetched robots.txt and then requested a path it disallows.
+func (m *Defender) applyRobotsPolicy(r *http.Request, clientIP net.IP) {
+	if m.robots == nil {
+		return
+	}
+	addr, ok := netip.AddrFromSlice(clientIP)
+	if !ok {
+		return
+	}
+	addr = addr.Unmap()
+	if isRobotsTxt(r) {
+		// Fetching the upstream robots.txt
+		robotsFetches.Record(addr, r.UserAgent())
+		return
+	}
+	if !robotsFetches.Fetched(addr, r.UserAgent()) {
+		return
+	}
+	rules := m.robots.rules(r.Host)
+	if rules == nil {
+		return
+	}
+	rule, disallowed := rules.Disallowed(r.UserAgent(), r.URL.RequestURI())
+	if !disallowed {
+		return
+	}
+
+	m.log.Info("robots.txt violation",
+		zap.String("ip", addr.String()),
+		zap.String("user_agent", r.UserAgent()),
+		zap.String("uri", r.URL.RequestURI()),
+		zap.Stringer("rule", rule),
+	)
+	m.addBan(r, m.EnforceRobots.spec(rule), netip.PrefixFrom(addr, addr.BitLen()), "robots.txt violation")
+}
+
+// learnUpstreamRobotsTxt parses the robots.txt served upstream once the response is complete.
+func (m *Defender) learnUpstreamRobotsTxt(r *http.Request, w *robotsResponseWriter) {
+	if w.status != http.StatusOK || w.Header().Get("Content-Encoding") != "" {
+		return
+	}
+	rules, err := robots.Parse(&w.body)
+	if err != nil {
+		m.log.Warn("Invalid upstream robots.txt", zap.String("host", r.Host), zap.Error(err))
+		return
+	}
+	m.robots.setUpstream(r.Host, rules)
+}
+
+// robotsResponseWriter keeps a copy of the robots.txt served upstream.
+type robotsResponseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	body   bytes.Buffer
+	status int
+}
+
+func (w *robotsResponseWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+	w.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (w *robotsResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	// Like crawlers, only parse the first robots.MaxSize bytes
+	if room := robots.MaxSize - w.body.Len(); room > 0 {
+		w.body.Write(b[:min(room, len(b))])
+	}
+	return w.ResponseWriterWrapper.Write(b)
+}
+
+// ReadFrom copies through Write, as the wrapped ReadFrom would bypass the copy.
+func (w *robotsResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
@@ -0,0 +1,210 @@
+package caddydefender
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"pkg.jsn.cam/caddy-defender/matchers/ip"
+	"pkg.jsn.cam/caddy-defender/ranges/data"
+	"pkg.jsn.cam/caddy-defender/robots"
+)
+
+const (
+	// aiTxtPath is the path of the ai.txt opt-out file.
+	aiTxtPath = "/ai.txt"
+	// llmsTxtPath is the path of the llms.txt file.
+	llmsTxtPath = "/llms.txt"
+
+	// aiTxt opts the whole site out of AI training, in the format of Spawning's ai.txt.
+	aiTxt = "# Content on this site may not be used to train AI models\nUser-Agent: *\nDisallow: /\n"
+	// defaultLLMsTxt is served as llms.txt when the Caddyfile enables it without content.
+	defaultLLMsTxt = "# Notice\n\n> The content of this site may not be used to train AI models.\n"
+)
+
+// robotsAllowedAgents are the crawlers that may index the site when serve_ignore disallows everyone else.
+var robotsAllowedAgents = []string{"Googlebot", "Bingbot", "DuckDuckBot"}
+
+// RobotsConfig customizes the robots.txt served by the handler and enables the ai.txt and
+// llms.txt opt-out files.
+type RobotsConfig struct {
+	// Allow lists the user-agents that may crawl everything but the traps.
+	// Default: "Googlebot", "Bingbot" and "DuckDuckBot" with serve_ignore, none otherwise
+	Allow []string `json:"allow,omitempty"`
+
+	// Disallow lists user-agents that may crawl nothing, in addition to the crawlers run from
+	// the blocked predefined ranges (e.g. "GPTBot" when blocking "openai").
+	Disallow []string `json:"disallow,omitempty"`
+
+	// Paths lists paths disallowed for every other crawler. With serve_ignore, they are
+	// disallowed everything anyway.
+	Paths []string `json:"paths,omitempty"`
+
+	// LLMsTxt is served as /llms.txt, e.g. a notice that the content may not be used for training.
+	// Default: "" (not served)
+	LLMsTxt string `json:"llms_txt,omitempty"`
+
+	// Merge appends the robots.txt served upstream to the generated one. Crawlers combine the
+	// groups naming the same user-agent, so the site's own rules still apply.
+	// Default: false (the generated robots.txt replaces the upstream one)
+	Merge bool `json:"merge,omitempty"`
+
+	// AITxt serves an /ai.txt opting the whole site out of AI training.
+	// Default: false
+	AITxt bool `json:"ai_txt,omitempty"`
+}
+
+// validate checks that the user-agents and paths can be written to robots.txt.
+func (c *RobotsConfig) validate() error {
+	for _, agent := range slices.Concat(c.Allow, c.Disallow) {
+		if agent == "" || strings.ContainsAny(agent, "\r\n#") {
+			return fmt.Errorf("invalid robots user-agent %q", agent)
+		}
+	}
+	for _, p := range c.Paths {
+		if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, "\r\n#") {
+			return fmt.Errorf("invalid robots path %q: must start with /", p)
+		}
+	}
+	return nil
+}
+
+// buildRobotsTxt returns the robots.txt served by the handler, or "" if it serves none. With
+// serve_ignore, only well-known search engines may crawl the site; trap paths are disallowed for
+// every crawler, and the crawlers run from the blocked ranges are disallowed everything.
+func (m *Defender) buildRobotsTxt() string {
+	var traps []string
+	if m.Traps != nil {
+		traps = m.Traps.Paths
+	}
+	if !m.ServeIgnore && len(traps) == 0 && m.Robots == nil {
+		return ""
+	}
+
+	cfg := m.Robots
+	if cfg == nil {
+		cfg = new(RobotsConfig)
+	}
+	allowed := cfg.Allow
+	if len(allowed) == 0 && m.ServeIgnore {
+		allowed = robotsAllowedAgents
+	}
+	disallowed := slices.Concat(cfg.Disallow, blockedCrawlerAgents(slices.Concat(m.rangeLists()...)))
+	everyone := slices.Concat(traps, cfg.Paths)
+	if m.ServeIgnore {
+		everyone = []string{"/"}
+	}
+
+	var b strings.Builder
+	for _, agent := range allowed {
+		writeRobotsGroup(&b, []string{agent}, traps)
+	}
+	if len(disallowed) > 0 && m.Robots != nil {
+		writeRobotsGroup(&b, disallowed, []string{"/"})
+	}
+	writeRobotsGroup(&b, []string{"*"}, everyone)
+	return b.String()
+}
+
+// writeRobotsGroup writes a robots.txt group disallowing paths for agents.
+func writeRobotsGroup(b *strings.Builder, agents, disallow []string) {
+	b.WriteString("\n")
+	for _, agent := range agents {
+		fmt.Fprintf(b, "User-agent: %s\n", agent)
+	}
+	if len(disallow) == 0 {
+		b.WriteString("Disallow:\n")
+	}
+	for _, p := range disallow {
+		fmt.Fprintf(b, "Disallow: %s\n", p)
+	}
+}
+
+// blockedCrawlerAgents returns the user-agent tokens of the crawlers run from the blocked
+// predefined ranges, without duplicates.
+func blockedCrawlerAgents(ranges []string) []string {
+	var agents []string
+	for _, entry := range ranges {
+		name, excluded := ip.ParseEntry(entry)
+		if excluded {
+			continue
+		}
+		for _, agent := range data.CrawlerAgents[name] {
+			if !slices.Contains(agents, agent) {
+				agents = append(agents, agent)
+			}
+		}
+	}
+	return agents
+}
+
+// writeText writes a plain text response.
+func writeText(w http.ResponseWriter, content string) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(content))
+}
+
+// mergeUpstreamRobotsTxt returns the generated robots.txt followed by the one served upstream,
+// falling back to the generated one if upstream serves none.
+func (m *Defender) mergeUpstreamRobotsTxt(r *http.Request, next caddyhttp.Handler) string {
+	// Ask for the full, uncompressed file whatever the client cached
+	req := r.Clone(r.Context())
+	for _, header := range []string{"Accept-Encoding", "If-Modified-Since", "If-None-Match", "Range"} {
+		req.Header.Del(header)
+	}
+
+	upstream := &bufferedResponseWriter{header: make(http.Header)}
+	if err := next.ServeHTTP(upstream, req); err != nil {
+		m.log.Debug("No upstream robots.txt to merge", zap.Error(err))
+		return m.robotsTxt
+	}
+	if upstream.status != http.StatusOK || upstream.tooLarge || upstream.header.Get("Content-Encoding") != "" {
+		m.log.Debug("No upstream robots.txt to merge", zap.Int("status", upstream.status))
+		return m.robotsTxt
+	}
+
+	merged := m.robotsTxt + "\n" + upstream.body.String()
+	if m.robots != nil {
+		// Enforce the site's own rules as well
+		rules, err := robots.Parse(strings.NewReader(merged))
+		if err == nil {
+			m.robots.setUpstream(r.Host, rules)
+		}
+	}
+	return merged
+}
+
+// bufferedResponseWriter keeps a response in memory, up to robots.MaxSize bytes of body.
+type bufferedResponseWriter struct {
+	header   http.Header
+	body     bytes.Buffer
+	status   int
+	tooLarge bool
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.body.Len()+len(b) > robots.MaxSize {
+		w.tooLarge = true
+		return 0, errors.New("robots.txt too large")
+	}
+	return w.body.Write(b)
+}
@@ -0,0 +1,189 @@
+package caddydefender
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/require"
+	"pkg.jsn.cam/caddy-defender/responders"
+)
+
+func TestBuildRobotsTxt(t *testing.T) {
+	tests := []struct {
+		traps       *TrapConfig
+		robots      *RobotsConfig
+		name        string
+		expected    string
+		ranges      []string
+		serveIgnore bool
+	}{
+		{
+			name:     "disabled",
+			expected: "",
+		},
+		{
+			name:        "serve ignore",
+			serveIgnore: true,
+			expected: `
+User-agent: Googlebot
+Disallow:
+
+User-agent: Bingbot
+Disallow:
+
+User-agent: DuckDuckBot
+Disallow:
+
+User-agent: *
+Disallow: /
+`,
+		},
+		{
+			name:  "traps",
+			traps: &TrapConfig{Paths: []string{"/wp-admin/", "/.env"}},
+			expected: `
+User-agent: *
+Disallow: /wp-admin/
+Disallow: /.env
+`,
+		},
+		{
+			name:        "serve ignore with traps",
+			serveIgnore: true,
+			traps:       &TrapConfig{Paths: []string{"/wp-admin/"}},
+			expected: `
+User-agent: Googlebot
+Disallow: /wp-admin/
+
+User-agent: Bingbot
+Disallow: /wp-admin/
+
+User-agent: DuckDuckBot
+Disallow: /wp-admin/
+
+User-agent: *
+Disallow: /
+`,
+		},
+		{
+			name:   "robots",
+			ranges: []string{"openai", "!githubcopilot", "203.0.113.0/24"},
+			traps:  &TrapConfig{Paths: []string{"/wp-admin/"}},
+			robots: &RobotsConfig{
+				Allow:    []string{"Googlebot"},
+				Disallow: []string{"CCBot"},
+				Paths:    []string{"/search"},
+			},
+			expected: `
+User-agent: Googlebot
+Disallow: /wp-admin/
+
+User-agent: CCBot
+User-agent: GPTBot
+User-agent: ChatGPT-User
+User-agent: OAI-SearchBot
+Disallow: /
+
+User-agent: *
+Disallow: /wp-admin/
+Disallow: /search
+`,
+		},
+		{
+			name:        "robots with serve ignore",
+			ranges:      []string{"mistral"},
+			serveIgnore: true,
+			robots:      &RobotsConfig{AITxt: true},
+			expected: `
+User-agent: Googlebot
+Disallow:
+
+User-agent: Bingbot
+Disallow:
+
+User-agent: DuckDuckBot
+Disallow:
+
+User-agent: MistralAI-User
+Disallow: /
+
+User-agent: *
+Disallow: /
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Defender{Ranges: tt.ranges, ServeIgnore: tt.serveIgnore, Traps: tt.traps, Robots: tt.robots}
+			require.Equal(t, tt.expected, m.buildRobotsTxt())
+		})
+	}
+}
+
+func TestDefenderServeHTTP_RobotsFiles(t *testing.T) {
+	defender := &Defender{
+		RawResponder: "block",
+		Ranges:       []string{"openai"},
+		Robots:       &RobotsConfig{Merge: true, AITxt: true, LLMsTxt: defaultLLMsTxt},
+		responder:    &responders.BlockResponder{},
+	}
+	require.NoError(t, defender.Validate())
+	require.NoError(t, defender.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, defender.Cleanup()) }()
+
+	serve := func(path string, next robotsHandler) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "198.51.100.50:12345"
+		recorder := httptest.NewRecorder()
+		require.NoError(t, defender.ServeHTTP(recorder, req, next))
+		return recorder
+	}
+
+	// The upstream robots.txt is appended to the generated one
+	recorder := serve("/robots.txt", robotsHandler{})
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, `
+User-agent: GPTBot
+User-agent: ChatGPT-User
+User-agent: OAI-SearchBot
+Disallow: /
+
+User-agent: *
+Disallow:
+
+User-agent: *
+Disallow: /private/
+`, recorder.Body.String())
+
+	recorder = serve("/ai.txt", robotsHandler{})
+	require.Equal(t, aiTxt, recorder.Body.String())
+
+	recorder = serve("/llms.txt", robotsHandler{})
+	require.Equal(t, defaultLLMsTxt, recorder.Body.String())
+}
+
+func TestMergeUpstreamRobotsTxtWithoutUpstream(t *testing.T) {
+	defender := &Defender{
+		RawResponder: "block",
+		Ranges:       []string{"openai"},
+		Robots:       &RobotsConfig{Merge: true},
+		responder:    &responders.BlockResponder{},
+	}
+	require.NoError(t, defender.Provision(caddy.Context{Context: context.Background()}))
+	defer func() { require.NoError(t, defender.Cleanup()) }()
+
+	req := httptest.NewRequest(http.MethodGet, "/robots.txt", nil)
+	require.Equal(t, defender.robotsTxt, defender.mergeUpstreamRobotsTxt(req, notFoundHandler{}))
+}
+
+// notFoundHandler fails like a file server without the requested file.
+type notFoundHandler struct{}
+
+func (notFoundHandler) ServeHTTP(http.ResponseWriter, *http.Request) error {
+	return caddyhttp.Error(http.StatusNotFound, nil)
+}
@@ -0,0 +1,152 @@
+package caddydefender
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"pkg.jsn.cam/caddy-defender/matchers/ip"
+	"pkg.jsn.cam/caddy-defender/responders"
+)
+
+// Rule hands the requests from its own ranges to its own responder, so a single handler can,
+// say, tarpit one group of ranges and redirect another.
+type Rule struct {
+	// Ranges lists the ranges handled by the rule, with the same syntax as the handler's ranges.
+	// Required.
+	Ranges []string `json:"ranges"`
+
+	// RawResponder names the rule's responder, set up from the handler's settings (message,
+	// url, tarpit_config, ...).
+	// Required unless ResponderRaw is set.
+	RawResponder string `json:"raw_responder,omitempty"`
+
+	// ResponderRaw is the rule's responder module with its own settings, e.g.
+	// {"responder": "redirect", "url": "https://status.example.com"}. It takes the place of
+	// RawResponder, which is set to its name.
+	ResponderRaw json.RawMessage `json:"responder,omitempty" caddy:"namespace=http.handlers.defender.responders inline_key=responder"` //nolint:lll // Struct tags can't be wrapped.
+
+	// responder is the rule's responder loaded from ResponderRaw, if any
+	responder responders.Responder
+}
+
+// unmarshalRule parses a rule subdirective. Syntax:
+//
+//	rule [<responder>] {
+//	    ranges <cidr_or_predefined...>
+//	    responder <name> {
+//	        ...
+//	    }
+//	}
+func unmarshalRule(d *caddyfile.Dispenser) (Rule, error) {
+	var rule Rule
+	if d.NextArg() {
+		if !validResponder(d.Val()) {
+			return rule, d.Errf("invalid responder type: %s", d.Val())
+		}
+		rule.RawResponder = d.Val()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "ranges":
+			rule.Ranges = append(rule.Ranges, d.RemainingArgs()...)
+		case "responder":
+			if !d.NextArg() {
+				return rule, d.ArgErr()
+			}
+			name := d.Val()
+			if rule.RawResponder != "" && (rule.ResponderRaw != nil || rule.RawResponder != name) {
+				return rule, d.Errf("rule responder already set to %s", rule.RawResponder)
+			}
+			unm, err := caddyfile.UnmarshalModule(d, responders.Namespace+"."+name)
+			if err != nil {
+				return rule, err
+			}
+			rule.RawResponder = name
+			rule.ResponderRaw = caddyconfig.JSONModuleObject(unm, "responder", name, nil)
+		default:
+			return rule, d.Errf("unknown nested config key: %s", d.Val())
+		}
+	}
+	if rule.RawResponder == "" {
+		return rule, d.Err("missing rule responder type")
+	}
+	return rule, nil
+}
+
+// validate checks the rule's ranges and responder. Responders named by the rule are set
+// up from the handler's settings, so redirects require the handler to have a redirect
+// configured (see Defender.redirectConfigured).
+func (r *Rule) validate(redirect bool) error {
+	if !slices.ContainsFunc(r.Ranges, isBlockedRange) {
+		return errors.New("rule requires at least one range to block")
+	}
+	if err := validateRanges(r.Ranges); err != nil {
+		return err
+	}
+	// Modules validate their own settings, and their raw JSON is gone once they are loaded
+	if r.ResponderRaw != nil || r.responder != nil {
+		return nil
+	}
+	if !validResponder(r.RawResponder) {
+		return fmt.Errorf("invalid rule responder: %s", r.RawResponder)
+	}
+	if r.RawResponder == responderRedirect && !redirect {
+		return errors.New("rule redirect responder requires 'url' to be set")
+	}
+	return nil
+}
+
+// provisionRules loads the responder modules of the rules. Responders named by the rules
+// are provisioned along with those bans can name.
+func (m *Defender) provisionRules(ctx caddy.Context) error {
+	for i := range m.Rules {
+		rule := &m.Rules[i]
+		if rule.ResponderRaw == nil {
+			continue
+		}
+		mod, err := ctx.LoadModule(rule, "ResponderRaw")
+		if err != nil {
+			return fmt.Errorf("loading rule %d responder module: %w", i, err)
+		}
+		responder, ok := mod.(responders.Responder)
+		if !ok {
+			return fmt.Errorf("module %T is not a responder", mod)
+		}
+		name := mod.(caddy.Module).CaddyModule().ID.Name()
+		if rule.RawResponder != "" && rule.RawResponder != name {
+			return fmt.Errorf("rule raw_responder %q doesn't match the responder module %q", rule.RawResponder, name)
+		}
+		rule.RawResponder = name
+		rule.responder = responder
+	}
+	return nil
+}
+
+// rangeLists returns the range lists compiled into the handler's table: its own ranges,
+// followed by those of its rules, so ip.Match.Rule is 0 for the handler's ranges and i+1
+// for the i-th rule.
+func (m *Defender) rangeLists() [][]string {
+	lists := [][]string{m.Ranges}
+	for _, rule := range m.Rules {
+		lists = append(lists, rule.Ranges)
+	}
+	return lists
+}
+
+// ruleResponder returns the name and responder of the rule whose ranges produced match,
+// falling back to the handler's responder for its own ranges.
+func (m *Defender) ruleResponder(match *ip.Match) (string, responders.Responder) {
+	if match == nil || match.Rule < 1 || match.Rule > len(m.Rules) {
+		return m.RawResponder, m.responder
+	}
+	rule := m.Rules[match.Rule-1]
+	if rule.responder != nil {
+		return rule.RawResponder, rule.responder
+	}
+	return m.namedResponder(rule.RawResponder)
+}
@@ -0,0 +1,128 @@
+package caddydefender
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnmarshalCaddyfile_Rules(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	defender {
+		rule tarpit {
+			ranges 203.0.113.0/24
+		}
+		rule {
+			ranges 198.51.100.0/24 !198.51.100.128/25
+			responder redirect https://status.example.com
+		}
+	}`)
+	var m Defender
+	require.NoError(t, m.UnmarshalCaddyfile(d))
+	require.Empty(t, m.RawResponder)
+	require.Len(t, m.Rules, 2)
+	require.Equal(t, Rule{Ranges: []string{"203.0.113.0/24"}, RawResponder: "tarpit"}, m.Rules[0])
+	require.Equal(t, []string{"198.51.100.0/24", "!198.51.100.128/25"}, m.Rules[1].Ranges)
+	require.Equal(t, "redirect", m.Rules[1].RawResponder)
+	require.JSONEq(t, `{"responder": "redirect", "url": "https://status.example.com"}`, string(m.Rules[1].ResponderRaw))
+
+	for name, input := range map[string]string{
+		"missing responder": `defender {
+			rule {
+				ranges 203.0.113.0/24
+			}
+		}`,
+		"invalid responder": `defender {
+			rule nope {
+				ranges 203.0.113.0/24
+			}
+		}`,
+		"unknown key": `defender {
+			rule block {
+				paths /admin
+			}
+		}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			var m Defender
+			require.Error(t, m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)))
+		})
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     Rule
+		redirect bool
+		err      string
+	}{
+		{name: "valid", rule: Rule{Ranges: []string{"openai"}, RawResponder: "drop"}},
+		{name: "no ranges", rule: Rule{RawResponder: "drop"}, err: "at least one range"},
+		{name: "only exclusions", rule: Rule{Ranges: []string{"!openai"}, RawResponder: "drop"}, err: "at least one range"},
+		{name: "invalid range", rule: Rule{Ranges: []string{"nope"}, RawResponder: "drop"}, err: "invalid IP range"},
+		{name: "invalid responder", rule: Rule{Ranges: []string{"openai"}, RawResponder: "nope"}, err: "invalid rule responder"},
+		{name: "redirect without url", rule: Rule{Ranges: []string{"openai"}, RawResponder: "redirect"}, err: "requires 'url'"},
+		{name: "redirect with url", rule: Rule{Ranges: []string{"openai"}, RawResponder: "redirect"}, redirect: true},
+		{
+			name: "redirect module",
+			rule: Rule{Ranges: []string{"openai"}, ResponderRaw: json.RawMessage(`{"responder":"redirect","url":"https://example.com"}`)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.validate(tt.redirect)
+			if tt.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestDefenderServeHTTP_Rules(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	var defender Defender
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"message": "go away",
+		"status_code": 451,
+		"rules": [
+			{"ranges": ["203.0.113.0/24", "!203.0.113.128/25"], "raw_responder": "custom"},
+			{"ranges": ["203.0.113.0/24"], "responder": {"responder": "redirect", "url": "https://status.example.com"}},
+			{"ranges": ["198.51.100.0/24"], "raw_responder": "custom"}
+		]
+	}`), &defender))
+	require.NoError(t, defender.Provision(ctx))
+	defer func() { require.NoError(t, defender.Cleanup()) }()
+	require.NoError(t, defender.Validate(), "validated after the rule's module is loaded")
+	require.Equal(t, "block", defender.RawResponder)
+	require.Empty(t, defender.Ranges, "rules don't add the default ranges")
+
+	serve := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = ip + ":12345"
+		recorder := httptest.NewRecorder()
+		require.NoError(t, defender.ServeHTTP(recorder, req, &mockHandler{}))
+		return recorder
+	}
+
+	recorder := serve("203.0.113.10")
+	require.Equal(t, http.StatusUnavailableForLegalReasons, recorder.Code, "first rule")
+	require.Equal(t, "go away", recorder.Body.String())
+
+	recorder = serve("203.0.113.200")
+	require.Equal(t, http.StatusPermanentRedirect, recorder.Code, "excluded from the first rule")
+	require.Equal(t, "https://status.example.com", recorder.Header().Get("Location"))
+
+	require.Equal(t, http.StatusUnavailableForLegalReasons, serve("198.51.100.1").Code, "third rule")
+	require.Equal(t, http.StatusOK, serve("192.0.2.1").Code, "no rule")
+}
@@ -0,0 +1,114 @@
+// Package strikes counts the requests each client makes over a sliding window, in bounded
+// memory.
+package strikes
+
+import (
+	"container/list"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// maxClients bounds the number of clients counted. Beyond it, the least recently seen
+// client is forgotten.
+const maxClients = 100_000
+
+// sweepInterval is the minimum time between removals of idle clients.
+const sweepInterval = time.Minute
+
+// strikes are the strikes of a client in the current and previous windows.
+type strikes struct {
+	// addr identifies the client in Counter.clients.
+	addr     netip.Addr
+	start    time.Time
+	previous int
+	current  int
+}
+
+// Counter counts strikes per client IP. Strikes are forgotten as they slide out of the
+// window. It is safe for concurrent use.
+type Counter struct {
+	lastSweep time.Time
+	// clients holds the elements of recent, whose values are the clients' *strikes.
+	clients map[netip.Addr]*list.Element
+	// recent orders the clients from the most to the least recently seen.
+	recent     *list.List
+	now        func() time.Time
+	window     time.Duration
+	maxClients int
+	mu         sync.Mutex
+}
+
+// New returns a Counter counting strikes over window.
+func New(window time.Duration) *Counter {
+	return &Counter{
+		clients:    make(map[netip.Addr]*list.Element),
+		recent:     list.New(),
+		now:        time.Now,
+		window:     window,
+		maxClients: maxClients,
+	}
+}
+
+// Add records a strike for addr and returns its strikes within the window, including this one.
+// The previous window's strikes are weighted by how much of it the window still covers. Once
+// too many clients are counted, the least recently seen one is forgotten, so a flood of new
+// clients can't reset the strikes of the active ones.
+func (c *Counter) Add(addr netip.Addr) int {
+	addr = addr.Unmap()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if now.Sub(c.lastSweep) >= sweepInterval {
+		c.sweep(now)
+	}
+
+	var s *strikes
+	if elem, ok := c.clients[addr]; ok {
+		c.recent.MoveToFront(elem)
+		s = elem.Value.(*strikes)
+	} else {
+		if len(c.clients) >= c.maxClients {
+			c.remove(c.recent.Back())
+		}
+		s = &strikes{addr: addr, start: now}
+		c.clients[addr] = c.recent.PushFront(s)
+	}
+
+	if elapsed := now.Sub(s.start); elapsed >= c.window {
+		s.previous = s.current
+		if elapsed >= 2*c.window {
+			s.previous = 0
+		}
+		s.current = 0
+		s.start = s.start.Add(elapsed.Truncate(c.window))
+	}
+	s.current++
+
+	weight := 1 - float64(now.Sub(s.start))/float64(c.window)
+	return s.current + int(float64(s.previous)*weight)
+}
+
+// Len returns the number of clients counted.
+func (c *Counter) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.clients)
+}
+
+// sweep removes the clients without strikes in the last two windows. c.mu must be held.
+func (c *Counter) sweep(now time.Time) {
+	for _, elem := range c.clients {
+		if now.Sub(elem.Value.(*strikes).start) >= 2*c.window {
+			c.remove(elem)
+		}
+	}
+	c.lastSweep = now
+}
+
+// remove forgets the client of elem. c.mu must be held.
+func (c *Counter) remove(elem *list.Element) {
+	delete(c.clients, elem.Value.(*strikes).addr)
+	c.recent.Remove(elem)
+}
@@ -0,0 +1,61 @@
+package strikes
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounter(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	c := New(time.Hour)
+	c.now = func() time.Time { return now }
+
+	client := netip.MustParseAddr("203.0.113.1")
+	for i := 1; i <= 4; i++ {
+		require.Equal(t, i, c.Add(client))
+	}
+	require.Equal(t, 1, c.Add(netip.MustParseAddr("203.0.113.2")), "clients are counted separately")
+	require.Equal(t, 5, c.Add(netip.MustParseAddr("::ffff:203.0.113.1")), "mapped addresses are unmapped")
+
+	// A quarter into the next window, three quarters of the previous window's strikes count.
+	now = now.Add(75 * time.Minute)
+	require.Equal(t, 1+3, c.Add(client))
+
+	// Strikes older than two windows are forgotten, along with idle clients.
+	now = now.Add(3 * time.Hour)
+	require.Equal(t, 1, c.Add(client))
+	require.Equal(t, 1, c.Len())
+}
+
+func TestCounterBounded(t *testing.T) {
+	c := New(time.Hour)
+	base := netip.MustParseAddr("10.0.0.0")
+	addr := base
+	for range maxClients + 10 {
+		c.Add(addr)
+		addr = addr.Next()
+	}
+	require.Equal(t, maxClients, c.Len())
+}
+
+func TestCounterEvictsLeastRecentlySeen(t *testing.T) {
+	c := New(time.Hour)
+	c.maxClients = 2
+
+	first := netip.MustParseAddr("203.0.113.1")
+	second := netip.MustParseAddr("203.0.113.2")
+	for range 3 {
+		c.Add(first)
+	}
+	c.Add(second)
+	require.Equal(t, 4, c.Add(first), "seeing a client again makes it the most recent")
+
+	// New clients evict the least recently seen one, not an arbitrary one
+	c.Add(netip.MustParseAddr("203.0.113.3"))
+	require.Equal(t, 2, c.Len())
+	require.Equal(t, 5, c.Add(first), "active clients keep their strikes")
+	require.Equal(t, 1, c.Add(second), "evicted clients start over")
+}
@@ -0,0 +1,206 @@
+package caddydefender
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"pkg.jsn.cam/caddy-defender/matchers/ip"
+	"pkg.jsn.cam/caddy-defender/ranges/sources"
+)
+
+// rangeTables holds the compiled range tables, keyed by the canonical hash of their
+// rangeConfig. Defender instances with identical range configurations share one table,
+// and since a reload provisions the new config before cleaning up the old one, unchanged
+// tables are reused rather than rebuilt.
+var rangeTables = caddy.NewUsagePool()
+
+// rangeConfig is everything a compiled range table depends on.
+type rangeConfig struct {
+	Ranges          []string             `json:"ranges"`
+	Rules           [][]string           `json:"rules,omitempty"`
+	Whitelist       []string             `json:"whitelist"`
+	RefreshInterval caddy.Duration       `json:"refresh_interval"`
+	Remote          sources.RemoteConfig `json:"remote"`
+	Cache           ip.CacheConfig       `json:"cache"`
+}
+
+// rangeConfig returns the canonical range configuration of m.
+func (m *Defender) rangeConfig() rangeConfig {
+	return rangeConfig{
+		Ranges:          canonicalEntries(m.Ranges),
+		Rules:           canonicalRules(m.Rules),
+		Whitelist:       canonicalEntries(m.Whitelist),
+		RefreshInterval: m.RefreshInterval,
+		Remote:          m.Remote,
+		Cache:           m.Cache,
+	}
+}
+
+// canonicalEntries sorts and deduplicates entries, so configurations that only differ
+// in ordering share a table.
+func canonicalEntries(entries []string) []string {
+	entries = slices.Clone(entries)
+	slices.Sort(entries)
+	return slices.Compact(entries)
+}
+
+// canonicalRules returns the canonical ranges of each rule. The order of the rules is kept,
+// since it decides which rule handles ranges they share.
+func canonicalRules(rules []Rule) [][]string {
+	var lists [][]string
+	for _, rule := range rules {
+		lists = append(lists, canonicalEntries(rule.Ranges))
+	}
+	return lists
+}
+
+// lists returns the range lists compiled into the table, the ranges followed by the rules
+// (see Defender.rangeLists).
+func (c rangeConfig) lists() [][]string {
+	return slices.Concat([][]string{c.Ranges}, c.Rules)
+}
+
+// key returns the hash identifying the config in rangeTables.
+func (c rangeConfig) key() (string, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("encoding range config: %w", err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// entries returns the distinct predefined keys, CIDRs and sources referenced by
+// the ranges, rules and whitelist, with exclusion markers removed.
+func (c rangeConfig) entries() []string {
+	var entries []string
+	for _, entry := range slices.Concat(append(c.lists(), c.Whitelist)...) {
+		name, _ := ip.ParseEntry(entry)
+		if !slices.Contains(entries, name) {
+			entries = append(entries, name)
+		}
+	}
+	return entries
+}
+
+// rangeTable is a compiled range table along with the watcher keeping it up to date.
+type rangeTable struct {
+	checker *ip.IPChecker
+	// resolver holds the range data the table is currently built from
+	resolver *sources.Resolver
+	cancel   context.CancelFunc
+}
+
+// Destruct stops the watcher once the last Defender using the table is cleaned up.
+func (t *rangeTable) Destruct() error {
+	t.cancel()
+	return nil
+}
+
+// loadRangeTable returns the shared table for cfg, compiling it if no other Defender uses it.
+// Callers must release it with rangeTables.Delete(key) when they are cleaned up.
+func loadRangeTable(ctx caddy.Context, key string, cfg rangeConfig, log *zap.Logger) (*rangeTable, error) {
+	val, _, err := rangeTables.LoadOrNew(key, func() (caddy.Destructor, error) {
+		return newRangeTable(ctx, cfg, log)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.(*rangeTable), nil
+}
+
+// newRangeTable loads the sources referenced by cfg, compiles them and starts watching
+// them for changes. The watcher outlives ctx, since the table may be shared with later
+// configs; it runs until the table is destructed.
+func newRangeTable(ctx caddy.Context, cfg rangeConfig, log *zap.Logger) (*rangeTable, error) {
+	resolver := sources.NewResolver(log)
+	resolver.Remote = cfg.Remote
+	resolver.OnRefresh = recordRefresh
+	if err := resolver.Load(ctx, cfg.entries()); err != nil {
+		return nil, fmt.Errorf("loading ranges: %w", err)
+	}
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+	opts := ip.Options{
+		Resolve: resolver.Resolve,
+		Cache:   cfg.Cache,
+		Metrics: cacheRecorder{},
+		// The process-wide tables are the same for every config, so they aren't part of the key
+		Bans:   banTable,
+		Allows: allowTable,
+	}
+	table := &rangeTable{
+		checker:  ip.NewIPCheckerWithRules(cfg.lists(), cfg.Whitelist, opts, log),
+		resolver: resolver,
+		cancel:   cancel,
+	}
+	go table.watch(watchCtx, cfg, resolver, log)
+
+	return table, nil
+}
+
+// watch keeps the table up to date: it periodically re-fetches the predefined and URL
+// ranges in use (if RefreshInterval is set) and reloads range files whose modification
+// time changed. It stops when ctx is cancelled.
+func (t *rangeTable) watch(ctx context.Context, cfg rangeConfig, resolver *sources.Resolver, log *zap.Logger) {
+	var (
+		keys     []string
+		hasFiles bool
+	)
+	for _, entry := range cfg.entries() {
+		if resolver.Refreshable(entry) {
+			keys = append(keys, entry)
+		}
+		hasFiles = hasFiles || sources.IsFile(entry)
+	}
+
+	refresh := func() {
+		changed := resolver.Refresh(keys)
+		changed = resolver.RefreshRemotes(ctx) || changed
+		if changed {
+			t.checker.Rebuild(resolver.Resolve)
+			log.Info("refreshed ranges", zap.Strings("ranges", keys))
+		}
+	}
+
+	var refreshC, fileC <-chan time.Time
+	if cfg.RefreshInterval > 0 && (len(keys) > 0 || resolver.HasRemotes()) {
+		ticker := time.NewTicker(time.Duration(cfg.RefreshInterval))
+		defer ticker.Stop()
+		refreshC = ticker.C
+
+		// Don't wait a full interval for fresh predefined ranges
+		if resolver.Refresh(keys) {
+			t.checker.Rebuild(resolver.Resolve)
+			log.Info("refreshed predefined ranges", zap.Strings("ranges", keys))
+		}
+	}
+	if hasFiles {
+		ticker := time.NewTicker(fileCheckInterval)
+		defer ticker.Stop()
+		fileC = ticker.C
+	}
+	if refreshC == nil && fileC == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-refreshC:
+			refresh()
+		case <-fileC:
+			if resolver.ReloadFiles() {
+				t.checker.Rebuild(resolver.Resolve)
+			}
+		}
+	}
+}
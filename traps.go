@@ -0,0 +1,87 @@
+package caddydefender
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"pkg.jsn.cam/caddy-defender/bans"
+)
+
+const (
+	// defaultTrapDuration is how long clients requesting a trap are banned unless Duration is set.
+	defaultTrapDuration = 24 * time.Hour
+	// trapReason is the reason recorded for bans added by traps.
+	trapReason = "trap"
+)
+
+// TrapConfig bans clients that request honeypot paths. The paths are disallowed for every crawler
+// in the robots.txt served by the handler, so only clients ignoring it fall into a trap.
+type TrapConfig struct {
+	// Responder names the responder handling requests from clients caught by a trap.
+	// Default: "" (the handler's responder)
+	Responder string `json:"responder,omitempty"`
+
+	// Paths lists the trap paths, e.g. "/wp-admin/" or a link hidden in the site's pages.
+	// Like robots.txt rules, a path matches every request path starting with it.
+	// Required.
+	Paths []string `json:"paths,omitempty"`
+
+	// Duration is how long clients requesting a trap are banned.
+	// Default: 24h
+	Duration caddy.Duration `json:"duration,omitempty"`
+}
+
+// validate checks that the paths are set and the duration and responder are valid.
+func (c *TrapConfig) validate() error {
+	if len(c.Paths) == 0 {
+		return errors.New("traps requires at least one path")
+	}
+	for _, p := range c.Paths {
+		if !strings.HasPrefix(p, "/") || p == "/" {
+			return fmt.Errorf("invalid trap path %q: must start with / and not be the root", p)
+		}
+	}
+	if c.Duration < 0 {
+		return errors.New("traps duration must not be negative")
+	}
+	if c.Responder != "" && !validResponder(c.Responder) {
+		return fmt.Errorf("invalid traps responder: %s", c.Responder)
+	}
+	return nil
+}
+
+// matches reports whether a request for path falls into a trap.
+func (c *TrapConfig) matches(path string) bool {
+	return slices.ContainsFunc(c.Paths, func(trap string) bool {
+		return strings.HasPrefix(path, trap)
+	})
+}
+
+// spec returns the ban of clients caught by a trap.
+func (c *TrapConfig) spec() bans.Spec {
+	duration := time.Duration(c.Duration)
+	if duration == 0 {
+		duration = defaultTrapDuration
+	}
+	return bans.Spec{Duration: duration, Reason: trapReason, Responder: c.Responder}
+}
+
+// applyTraps bans the client if the request fell into a trap.
+func (m *Defender) applyTraps(r *http.Request, clientIP net.IP) {
+	if m.Traps == nil || !m.Traps.matches(r.URL.Path) {
+		return
+	}
+	addr, ok := netip.AddrFromSlice(clientIP)
+	if !ok {
+		return
+	}
+	addr = addr.Unmap()
+	m.addBan(r, m.Traps.spec(), netip.PrefixFrom(addr, addr.BitLen()), "trap "+r.URL.Path)
+}
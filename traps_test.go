@@ -0,0 +1,17 @@
+package caddydefender
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrapConfigMatches(t *testing.T) {
+	traps := &TrapConfig{Paths: []string{"/wp-admin/", "/.env"}}
+
+	require.True(t, traps.matches("/wp-admin/"))
+	require.True(t, traps.matches("/wp-admin/install.php"))
+	require.True(t, traps.matches("/.env.local"))
+	require.False(t, traps.matches("/wp-admin"))
+	require.False(t, traps.matches("/"))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// catalogURL lists the AI crawlers tracked by the ai.robots.txt project.
+const catalogURL = "https://raw.githubusercontent.com/ai-robots-txt/ai.robots.txt/main/robots.json"
+
+// allKey is the catalog key holding every crawler token.
+const allKey = "ai_crawlers"
+
+// operatorKeys maps lower-cased substrings of the catalog's operator field to catalog keys.
+var operatorKeys = map[string]string{
+	"amazon":       "amazon",
+	"anthropic":    "anthropic",
+	"apple":        "apple",
+	"bytedance":    "bytedance",
+	"cohere":       "cohere",
+	"common crawl": "commoncrawl",
+	"google":       "google",
+	"huawei":       "huawei",
+	"meta":         "meta",
+	"mistral":      "mistral",
+	"openai":       "openai",
+	"perplexity":   "perplexity",
+}
+
+// excludedTokens are catalog entries that also fetch pages on behalf of people, such as link
+// previews and search indexing, so matching them would block more than AI crawlers.
+var excludedTokens = []string{
+	"applebot",
+	"facebookexternalhit",
+	"googleother",
+	"googleother-image",
+	"googleother-video",
+}
+
+var (
+	outputFile string
+	inputFile  string
+)
+
+func main() {
+	flag.StringVar(&outputFile, "output", "useragents/data/generated.go", "Output file path")
+	flag.StringVar(&inputFile, "input", "", "Read the catalog from a local robots.json instead of fetching it")
+	flag.Parse()
+
+	catalog, err := readCatalog()
+	if err != nil {
+		log.Fatalf("❌ Error reading the crawler catalog: %v", err)
+	}
+
+	userAgents := map[string][]string{}
+	for _, token := range slices.Sorted(maps.Keys(catalog)) {
+		info := catalog[token]
+		if slices.Contains(excludedTokens, strings.ToLower(token)) || hasToken(userAgents[allKey], token) {
+			continue
+		}
+		userAgents[allKey] = append(userAgents[allKey], token)
+
+		operator := strings.ToLower(info.Operator)
+		for substr, key := range operatorKeys {
+			if strings.Contains(operator, substr) {
+				userAgents[key] = append(userAgents[key], token)
+			}
+		}
+	}
+	for _, tokens := range userAgents {
+		slices.SortFunc(tokens, func(a, b string) int {
+			return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+		})
+	}
+
+	writeGoFile(userAgents, outputFile)
+	fmt.Printf("🎉 All %d crawler tokens have been successfully written to %s\n", len(userAgents[allKey]), outputFile)
+}
+
+// crawlerInfo is an entry of the ai.robots.txt catalog.
+type crawlerInfo struct {
+	Operator string `json:"operator"`
+}
+
+// readCatalog fetches the catalog, or reads it from inputFile if set.
+func readCatalog() (map[string]crawlerInfo, error) {
+	var body []byte
+	if inputFile != "" {
+		b, err := os.ReadFile(inputFile)
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	} else {
+		resp, err := http.Get(catalogURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch crawler catalog: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		}
+		if body, err = io.ReadAll(resp.Body); err != nil {
+			return nil, fmt.Errorf("failed to read crawler catalog: %v", err)
+		}
+	}
+
+	var catalog map[string]crawlerInfo
+	if err := json.Unmarshal(body, &catalog); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal crawler catalog: %v", err)
+	}
+	return catalog, nil
+}
+
+// hasToken reports whether tokens holds token, ignoring case.
+func hasToken(tokens []string, token string) bool {
+	return slices.ContainsFunc(tokens, func(t string) bool { return strings.EqualFold(t, token) })
+}
+
+// writeGoFile writes the catalog to a Go file.
+func writeGoFile(userAgents map[string][]string, outputFile string) {
+	const goTemplate = `package data
+
+// Code generated by pkg.jsn.cam/caddy-defender/blob/main/useragents/main.go; DO NOT EDIT.
+
+var UserAgents = map[string][]string{
+	{{- range $key, $values := . }}
+	"{{ $key }}": { {{- range $index, $value := $values }}
+		"{{ $value }}",{{- end }}
+	},{{- end }}
+}
+`
+
+	file, err := os.Create(outputFile)
+	if err != nil {
+		log.Fatalf("Failed to create output file: %v", err)
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Fatalf("Error closing file: %v", err)
+		}
+	}(file)
+
+	t := template.Must(template.New("code").Parse(goTemplate))
+	if err := t.Execute(file, userAgents); err != nil {
+		log.Panicf("Failed to execute template: %v", err)
+	}
+}